@@ -0,0 +1,629 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/debco/internal/debstore"
+	"github.com/dpeckett/debco/internal/util/diskcache"
+	"github.com/dpeckett/debco/internal/util/hashreader"
+)
+
+// Options configures a proxy server.
+type Options struct {
+	// Cache stores release files and package indexes.
+	Cache *diskcache.DiskCache
+	// Store stores packages.
+	Store *debstore.Store
+	// Keyring contains the keys trusted to sign release files.
+	Keyring openpgp.EntityList
+	// Upstreams are the URLs of the repositories that may be proxied (eg.
+	// "https://deb.debian.org/debian"). Only the dists and pool directories of
+	// the repositories are proxied, over either http or https.
+	Upstreams []*url.URL
+	// Client is used for upstream requests (defaults to http.DefaultClient).
+	Client *http.Client
+}
+
+// Server is a caching APT proxy (in the style of apt-cacher-ng).
+//
+// Upstream URLs are encoded in the request path (see ProxyURL). Release files
+// are only cached once their signature has been verified, package indexes
+// once their hash has been verified against the release, and packages once
+// their hash has been verified against a package index that was served by the
+// proxy. Anything that can't be verified is passed through without being
+// cached. Requests for anything other than the dists and pool directories of
+// the allowed upstream repositories are rejected.
+type Server struct {
+	cache     *diskcache.DiskCache
+	store     *debstore.Store
+	keyring   openpgp.EntityList
+	upstreams []*url.URL
+	client    *http.Client
+
+	mu sync.Mutex
+	// releases are the verified release files, keyed by URL.
+	releases map[string]*types.Release
+	// packageHashes are the SHA256 sums of packages, keyed by URL.
+	packageHashes map[string]string
+	// indexed records the package indexes (by SHA256 sum) that have been read
+	// into packageHashes.
+	indexed map[string]bool
+}
+
+// NewServer creates a new proxy server.
+func NewServer(opts Options) *Server {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Server{
+		cache:         opts.Cache,
+		store:         opts.Store,
+		keyring:       opts.Keyring,
+		upstreams:     opts.Upstreams,
+		client:        client,
+		releases:      make(map[string]*types.Release),
+		packageHashes: make(map[string]string),
+		indexed:       make(map[string]bool),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	upstreamURL, err := UpstreamURL(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowed(upstreamURL) {
+		slog.Warn("Rejecting request for disallowed upstream", slog.String("url", upstreamURL.String()))
+
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	slog.Debug("Proxying request", slog.String("url", upstreamURL.String()))
+
+	if strings.HasSuffix(upstreamURL.Path, ".deb") {
+		err = s.servePackage(w, r, upstreamURL)
+	} else if releaseURL, relPath, ok := splitDists(upstreamURL); ok {
+		if relPath == "InRelease" {
+			err = s.serveRelease(w, r, upstreamURL, releaseURL)
+		} else {
+			err = s.serveIndex(w, r, upstreamURL, releaseURL, relPath)
+		}
+	} else {
+		err = s.passthrough(w, r, upstreamURL)
+	}
+	if err != nil {
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) {
+			http.Error(w, http.StatusText(upstreamErr.StatusCode), upstreamErr.StatusCode)
+			return
+		}
+
+		slog.Warn("Error proxying request", slog.String("url", upstreamURL.String()), slog.Any("error", err))
+
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func (s *Server) serveRelease(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, releaseURL string) error {
+	if _, err := s.fetchRelease(r.Context(), releaseURL); err != nil {
+		// Releases signed by keys that aren't trusted by the proxy can still be
+		// verified by the client.
+		var verifyErr *verifyError
+		if errors.As(err, &verifyErr) {
+			slog.Warn("Unable to verify release, passing it through without caching (is the key trusted with --signed-by?)",
+				slog.String("url", releaseURL), slog.Any("error", err))
+
+			return s.passthrough(w, r, upstreamURL)
+		}
+
+		return err
+	}
+
+	return s.serveCached(w, r, releaseURL, "InRelease")
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, releaseURL, relPath string) error {
+	byHash := path.Base(path.Dir(relPath)) == "SHA256" && path.Base(path.Dir(path.Dir(relPath))) == "by-hash"
+
+	var expectedSHA256 string
+	if byHash {
+		expectedSHA256 = path.Base(relPath)
+	} else {
+		release, err := s.loadRelease(r.Context(), releaseURL)
+		if err == nil {
+			expectedSHA256 = releaseSHA256(release, relPath)
+
+			// The cached release might be out of date.
+			if expectedSHA256 == "" {
+				release, err = s.fetchRelease(r.Context(), releaseURL)
+				if err == nil {
+					expectedSHA256 = releaseSHA256(release, relPath)
+				}
+			}
+		}
+		if err != nil {
+			slog.Debug("Unable to load release", slog.String("url", releaseURL), slog.Any("error", err))
+		}
+	}
+
+	// Without a hash, the index can't be verified.
+	if expectedSHA256 == "" {
+		return s.passthrough(w, r, upstreamURL)
+	}
+
+	// Index files are immutable for a given hash.
+	key := "sha256:" + expectedSHA256
+
+	if resp, ok := s.cache.Get(key, nil); ok {
+		_ = resp.Body.Close()
+	} else if err := s.fetchIndex(r.Context(), upstreamURL, key, expectedSHA256); err != nil {
+		return err
+	}
+
+	// Read the hashes of the packages listed in package indexes.
+	if strings.HasPrefix(path.Base(relPath), "Packages") || (byHash && strings.Contains(relPath, "/binary-")) {
+		repoURL := *upstreamURL
+		repoURL.Path = upstreamURL.Path[:strings.LastIndex(upstreamURL.Path, "/dists/")]
+		repoURL.RawQuery = ""
+
+		if err := s.indexPackages(&repoURL, key, expectedSHA256); err != nil {
+			slog.Warn("Unable to read package index",
+				slog.String("url", upstreamURL.String()), slog.Any("error", err))
+		}
+	}
+
+	return s.serveCached(w, r, key, path.Base(upstreamURL.Path))
+}
+
+func (s *Server) servePackage(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL) error {
+	s.mu.Lock()
+	sha256, ok := s.packageHashes[upstreamURL.String()]
+	s.mu.Unlock()
+
+	// Without a hash, the package can't be verified.
+	if !ok {
+		return s.passthrough(w, r, upstreamURL)
+	}
+
+	storedPath, ok := s.store.Get(sha256)
+	if !ok {
+		resp, err := s.get(r.Context(), upstreamURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		storedPath, err = s.store.Put(sha256, resp.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(storedPath)
+	if err != nil {
+		return fmt.Errorf("failed to open package: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat package: %w", err)
+	}
+
+	http.ServeContent(w, r, path.Base(upstreamURL.Path), fi.ModTime(), f)
+
+	return nil
+}
+
+// passthrough forwards the request upstream without caching the response.
+func (s *Server) passthrough(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL) error {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Debug("Error forwarding response", slog.String("url", upstreamURL.String()), slog.Any("error", err))
+	}
+
+	return nil
+}
+
+// fetchRelease downloads (or revalidates) the release file, verifies its
+// signature, and stores it in the cache. If the upstream repository is not
+// reachable, the cached release is used instead.
+func (s *Server) fetchRelease(ctx context.Context, releaseURL string) (*types.Release, error) {
+	header := make(http.Header)
+
+	cachedResp, cached := s.cache.Get(releaseURL, nil)
+	if cached {
+		_ = cachedResp.Body.Close()
+
+		if etag := cachedResp.Header.Get("ETag"); etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		if lastModified := cachedResp.Header.Get("Last-Modified"); lastModified != "" {
+			header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := s.get(ctx, releaseURL, header)
+	if err != nil {
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusNotModified && cached {
+			return s.cachedRelease(releaseURL)
+		}
+
+		if !errors.As(err, &upstreamErr) && cached {
+			slog.Warn("Upstream repository is unavailable, using cached release",
+				slog.String("url", releaseURL), slog.Any("error", err))
+
+			return s.cachedRelease(releaseURL)
+		}
+
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release: %w", err)
+	}
+
+	release, err := s.verifyRelease(data)
+	if err != nil {
+		return nil, &verifyError{URL: releaseURL, Err: err}
+	}
+
+	if err := s.cacheResponse(releaseURL, resp, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.releases[releaseURL] = release
+	s.mu.Unlock()
+
+	return release, nil
+}
+
+// loadRelease returns the verified release file, only downloading it if it
+// hasn't been cached.
+func (s *Server) loadRelease(ctx context.Context, releaseURL string) (*types.Release, error) {
+	if release, err := s.cachedRelease(releaseURL); err == nil {
+		return release, nil
+	}
+
+	return s.fetchRelease(ctx, releaseURL)
+}
+
+func (s *Server) cachedRelease(releaseURL string) (*types.Release, error) {
+	s.mu.Lock()
+	release, ok := s.releases[releaseURL]
+	s.mu.Unlock()
+	if ok {
+		return release, nil
+	}
+
+	resp, ok := s.cache.Get(releaseURL, nil)
+	if !ok {
+		return nil, fmt.Errorf("release %s is not cached", releaseURL)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached release: %w", err)
+	}
+
+	release, err = s.verifyRelease(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify cached release %s: %w", releaseURL, err)
+	}
+
+	s.mu.Lock()
+	s.releases[releaseURL] = release
+	s.mu.Unlock()
+
+	return release, nil
+}
+
+func (s *Server) verifyRelease(data []byte) (*types.Release, error) {
+	decoder, err := deb822.NewDecoder(bytes.NewReader(data), s.keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	if decoder.Signer() == nil {
+		return nil, errors.New("release is not signed by a trusted key")
+	}
+
+	var release types.Release
+	if err := decoder.Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal release: %w", err)
+	}
+
+	return &release, nil
+}
+
+// fetchIndex downloads the index file, and stores it in the cache once its
+// hash has been verified.
+func (s *Server) fetchIndex(ctx context.Context, upstreamURL *url.URL, key, expectedSHA256 string) error {
+	resp, err := s.get(ctx, upstreamURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.CreateTemp("", "debco-proxy-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	hr := hashreader.NewReader(resp.Body)
+	if _, err := io.Copy(f, hr); err != nil {
+		return fmt.Errorf("failed to download index: %w", err)
+	}
+
+	if err := hr.Verify(expectedSHA256); err != nil {
+		return fmt.Errorf("failed to verify %s: %w", upstreamURL, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.cacheResponse(key, resp, f)
+}
+
+// indexPackages records the hashes of the packages listed in the (verified)
+// package index, so that the packages can be verified when they are requested.
+func (s *Server) indexPackages(repoURL *url.URL, key, sha256 string) error {
+	s.mu.Lock()
+	indexed := s.indexed[sha256]
+	s.mu.Unlock()
+	if indexed {
+		return nil
+	}
+
+	resp, ok := s.cache.Get(key, nil)
+	if !ok {
+		return fmt.Errorf("package index %s is not cached", key)
+	}
+	defer resp.Body.Close()
+
+	dr, err := compressmagic.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decompress package index: %w", err)
+	}
+	defer dr.Close()
+
+	decoder, err := deb822.NewDecoder(dr, nil)
+	if err != nil {
+		return err
+	}
+
+	var packageList []types.Package
+	if err := decoder.Decode(&packageList); err != nil {
+		return fmt.Errorf("failed to unmarshal package index: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pkg := range packageList {
+		if pkg.Filename == "" || pkg.SHA256 == "" {
+			continue
+		}
+
+		packageURL := *repoURL
+		packageURL.Path = path.Join(repoURL.Path, pkg.Filename)
+
+		s.packageHashes[packageURL.String()] = pkg.SHA256
+	}
+
+	s.indexed[sha256] = true
+
+	return nil
+}
+
+// cacheResponse writes the (verified) body of the response to the cache.
+func (s *Server) cacheResponse(key string, resp *http.Response, body io.Reader) error {
+	cachedResp := &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+		Header:     resp.Header.Clone(),
+		Body:       io.NopCloser(body),
+	}
+
+	s.cache.Set(key, cachedResp)
+
+	if _, err := io.Copy(io.Discard, cachedResp.Body); err != nil {
+		_ = cachedResp.Body.Close()
+		return fmt.Errorf("failed to cache response: %w", err)
+	}
+
+	return cachedResp.Body.Close()
+}
+
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, key, name string) error {
+	resp, ok := s.cache.Get(key, nil)
+	if !ok {
+		return fmt.Errorf("%s is not cached", key)
+	}
+	defer resp.Body.Close()
+
+	body, ok := resp.Body.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("cached response for %s is not seekable", key)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	http.ServeContent(w, r, name, lastModified, body)
+
+	return nil
+}
+
+func (s *Server) get(ctx context.Context, upstreamURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, &upstreamError{StatusCode: resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+// splitDists splits the URL of a file in the dists directory of a repository
+// into the URL of the release file, and the path of the file relative to the
+// release.
+func splitDists(upstreamURL *url.URL) (string, string, bool) {
+	i := strings.LastIndex(upstreamURL.Path, "/dists/")
+	if i < 0 {
+		return "", "", false
+	}
+
+	distribution, relPath, ok := strings.Cut(upstreamURL.Path[i+len("/dists/"):], "/")
+	if !ok || distribution == "" || relPath == "" {
+		return "", "", false
+	}
+
+	releaseURL := *upstreamURL
+	releaseURL.Path = path.Join(upstreamURL.Path[:i], "dists", distribution, "InRelease")
+	releaseURL.RawQuery = ""
+
+	return releaseURL.String(), relPath, true
+}
+
+// allowed returns true if the upstream URL is within the dists or pool
+// directory of one of the allowed upstream repositories.
+func (s *Server) allowed(upstreamURL *url.URL) bool {
+	for _, repoURL := range s.upstreams {
+		if !strings.EqualFold(upstreamURL.Host, repoURL.Host) {
+			continue
+		}
+
+		relPath, ok := strings.CutPrefix(upstreamURL.Path, strings.TrimSuffix(repoURL.Path, "/")+"/")
+		if ok && (strings.HasPrefix(relPath, "dists/") || strings.HasPrefix(relPath, "pool/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func releaseSHA256(release *types.Release, relPath string) string {
+	for _, hash := range release.SHA256 {
+		if hash.Filename == relPath {
+			return hash.Hash
+		}
+	}
+
+	return ""
+}
+
+// verifyError is returned when a release file can't be verified.
+type verifyError struct {
+	URL string
+	Err error
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("failed to verify %s: %v", e.URL, e.Err)
+}
+
+func (e *verifyError) Unwrap() error {
+	return e.Err
+}
+
+type upstreamError struct {
+	StatusCode int
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("unexpected upstream status: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/aptproxy"
+	"github.com/dpeckett/debco/internal/aptrepo"
+	"github.com/dpeckett/debco/internal/debgen"
+	"github.com/dpeckett/debco/internal/debstore"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/source"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/dpeckett/debco/internal/util/diskcache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	signer, err := aptrepo.GenerateKey("Test Repository", "")
+	require.NoError(t, err)
+
+	repoDir := t.TempDir()
+	packagePath := filepath.Join(t.TempDir(), "foo.deb")
+
+	f, err := os.Create(packagePath)
+	require.NoError(t, err)
+	require.NoError(t, debgen.Write(f, types.Package{
+		Name:         "foo",
+		Version:      version.MustParse("1.0"),
+		Architecture: arch.MustParse("amd64"),
+		Description:  "Test package",
+	}, nil))
+	require.NoError(t, f.Close())
+
+	_, err = aptrepo.Add(repoDir, packagePath, aptrepo.Options{})
+	require.NoError(t, err)
+
+	require.NoError(t, aptrepo.Publish(repoDir, signer, aptrepo.Options{}))
+
+	keyPath := filepath.Join(t.TempDir(), "signing_key.asc")
+	f, err = os.Create(keyPath)
+	require.NoError(t, err)
+	require.NoError(t, aptrepo.WritePublicKey(f, signer))
+	require.NoError(t, f.Close())
+
+	var requests atomic.Int32
+	var tampered atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if tampered.Load() && strings.HasSuffix(r.URL.Path, "/Packages") {
+			_, _ = w.Write([]byte("Package: evil\n"))
+			return
+		}
+
+		http.FileServer(http.Dir(repoDir)).ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cache, err := diskcache.NewDiskCache(t.TempDir(), "proxy")
+	require.NoError(t, err)
+
+	store, err := debstore.New(t.TempDir())
+	require.NoError(t, err)
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(aptproxy.NewServer(aptproxy.Options{
+		Cache:     cache,
+		Store:     store,
+		Keyring:   openpgp.EntityList{signer},
+		Upstreams: []*url.URL{upstreamURL},
+	}))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &aptproxy.Transport{Proxy: proxyURL}}
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = client
+	t.Cleanup(func() {
+		http.DefaultClient = defaultClient
+	})
+
+	loadPackages := func(t *testing.T) []string {
+		s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+			URL:      upstream.URL,
+			SignedBy: keyPath,
+		})
+		require.NoError(t, err)
+
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+		require.Len(t, components, 1)
+
+		packageList, _, err := components[0].Packages(ctx)
+		require.NoError(t, err)
+		require.Len(t, packageList, 1)
+
+		return packageList[0].URLs
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		packageURLs := loadPackages(t)
+
+		resp, err := client.Get(packageURLs[0])
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		entries, err := store.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		// Only the release should be revalidated.
+		requests.Store(0)
+
+		packageURLs = loadPackages(t)
+
+		resp, err = client.Get(packageURLs[0])
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		require.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Tampered Index", func(t *testing.T) {
+		tampered.Store(true)
+		t.Cleanup(func() {
+			tampered.Store(false)
+		})
+
+		resp, err := client.Get(upstream.URL + "/dists/stable/main/binary-amd64/Packages")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("Untrusted Release", func(t *testing.T) {
+		untrustedCache, err := diskcache.NewDiskCache(t.TempDir(), "proxy")
+		require.NoError(t, err)
+
+		untrustedProxy := httptest.NewServer(aptproxy.NewServer(aptproxy.Options{
+			Cache:     untrustedCache,
+			Store:     store,
+			Upstreams: []*url.URL{upstreamURL},
+		}))
+		t.Cleanup(untrustedProxy.Close)
+
+		untrustedProxyURL, err := url.Parse(untrustedProxy.URL)
+		require.NoError(t, err)
+
+		releaseURL := upstream.URL + "/dists/stable/InRelease"
+
+		u, err := url.Parse(releaseURL)
+		require.NoError(t, err)
+
+		// The release is passed through (for the client to verify), but not
+		// cached.
+		resp, err := defaultClient.Get(aptproxy.ProxyURL(untrustedProxyURL, u).String())
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, ok := untrustedCache.Get(releaseURL, nil)
+		require.False(t, ok)
+	})
+
+	t.Run("Disallowed", func(t *testing.T) {
+		for _, disallowedURL := range []string{
+			"http://169.254.169.254/latest/meta-data/",
+			"http://169.254.169.254/dists/stable/InRelease",
+			upstream.URL + "/signing_key.asc",
+			upstream.URL + "/dists/../signing_key.asc",
+		} {
+			u, err := url.Parse(disallowedURL)
+			require.NoError(t, err)
+
+			resp, err := defaultClient.Get(aptproxy.ProxyURL(proxyURL, u).String())
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+
+			require.Equal(t, http.StatusForbidden, resp.StatusCode, disallowedURL)
+		}
+	})
+}
+
+func TestProxyURL(t *testing.T) {
+	proxyURL, err := url.Parse("http://proxy:3142")
+	require.NoError(t, err)
+
+	upstreamURL, err := url.Parse("https://deb.debian.org/debian/dists/bookworm/InRelease?foo=bar")
+	require.NoError(t, err)
+
+	u := aptproxy.ProxyURL(proxyURL, upstreamURL)
+	require.Equal(t, "http://proxy:3142/https/deb.debian.org/debian/dists/bookworm/InRelease?foo=bar", u.String())
+
+	decodedURL, err := aptproxy.UpstreamURL(u)
+	require.NoError(t, err)
+	require.Equal(t, upstreamURL.String(), decodedURL.String())
+
+	_, err = aptproxy.UpstreamURL(&url.URL{Path: "/ftp/example.com/foo"})
+	require.Error(t, err)
+
+	_, err = aptproxy.UpstreamURL(&url.URL{Path: "/http/user@example.com/foo"})
+	require.Error(t, err)
+
+	decodedURL, err = aptproxy.UpstreamURL(&url.URL{Path: "/http/example.com/debian/dists/../../etc/passwd"})
+	require.NoError(t, err)
+	require.Equal(t, "/etc/passwd", decodedURL.Path)
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Transport is a http.RoundTripper that routes requests through a proxy
+// server.
+type Transport struct {
+	// Proxy is the URL of the proxy server.
+	Proxy *url.URL
+	// Transport is the underlying transport (defaults to http.DefaultTransport).
+	Transport http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// Local files (eg. file:// URLs) are never proxied.
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return transport.RoundTrip(req)
+	}
+
+	proxyReq := req.Clone(req.Context())
+	proxyReq.URL = ProxyURL(t.Proxy, req.URL)
+	proxyReq.Host = ""
+
+	return transport.RoundTrip(proxyReq)
+}
+
+// ProxyURL returns the URL used to request the upstream URL through the
+// proxy. The scheme and host of the upstream URL are encoded in the path, eg.
+// "https://deb.debian.org/debian/dists/bookworm/InRelease" becomes
+// "http://proxy:3142/https/deb.debian.org/debian/dists/bookworm/InRelease".
+func ProxyURL(proxy, upstreamURL *url.URL) *url.URL {
+	proxyURL := *proxy
+	proxyURL.Path = path.Join("/", proxy.Path, upstreamURL.Scheme, upstreamURL.Host, upstreamURL.Path)
+	proxyURL.RawPath = ""
+	proxyURL.RawQuery = upstreamURL.RawQuery
+
+	return &proxyURL
+}
+
+// UpstreamURL decodes the upstream URL from the URL of a proxy request.
+func UpstreamURL(reqURL *url.URL) (*url.URL, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimPrefix(reqURL.Path, "/"), "/")
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream URL scheme: %q", scheme)
+	}
+
+	host, upstreamPath, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return nil, fmt.Errorf("missing upstream host")
+	}
+
+	if strings.Contains(host, "@") {
+		return nil, fmt.Errorf("invalid upstream host: %q", host)
+	}
+
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path.Clean("/" + upstreamPath),
+		RawQuery: reqURL.RawQuery,
+	}, nil
+}
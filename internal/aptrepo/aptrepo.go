@@ -0,0 +1,451 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptrepo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/deb822"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/filehash"
+	debtime "github.com/dpeckett/deb822/types/time"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/unpack"
+)
+
+const (
+	// DefaultDistribution is the default distribution of a repository.
+	DefaultDistribution = "stable"
+	// DefaultComponent is the default component of a repository.
+	DefaultComponent = "main"
+	// PublicKeyFile is the name of the public key of a repository (relative
+	// to the repository directory).
+	PublicKeyFile = "signing_key.asc"
+)
+
+// Options configures a published repository.
+type Options struct {
+	// Distribution is the name of the distribution (defaults to "stable").
+	Distribution string
+	// Component is the name of the component packages are added to (defaults
+	// to "main"). Every component in the pool is published.
+	Component string
+	// Architectures are published in addition to the architectures of the
+	// packages in the pool (eg. so that a repository of architecture
+	// independent packages can be used on any architecture).
+	Architectures []string
+	// Origin is the origin of the repository.
+	Origin string
+	// Label is the label of the repository.
+	Label string
+	// Description is a description of the repository.
+	Description string
+}
+
+// Init creates an empty repository in dir, that is signed by the signer.
+func Init(dir string, signer *openpgp.Entity) error {
+	if err := os.MkdirAll(filepath.Join(dir, "pool"), 0o755); err != nil {
+		return fmt.Errorf("failed to create repository directory: %w", err)
+	}
+
+	return SavePublicKey(filepath.Join(dir, PublicKeyFile), signer)
+}
+
+// Check checks that the directory is a repository (created by Init).
+func Check(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "pool")); err != nil {
+		return fmt.Errorf("%s is not a repository (create it with 'debco repo init'): %w", dir, err)
+	}
+
+	return nil
+}
+
+// Add copies a package file into the pool of the repository in dir,
+// returning the control metadata of the package.
+func Add(dir, packagePath string, opts Options) (*debtypes.Package, error) {
+	control, err := unpack.ReadControl(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package %s: %w", packagePath, err)
+	}
+
+	poolPath := filepath.Join(dir, filepath.FromSlash(poolFilename(control, component(opts))))
+	if err := os.MkdirAll(filepath.Dir(poolPath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create pool directory: %w", err)
+	}
+
+	if err := copyFile(packagePath, poolPath); err != nil {
+		return nil, fmt.Errorf("failed to copy package %s: %w", packagePath, err)
+	}
+
+	return control, nil
+}
+
+// Publish generates the package indexes, and a signed release file, for all
+// the packages in the pool of the repository in dir (every component in the
+// pool is published). Any previously published indexes for the distribution
+// are replaced, and the public key of the signer is written to the repository
+// (in case the signing key has changed).
+func Publish(dir string, signer *openpgp.Entity, opts Options) error {
+	distribution := opts.Distribution
+	if distribution == "" {
+		distribution = DefaultDistribution
+	}
+
+	components, err := poolComponents(dir)
+	if err != nil {
+		return err
+	}
+
+	// An empty repository is published with the default component.
+	if len(components) == 0 {
+		components = []string{component(opts)}
+	}
+
+	// Architecture independent packages are listed in the indexes of every
+	// architecture.
+	allArch := arch.MustParse("all")
+	architectures := map[string]bool{}
+	for _, a := range opts.Architectures {
+		architectures[a] = true
+	}
+
+	packageLists := map[string][]debtypes.Package{}
+	for _, comp := range components {
+		packageList, err := readPool(dir, comp)
+		if err != nil {
+			return err
+		}
+
+		for _, pkg := range packageList {
+			if !pkg.Architecture.Is(&allArch) {
+				architectures[pkg.Architecture.String()] = true
+			}
+		}
+
+		packageLists[comp] = packageList
+	}
+	if len(architectures) == 0 {
+		architectures["all"] = true
+	}
+
+	distDir := filepath.Join(dir, "dists", distribution)
+	if err := os.RemoveAll(distDir); err != nil {
+		return fmt.Errorf("failed to remove existing indexes: %w", err)
+	}
+
+	release := debtypes.Release{
+		Origin:      opts.Origin,
+		Label:       opts.Label,
+		Suite:       distribution,
+		Codename:    distribution,
+		Date:        debtime.Time(time.Now().UTC()),
+		Components:  components,
+		Description: opts.Description,
+	}
+
+	for _, archName := range sortedKeys(architectures) {
+		targetArch, err := arch.Parse(archName)
+		if err != nil {
+			return fmt.Errorf("invalid architecture %q: %w", archName, err)
+		}
+		release.Architectures = append(release.Architectures, targetArch)
+	}
+
+	for _, comp := range components {
+		for _, targetArch := range release.Architectures {
+			var archPackages []debtypes.Package
+			for _, pkg := range packageLists[comp] {
+				if pkg.Architecture.Is(&allArch) || pkg.Architecture.Is(&targetArch) {
+					archPackages = append(archPackages, pkg)
+				}
+			}
+
+			var packagesIndex bytes.Buffer
+			if len(archPackages) > 0 {
+				if err := deb822.Marshal(&packagesIndex, archPackages); err != nil {
+					return fmt.Errorf("failed to marshal packages: %w", err)
+				}
+			}
+
+			indexDir := path.Join(comp, "binary-"+targetArch.String())
+			for _, name := range []string{"Packages", "Packages.xz"} {
+				hash, err := writeIndex(filepath.Join(distDir, filepath.FromSlash(indexDir), name), packagesIndex.Bytes())
+				if err != nil {
+					return fmt.Errorf("failed to write %s: %w", name, err)
+				}
+
+				hash.Filename = path.Join(indexDir, name)
+				release.SHA256 = append(release.SHA256, *hash)
+			}
+		}
+	}
+
+	var releaseFile bytes.Buffer
+	if err := deb822.Marshal(&releaseFile, release); err != nil {
+		return fmt.Errorf("failed to marshal release: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distDir, "Release"), releaseFile.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write release: %w", err)
+	}
+
+	// Sign the release.
+	var inRelease bytes.Buffer
+	w, err := clearsign.Encode(&inRelease, signer.PrivateKey, nil)
+	if err != nil {
+		return fmt.Errorf("failed to sign release: %w", err)
+	}
+
+	if _, err := w.Write(releaseFile.Bytes()); err != nil {
+		return fmt.Errorf("failed to sign release: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to sign release: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distDir, "InRelease"), inRelease.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write signed release: %w", err)
+	}
+
+	var releaseSignature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&releaseSignature, signer, bytes.NewReader(releaseFile.Bytes()), nil); err != nil {
+		return fmt.Errorf("failed to sign release: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distDir, "Release.gpg"), releaseSignature.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write release signature: %w", err)
+	}
+
+	return SavePublicKey(filepath.Join(dir, PublicKeyFile), signer)
+}
+
+// poolComponents returns the (sorted) names of the components in the pool of
+// the repository in dir.
+func poolComponents(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(dir, "pool"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read pool: %w", err)
+	}
+
+	var components []string
+	for _, e := range dirEntries {
+		if e.IsDir() {
+			components = append(components, e.Name())
+		}
+	}
+
+	return components, nil
+}
+
+// readPool reads the control metadata of every package in the pool of the
+// component.
+func readPool(dir, comp string) ([]debtypes.Package, error) {
+	var packageList []debtypes.Package
+
+	poolDir := filepath.Join(dir, "pool", comp)
+	err := filepath.WalkDir(poolDir, func(packagePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && packagePath == poolDir {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".deb") {
+			return nil
+		}
+
+		control, err := unpack.ReadControl(packagePath)
+		if err != nil {
+			return fmt.Errorf("failed to read package %s: %w", packagePath, err)
+		}
+
+		f, err := os.Open(packagePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		if err != nil {
+			return fmt.Errorf("failed to read package %s: %w", packagePath, err)
+		}
+
+		relPath, err := filepath.Rel(dir, packagePath)
+		if err != nil {
+			return err
+		}
+
+		control.Filename = filepath.ToSlash(relPath)
+		control.Size = int(size)
+		control.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+		packageList = append(packageList, *control)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool: %w", err)
+	}
+
+	sort.Slice(packageList, func(i, j int) bool {
+		return packageList[i].Compare(packageList[j]) < 0
+	})
+
+	return packageList, nil
+}
+
+// writeIndex writes an index file (compressed according to its extension),
+// returning the hash of the written file.
+func writeIndex(indexPath string, data []byte) (*filehash.FileHash, error) {
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+
+	var w io.WriteCloser = nopWriteCloser{cw}
+	if filepath.Ext(indexPath) != "" {
+		w, err = compressmagic.NewWriter(cw, indexPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return &filehash.FileHash{
+		Hash: hex.EncodeToString(h.Sum(nil)),
+		Size: cw.n,
+	}, nil
+}
+
+// poolFilename returns the path (relative to the repository) of a package
+// in the pool, following the Debian archive layout (eg.
+// "pool/main/b/bash/bash_5.2.15-2+b2_amd64.deb").
+func poolFilename(control *debtypes.Package, comp string) string {
+	prefix := control.Name[:1]
+	if strings.HasPrefix(control.Name, "lib") && len(control.Name) > 3 {
+		prefix = control.Name[:4]
+	}
+
+	// Filenames don't include the epoch.
+	pkgVersion := version.Version{
+		Version:  control.Version.Version,
+		Revision: control.Version.Revision,
+	}
+
+	filename := fmt.Sprintf("%s_%s_%s.deb", control.Name, pkgVersion, control.Architecture)
+
+	return path.Join("pool", comp, prefix, control.Name, filename)
+}
+
+func component(opts Options) string {
+	if opts.Component == "" {
+		return DefaultComponent
+	}
+
+	return opts.Component
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	return dstFile.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
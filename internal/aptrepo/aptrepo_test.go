@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptrepo_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/aptrepo"
+	"github.com/dpeckett/debco/internal/debgen"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/source"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	signer, err := aptrepo.GenerateKey("Test Repository", "test@example.com")
+	require.NoError(t, err)
+
+	packagesDir := t.TempDir()
+	repoDir := t.TempDir()
+
+	for _, control := range []types.Package{
+		{
+			Name:         "foo",
+			Version:      version.MustParse("1:1.0-1"),
+			Architecture: arch.MustParse("amd64"),
+			Description:  "Test package",
+		},
+		{
+			Name:         "libbar",
+			Version:      version.MustParse("2.0"),
+			Architecture: arch.MustParse("all"),
+			Description:  "Test library",
+		},
+	} {
+		packagePath := filepath.Join(packagesDir, control.Name+".deb")
+
+		f, err := os.Create(packagePath)
+		require.NoError(t, err)
+		require.NoError(t, debgen.Write(f, control, nil))
+		require.NoError(t, f.Close())
+
+		_, err = aptrepo.Add(repoDir, packagePath, aptrepo.Options{})
+		require.NoError(t, err)
+	}
+
+	require.FileExists(t, filepath.Join(repoDir, "pool/main/f/foo/foo_1.0-1_amd64.deb"))
+	require.FileExists(t, filepath.Join(repoDir, "pool/main/libb/libbar/libbar_2.0_all.deb"))
+
+	require.NoError(t, aptrepo.Publish(repoDir, signer, aptrepo.Options{
+		Architectures: []string{"arm64"},
+	}))
+
+	// The public key is written to the repository.
+	keyPath := filepath.Join(repoDir, aptrepo.PublicKeyFile)
+	require.FileExists(t, keyPath)
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	t.Cleanup(srv.Close)
+
+	s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+		URL:      srv.URL,
+		SignedBy: keyPath,
+	})
+	require.NoError(t, err)
+
+	t.Run("Architecture Specific", func(t *testing.T) {
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+		require.Len(t, components, 1)
+
+		packageList, _, err := components[0].Packages(ctx)
+		require.NoError(t, err)
+		require.Len(t, packageList, 2)
+
+		require.Equal(t, "foo", packageList[0].Name)
+		require.Equal(t, "1:1.0-1", packageList[0].Version.String())
+		require.Equal(t, []string{srv.URL + "/pool/main/f/foo/foo_1.0-1_amd64.deb"}, packageList[0].URLs)
+		require.NotEmpty(t, packageList[0].SHA256)
+
+		require.Equal(t, "libbar", packageList[1].Name)
+	})
+
+	t.Run("Architecture Independent", func(t *testing.T) {
+		components, err := s.Components(ctx, arch.MustParse("arm64"))
+		require.NoError(t, err)
+		require.Len(t, components, 1)
+
+		packageList, _, err := components[0].Packages(ctx)
+		require.NoError(t, err)
+		require.Len(t, packageList, 1)
+
+		require.Equal(t, "libbar", packageList[0].Name)
+	})
+
+	t.Run("Multiple Components", func(t *testing.T) {
+		// Publishing again after adding to another component keeps the
+		// existing components.
+		_, err := aptrepo.Add(repoDir, filepath.Join(packagesDir, "foo.deb"), aptrepo.Options{Component: "contrib"})
+		require.NoError(t, err)
+
+		require.NoError(t, aptrepo.Publish(repoDir, signer, aptrepo.Options{}))
+
+		s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+			URL:        srv.URL,
+			SignedBy:   keyPath,
+			Components: []string{"main", "contrib"},
+		})
+		require.NoError(t, err)
+
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+		require.Len(t, components, 2)
+
+		packageLists := map[string][]string{}
+		for _, component := range components {
+			packageList, _, err := component.Packages(ctx)
+			require.NoError(t, err)
+
+			for _, pkg := range packageList {
+				packageLists[component.Name] = append(packageLists[component.Name], pkg.URLs...)
+			}
+		}
+
+		require.Equal(t, map[string][]string{
+			"main": {
+				srv.URL + "/pool/main/f/foo/foo_1.0-1_amd64.deb",
+				srv.URL + "/pool/main/libb/libbar/libbar_2.0_all.deb",
+			},
+			"contrib": {
+				srv.URL + "/pool/contrib/f/foo/foo_1.0-1_amd64.deb",
+			},
+		}, packageLists)
+	})
+
+	t.Run("Private Key", func(t *testing.T) {
+		keyPath := filepath.Join(t.TempDir(), "private_key.asc")
+
+		f, err := os.Create(keyPath)
+		require.NoError(t, err)
+		require.NoError(t, aptrepo.WritePrivateKey(f, signer))
+		require.NoError(t, f.Close())
+
+		f, err = os.Open(keyPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		key, err := aptrepo.ReadPrivateKey(f)
+		require.NoError(t, err)
+
+		require.Equal(t, signer.PrimaryKey.Fingerprint, key.PrimaryKey.Fingerprint)
+	})
+}
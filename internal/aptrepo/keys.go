@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptrepo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// GenerateKey generates a new OpenPGP key for signing repositories.
+func GenerateKey(name, email string) (*openpgp.Entity, error) {
+	entity, err := openpgp.NewEntity(name, "Repository signing key", email, &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	return entity, nil
+}
+
+// ReadPrivateKey reads an armored OpenPGP private key.
+func ReadPrivateKey(r io.Reader) (*openpgp.Entity, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil {
+			return entity, nil
+		}
+	}
+
+	return nil, errors.New("no private key found")
+}
+
+// WritePrivateKey writes the OpenPGP private key in armored form.
+func WritePrivateKey(w io.Writer, entity *openpgp.Entity) error {
+	aw, err := armor.Encode(w, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := entity.SerializePrivate(aw, nil); err != nil {
+		return fmt.Errorf("failed to serialize private key: %w", err)
+	}
+
+	return aw.Close()
+}
+
+// WritePublicKey writes the OpenPGP public key in armored form (eg. for use
+// as the signedBy key of a source).
+func WritePublicKey(w io.Writer, entity *openpgp.Entity) error {
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := entity.Serialize(aw); err != nil {
+		return fmt.Errorf("failed to serialize public key: %w", err)
+	}
+
+	return aw.Close()
+}
+
+// LoadPrivateKey reads the private key used to sign repositories from a file.
+func LoadPrivateKey(keyPath string) (*openpgp.Entity, error) {
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open signing key: %w", err)
+	}
+	defer keyFile.Close()
+
+	return ReadPrivateKey(keyFile)
+}
+
+// SavePrivateKey writes the private key used to sign repositories to a new
+// file (that is only readable by the current user).
+func SavePrivateKey(keyPath string, entity *openpgp.Entity) error {
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o700); err != nil {
+		return fmt.Errorf("failed to create signing key directory: %w", err)
+	}
+
+	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create signing key: %w", err)
+	}
+	defer keyFile.Close()
+
+	if err := WritePrivateKey(keyFile, entity); err != nil {
+		return err
+	}
+
+	return keyFile.Close()
+}
+
+// SavePublicKey writes the public key to a file.
+func SavePublicKey(keyPath string, entity *openpgp.Entity) error {
+	keyFile, err := os.Create(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to create public key file: %w", err)
+	}
+	defer keyFile.Close()
+
+	if err := WritePublicKey(keyFile, entity); err != nil {
+		return err
+	}
+
+	return keyFile.Close()
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aptrepo_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/debco/internal/aptrepo"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningKeys(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	signer, err := aptrepo.GenerateKey("Test Repository", "test@example.com")
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(t.TempDir(), "keys", "signing_key.asc")
+	require.NoError(t, aptrepo.SavePrivateKey(keyPath, signer))
+
+	// The private key is only readable by the current user.
+	fi, err := os.Stat(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := aptrepo.LoadPrivateKey(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, signer.PrimaryKey.Fingerprint, loaded.PrimaryKey.Fingerprint)
+	require.NotNil(t, loaded.PrivateKey)
+
+	t.Run("Existing Key", func(t *testing.T) {
+		// An existing key is never overwritten.
+		require.ErrorIs(t, aptrepo.SavePrivateKey(keyPath, signer), os.ErrExist)
+	})
+
+	t.Run("Missing Key", func(t *testing.T) {
+		_, err := aptrepo.LoadPrivateKey(filepath.Join(t.TempDir(), "missing.asc"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestInit(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	signer, err := aptrepo.GenerateKey("Test Repository", "")
+	require.NoError(t, err)
+
+	repoDir := filepath.Join(t.TempDir(), "repo")
+	require.Error(t, aptrepo.Check(repoDir))
+
+	require.NoError(t, aptrepo.Init(repoDir, signer))
+	require.NoError(t, aptrepo.Check(repoDir))
+
+	// The public key can be used to verify the repository.
+	publicKey, err := os.ReadFile(filepath.Join(repoDir, aptrepo.PublicKeyFile))
+	require.NoError(t, err)
+	require.Contains(t, string(publicKey), "BEGIN PGP PUBLIC KEY BLOCK")
+	require.NotContains(t, string(publicKey), "PRIVATE KEY")
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package baseimage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/debco/internal/buildkit"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/ociarchive"
+	"github.com/dpeckett/debco/internal/resolve"
+	"github.com/dpeckett/debco/internal/types"
+	"github.com/dpeckett/debco/internal/unpack"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image is an existing image that the packages are installed on top of.
+type Image struct {
+	// Ref is the pinned image reference (for images resolved by BuildKit).
+	Ref string
+	// ArchivePath is the path to the flattened root filesystem of the image
+	// (for images read from an OCI archive).
+	ArchivePath string
+	// Config is the configuration of the image.
+	Config ocispecs.Image
+	// Installed is the list of packages installed in the image.
+	Installed []unpack.InstalledPackage
+}
+
+// Resolver resolves image references (see buildkit.BuildKit).
+type Resolver interface {
+	ResolveImage(ctx context.Context, ref string, platform ocispecs.Platform, fn func(fsys fs.FS) error) (*buildkit.Image, error)
+}
+
+// Load reads the configuration and installed packages of the base image
+// (either an image reference, or an OCI archive prefixed with "oci-archive:").
+// Images in OCI archives are flattened into the temporary directory.
+func Load(ctx context.Context, resolver Resolver, from string, platform ocispecs.Platform, tempDir string) (*Image, error) {
+	var image Image
+	readInstalled := func(fsys fs.FS) error {
+		var err error
+		image.Installed, err = unpack.ReadInstalled(fsys)
+		if err != nil {
+			return fmt.Errorf("failed to read dpkg database of base image: %w", err)
+		}
+
+		return nil
+	}
+
+	if archivePath, ok := strings.CutPrefix(from, "oci-archive:"); ok {
+		extracted, err := ociarchive.Extract(tempDir, archivePath, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read base image: %w", err)
+		}
+
+		image.ArchivePath = extracted.RootFSArchivePath
+		image.Config = extracted.Config
+
+		if err := readArchive(extracted.RootFSArchivePath, readInstalled); err != nil {
+			return nil, err
+		}
+	} else {
+		resolved, err := resolver.ResolveImage(ctx, from, platform, readInstalled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read base image: %w", err)
+		}
+
+		image.Ref = resolved.Ref
+		image.Config = resolved.Config
+	}
+
+	slog.Debug("Loaded base image", slog.String("from", from),
+		slog.Int("installed", len(image.Installed)))
+
+	return &image, nil
+}
+
+// MarkInstalled replaces the available versions of each installed package in
+// the package database with the installed version (as packages in the base
+// image are not upgraded).
+func MarkInstalled(packageDB *database.PackageDB, installed []unpack.InstalledPackage) {
+	for _, pkg := range installed {
+		for _, existing := range packageDB.Get(pkg.Name) {
+			if !existing.IsVirtual && existing.Architecture.String() == pkg.Architecture.String() {
+				packageDB.Remove(existing)
+			}
+		}
+
+		packageDB.Add(types.Package{Package: pkg.Package})
+	}
+}
+
+// RemoveInstalled removes the installed packages from the selected packages
+// (so that only the packages missing from the base image are installed).
+func RemoveInstalled(selectedDB *database.PackageDB, installed []unpack.InstalledPackage) {
+	for _, pkg := range installed {
+		selectedDB.Remove(types.Package{Package: pkg.Package})
+	}
+}
+
+// AddLayer returns the installed packages after a layer, whose dpkg
+// database is in the archive, has been installed on top of them.
+func AddLayer(installed []unpack.InstalledPackage, dpkgConfArchivePath string) ([]unpack.InstalledPackage, error) {
+	err := readArchive(dpkgConfArchivePath, func(fsys fs.FS) error {
+		var err error
+		installed, err = unpack.UpdateInstalled(installed, fsys)
+		if err != nil {
+			return fmt.Errorf("failed to read dpkg database of layer: %w", err)
+		}
+
+		return nil
+	})
+
+	return installed, err
+}
+
+// FetchFunc downloads the selected packages into the directory, returning the
+// paths to the package files.
+type FetchFunc func(ctx context.Context, dir string, selectedDB *database.PackageDB) ([]string, error)
+
+// PrepareSecondStage fetches and unpacks the debco package (without its
+// dependencies), returning the path to its data archive (which provides the
+// second-stage binary for images built on top of a base image).
+func PrepareSecondStage(ctx context.Context, tempDir string, packageDB *database.PackageDB, fetch FetchFunc) (string, error) {
+	if err := os.MkdirAll(tempDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create second-stage temp directory: %w", err)
+	}
+
+	resolvedDB, err := resolve.Resolve(packageDB, []string{"debco"}, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve debco package: %w", err)
+	}
+
+	// Only the debco binary is needed (not its dependencies).
+	secondStageDB := database.NewPackageDB()
+	for _, pkg := range resolvedDB.Get("debco") {
+		if !pkg.IsVirtual {
+			secondStageDB.Add(pkg)
+		}
+	}
+
+	packagePaths, err := fetch(ctx, tempDir, secondStageDB)
+	if err != nil {
+		return "", err
+	}
+
+	_, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{})
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack debco package: %w", err)
+	}
+
+	return dataArchivePaths[0], nil
+}
+
+// readArchive calls fn with the contents of a tar archive.
+func readArchive(archivePath string, fn func(fsys fs.FS) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	fsys, err := tarfs.Open(f)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	return fn(fsys)
+}
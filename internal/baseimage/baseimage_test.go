@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package baseimage_test
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/containerd/containerd/platforms"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/baseimage"
+	"github.com/dpeckett/debco/internal/buildkit"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/debgen"
+	"github.com/dpeckett/debco/internal/ociarchive"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/dpeckett/debco/internal/types"
+	"github.com/dpeckett/debco/internal/unpack"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const status = "Package: hello\nStatus: install ok installed\nVersion: 1.0\nArchitecture: amd64\n\n" +
+	"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\nArchitecture: all\n"
+
+func TestLoad(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+	platform := platforms.MustParse("linux/amd64")
+
+	t.Run("OCI Archive", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archivePath := filepath.Join(tempDir, "image.tar")
+		testutil.WriteOCIArchive(t, archivePath, [][]testutil.TarEntry{
+			{
+				{Name: "usr/", Typeflag: tar.TypeDir},
+				{Name: "usr/bin/", Typeflag: tar.TypeDir},
+				{Name: "usr/bin/hello", Content: "hello"},
+				{Name: "var/", Typeflag: tar.TypeDir},
+				{Name: "var/lib/", Typeflag: tar.TypeDir},
+				{Name: "var/lib/dpkg/", Typeflag: tar.TypeDir},
+				{Name: "var/lib/dpkg/status", Content: status},
+				{Name: "var/lib/dpkg/info/", Typeflag: tar.TypeDir},
+				{Name: "var/lib/dpkg/info/hello.list", Content: "/.\n/usr\n/usr/bin\n/usr/bin/hello\n"},
+			},
+		})
+
+		image, err := baseimage.Load(ctx, nil, "oci-archive:"+archivePath, platform, tempDir)
+		require.NoError(t, err)
+
+		require.Empty(t, image.Ref)
+		require.FileExists(t, image.ArchivePath)
+		require.Equal(t, []string{"/bin/sh"}, image.Config.Config.Cmd)
+
+		// Packages that are not installed (eg. only their config files remain)
+		// are skipped.
+		require.Len(t, image.Installed, 1)
+		require.Equal(t, "hello", image.Installed[0].Name)
+		require.Equal(t, []string{"/usr", "/usr/bin", "/usr/bin/hello"}, image.Installed[0].Files)
+
+		_, err = baseimage.Load(ctx, nil, "oci-archive:"+filepath.Join(tempDir, "missing.tar"), platform, tempDir)
+		require.Error(t, err)
+	})
+
+	t.Run("Image Reference", func(t *testing.T) {
+		resolver := &fakeResolver{
+			fsys: fstest.MapFS{
+				"var/lib/dpkg/status": &fstest.MapFile{Data: []byte(status)},
+			},
+		}
+
+		image, err := baseimage.Load(ctx, resolver, "debian:bookworm", platform, t.TempDir())
+		require.NoError(t, err)
+
+		require.Equal(t, "docker.io/library/debian:bookworm@sha256:abcd", image.Ref)
+		require.Empty(t, image.ArchivePath)
+		require.Equal(t, "amd64", image.Config.Architecture)
+
+		require.Len(t, image.Installed, 1)
+		require.Equal(t, "hello", image.Installed[0].Name)
+	})
+}
+
+func TestMarkInstalled(t *testing.T) {
+	packageDB := database.NewPackageDB()
+	for _, v := range []string{"1.0", "2.0"} {
+		packageDB.Add(types.Package{Package: debtypes.Package{
+			Name:         "hello",
+			Version:      version.MustParse(v),
+			Architecture: arch.MustParse("amd64"),
+		}})
+	}
+
+	installed, err := unpack.ReadInstalled(fstest.MapFS{
+		"var/lib/dpkg/status": &fstest.MapFile{Data: []byte(status)},
+	})
+	require.NoError(t, err)
+
+	baseimage.MarkInstalled(packageDB, installed)
+
+	// Only the installed version is available.
+	packageList := packageDB.Get("hello")
+	require.Len(t, packageList, 1)
+	require.Equal(t, "1.0", packageList[0].Version.String())
+	require.Equal(t, []string{"install", "ok", "installed"}, []string(packageList[0].Status))
+
+	selectedDB := database.NewPackageDB()
+	selectedDB.AddAll(packageList)
+	selectedDB.Add(types.Package{Package: debtypes.Package{
+		Name:         "world",
+		Version:      version.MustParse("1.0"),
+		Architecture: arch.MustParse("amd64"),
+	}})
+
+	baseimage.RemoveInstalled(selectedDB, installed)
+
+	require.Empty(t, selectedDB.Get("hello"))
+	require.Len(t, selectedDB.Get("world"), 1)
+}
+
+func TestAddLayer(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	installed, err := unpack.ReadInstalled(fstest.MapFS{
+		"var/lib/dpkg/status":          &fstest.MapFile{Data: []byte(status)},
+		"var/lib/dpkg/info/hello.list": &fstest.MapFile{Data: []byte("/.\n/usr\n/usr/bin\n/usr/bin/hello\n")},
+	})
+	require.NoError(t, err)
+
+	// The dpkg database of a layer that installs another package.
+	archivePath := filepath.Join(t.TempDir(), "dpkg.tar")
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+
+	tw := tar.NewWriter(f)
+	for name, content := range map[string]string{
+		"var/lib/dpkg/status":          status + "\nPackage: world\nStatus: install ok installed\nVersion: 1.0\nArchitecture: amd64\n",
+		"var/lib/dpkg/info/hello.list": "/.\n/usr\n/usr/bin\n/usr/bin/hello\n",
+		"var/lib/dpkg/info/world.list": "/.\n/usr\n/usr/bin\n/usr/bin/world\n",
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		}))
+
+		_, err = tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	installed, err = baseimage.AddLayer(installed, archivePath)
+	require.NoError(t, err)
+
+	files := make(map[string][]string)
+	for _, pkg := range installed {
+		files[pkg.Name] = pkg.Files
+	}
+
+	require.Equal(t, map[string][]string{
+		"hello": {"/usr", "/usr/bin", "/usr/bin/hello"},
+		"world": {"/usr", "/usr/bin", "/usr/bin/world"},
+	}, files)
+}
+
+func TestPrepareSecondStage(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	tempDir := t.TempDir()
+
+	binDir := filepath.Join(tempDir, "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "debco"), []byte("debco"), 0o755))
+
+	packagePath := filepath.Join(tempDir, "debco.deb")
+	f, err := os.Create(packagePath)
+	require.NoError(t, err)
+	require.NoError(t, debgen.Write(f, debtypes.Package{
+		Name:         "debco",
+		Version:      version.MustParse("1.0"),
+		Architecture: arch.MustParse("amd64"),
+		Description:  "Test package",
+	}, []debgen.File{{Path: "/usr/bin/debco", SourcePath: filepath.Join(binDir, "debco")}}))
+	require.NoError(t, f.Close())
+
+	packageDB := database.NewPackageDB()
+	packageDB.AddAll([]types.Package{
+		{Package: debtypes.Package{
+			Name:         "debco",
+			Version:      version.MustParse("1.0"),
+			Architecture: arch.MustParse("amd64"),
+			Depends:      dependency.MustParse("libc6"),
+		}},
+		{Package: debtypes.Package{
+			Name:         "libc6",
+			Version:      version.MustParse("2.36"),
+			Architecture: arch.MustParse("amd64"),
+		}},
+	})
+
+	var fetched []string
+	archivePath, err := baseimage.PrepareSecondStage(ctx, filepath.Join(tempDir, "second-stage"), packageDB,
+		func(ctx context.Context, dir string, selectedDB *database.PackageDB) ([]string, error) {
+			err := selectedDB.ForEach(func(pkg types.Package) error {
+				fetched = append(fetched, pkg.Name)
+				return nil
+			})
+
+			return []string{packagePath}, err
+		})
+	require.NoError(t, err)
+
+	// Only the debco package is fetched (not its dependencies).
+	require.Equal(t, []string{"debco"}, fetched)
+
+	content, err := ociarchive.ReadFile(archivePath, "/usr/bin/debco")
+	require.NoError(t, err)
+	require.Equal(t, "debco", string(content))
+}
+
+type fakeResolver struct {
+	fsys fs.FS
+}
+
+func (r *fakeResolver) ResolveImage(_ context.Context, ref string, platform ocispecs.Platform, fn func(fsys fs.FS) error) (*buildkit.Image, error) {
+	if err := fn(r.fsys); err != nil {
+		return nil, err
+	}
+
+	return &buildkit.Image{
+		Ref:    "docker.io/library/" + ref + "@sha256:abcd",
+		Config: ocispecs.Image{Platform: platform},
+	}, nil
+}
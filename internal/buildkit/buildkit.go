@@ -23,11 +23,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -37,6 +39,7 @@ import (
 	"github.com/moby/buildkit/client/llb"
 
 	"github.com/dpeckett/debco/internal/buildkit/exptypes"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
@@ -45,11 +48,21 @@ import (
 )
 
 // BuildKit is a wrapper around BuildKit that provides a simplified interface
-// for building OCI images using BuildKit running in a Docker container.
+// for building OCI images using BuildKit running in a Docker container (or a
+// local process, or an existing BuildKit daemon).
 type BuildKit struct {
+	// Offline prevents the BuildKit image from being pulled (it must already
+	// be available locally).
+	Offline       bool
 	certsDir      string
 	containerName string
 	address       string
+	// remote is true when using an existing BuildKit daemon.
+	remote  bool
+	tlsConf *TLSConfig
+	// stateDir is the state directory of the BuildKit daemon, when it is run
+	// as a local process.
+	stateDir string
 }
 
 // New creates a new BuildKit instance.
@@ -60,6 +73,41 @@ func New(name, certsDir string) *BuildKit {
 	}
 }
 
+// FromConfig creates a BuildKit instance that either uses the existing
+// BuildKit daemon in the configuration, or runs its own daemon in a Docker
+// container (or as a local process if Docker is not available), keeping its
+// state in the state directory.
+func FromConfig(ctx context.Context, conf latestrecipe.BuildKitConfig, stateDir string) (*BuildKit, error) {
+	if conf.Address != "" {
+		var tlsConf *TLSConfig
+		if conf.CACert != "" || conf.Cert != "" || conf.Key != "" {
+			tlsConf = &TLSConfig{
+				CACertPath: conf.CACert,
+				CertPath:   conf.Cert,
+				KeyPath:    conf.Key,
+				ServerName: conf.ServerName,
+			}
+		}
+
+		return NewRemote(conf.Address, tlsConf)
+	}
+
+	// Run the BuildKit daemon as a local process on hosts without Docker.
+	if !DockerAvailable(ctx) && ProcessAvailable() {
+		slog.Debug("Docker is not available, running buildkit as a local process")
+
+		return NewProcess(filepath.Join(stateDir, "buildkitd")), nil
+	}
+
+	// Mutual TLS certificates for the BuildKit daemon.
+	certsDir := filepath.Join(stateDir, "certs")
+	if err := os.MkdirAll(certsDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create certs directory: %w", err)
+	}
+
+	return New("debco", certsDir), nil
+}
+
 type BuildOptions struct {
 	// OCIArchivePath is the path to the output OCI image tarball.
 	OCIArchivePath string
@@ -88,6 +136,104 @@ type PlatformBuildOptions struct {
 	// DataArchivePaths is a list of paths to package data archives.
 	// The paths must be relative to the build context directory.
 	DataArchivePaths []string
+	// RootFSArchivePath is the path to a merged root filesystem archive (see
+	// unpack.Merge). If set, it is copied into the image in a single operation
+	// (instead of the dpkg configuration and data archives).
+	// The path must be relative to the build context directory.
+	RootFSArchivePath string
+	// LayerArchivePaths is a list of merged root filesystem archives that are
+	// each installed in their own layer, on top of a base layer (instead of
+	// squashing everything into a single layer). Unless a second-stage binary
+	// is provided, the base layer must contain the debco package.
+	// The paths must be relative to the build context directory.
+	LayerArchivePaths []string
+	// BaseImage is an optional image reference (see ResolveImage) that the
+	// layer archives are installed on top of (instead of a base system built
+	// from the dpkg configuration and data archives).
+	BaseImage string
+	// BaseArchivePath is the path to an optional root filesystem archive (eg.
+	// a flattened OCI archive) that the layer archives are installed on top of.
+	// The path must be relative to the build context directory.
+	BaseArchivePath string
+	// BaseImageConfig is the configuration of the base image, which the image
+	// configuration inherits.
+	BaseImageConfig *ocispecs.Image
+	// SecondStageArchivePath is the path to the data archive of the debco
+	// package, that provides the second-stage binary when the base image does
+	// not contain debco. The path must be relative to the build context
+	// directory.
+	SecondStageArchivePath string
+}
+
+// Image is an image resolved by BuildKit.
+type Image struct {
+	// Ref is the image reference, pinned to the digest of the image.
+	Ref string
+	// Config is the configuration of the image.
+	Config ocispecs.Image
+}
+
+// ResolveImage resolves the image reference for the platform (pulling the
+// image if necessary). If fn is not nil, it is called with the root
+// filesystem of the image (which is only valid until fn returns).
+func (b *BuildKit) ResolveImage(ctx context.Context, ref string, platform ocispecs.Platform, fn func(fsys fs.FS) error) (*Image, error) {
+	c, err := b.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var image Image
+	buildFunc := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		dgst, configBytes, err := c.ResolveImageConfig(ctx, ref, llb.ResolveImageConfigOpt{
+			Platform: &platform,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve image config: %w", err)
+		}
+
+		if err := json.Unmarshal(configBytes, &image.Config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
+		}
+
+		image.Ref = ref
+		if !strings.Contains(ref, "@") {
+			image.Ref = ref + "@" + dgst.String()
+		}
+
+		if fn == nil {
+			return gateway.NewResult(), nil
+		}
+
+		def, err := llb.Image(image.Ref, llb.Platform(platform)).Marshal(ctx, llb.Platform(platform))
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		imageRef, err := r.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fn(NewReferenceFS(ctx, imageRef)); err != nil {
+			return nil, err
+		}
+
+		return gateway.NewResult(), nil
+	}
+
+	if _, err := c.Build(ctx, client.SolveOpt{}, "", buildFunc, nil); err != nil {
+		return nil, fmt.Errorf("failed to resolve image %s: %w", ref, err)
+	}
+
+	return &image, nil
 }
 
 // Build builds an OCI image tarball using BuildKit.
@@ -102,62 +248,12 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 
 			buildContextKey := fmt.Sprintf("build-context-%s", strings.ReplaceAll(platformStr, "/", "-"))
 
-			dpkgConfArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.DpkgConfArchivePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get relative path to dpkg configuration archive: %w", err)
-			}
-
 			// Create an LLB definition for the build.
-			state := llb.Scratch().
-				Platform(platforms.Normalize(platformOpt.Platform)).
-				AddEnv("DEBIAN_FRONTEND", "noninteractive").
-				AddEnv("DEBCONF_NONINTERACTIVE_SEEN", "true").
-				AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin").
-				File(llb.Copy(llb.Local(buildContextKey), dpkgConfArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
-
-			for _, dataArchivePath := range platformOpt.DataArchivePaths {
-				dataArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, dataArchivePath)
-				if err != nil {
-					return nil, fmt.Errorf("failed to get relative path to data archive: %w", err)
-				}
-
-				state = state.File(llb.Copy(llb.Local(buildContextKey), dataArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
-			}
-
-			if opts.SecondStageBinaryPath != "" {
-				// Copy the debco binary into the root filesystem.
-				state = state.File(llb.Copy(llb.Local("second-stage-bin"), filepath.Base(opts.SecondStageBinaryPath), "/usr/bin/debco", &llb.CopyInfo{}))
-			}
-
-			state = state.
-				Run(llb.Shlex("debco second-stage merge-usr")).                   // Merge the /usr directory into the root filesystem.
-				Run(llb.Shlex("/var/lib/dpkg/info/base-passwd.preinst install")). // Create the /etc/group and /etc/passwd files (needed by dpkg).
-				Run(llb.Shlex("dpkg --configure -a")).                            // Configure the packages.
-				// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
-				// These files are no longer needed and will lead to irreproducible builds.
-				File(llb.Rm("/var/log/dpkg.log")).
-				File(llb.Rm("/var/log/alternatives.log")).
-				File(llb.Rm("/var/cache/ldconfig/aux-cache"))
-
-			// Provision image (eg. create users/groups etc).
-			state = state.
-				File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/debco/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
-				Run(llb.Shlex("debco second-stage provision -f /etc/debco/config.yaml")).
-				Root().
-				File(llb.Rm("/etc/debco"))
-
-			// Remove the no longer needed debco binary.
-			if opts.SecondStageBinaryPath != "" {
-				state = state.File(llb.Rm("/usr/bin/debco"))
-			} else {
-				state = state.Run(llb.Shlex("dpkg -r debco")).
-					Root()
+			state, err := platformState(opts, platformOpt, buildContextKey)
+			if err != nil {
+				return nil, err
 			}
 
-			// Squash everything into a single final layer.
-			state = llb.Scratch().
-				File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
-
 			// Marshal the LLB definition.
 			def, err := state.Marshal(ctx, llb.Platform(platformOpt.Platform))
 			if err != nil {
@@ -200,19 +296,9 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 		return res, nil
 	}
 
-	buildkitURL, err := url.Parse(b.address)
+	c, err := b.newClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to parse buildkit address: %w", err)
-	}
-
-	c, err := client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
-		filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "debco.pem"), filepath.Join(b.certsDir, "debco-key.pem")),
-		client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
-			var d net.Dialer
-			return d.DialContext(ctx, "tcp", buildkitURL.Host)
-		}))
-	if err != nil {
-		return fmt.Errorf("failed to create buildkit client: %w", err)
+		return err
 	}
 	defer c.Close()
 
@@ -286,6 +372,30 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	return nil
 }
 
+// newClient connects to the BuildKit daemon.
+func (b *BuildKit) newClient(ctx context.Context) (*client.Client, error) {
+	if b.remote || b.stateDir != "" {
+		return b.newRemoteClient(ctx)
+	}
+
+	buildkitURL, err := url.Parse(b.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+	}
+
+	c, err := client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
+		filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "debco.pem"), filepath.Join(b.certsDir, "debco-key.pem")),
+		client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", buildkitURL.Host)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buildkit client: %w", err)
+	}
+
+	return c, nil
+}
+
 func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
 	exporterPlatforms := exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(platformOpts)),
@@ -306,22 +416,240 @@ func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
 	return exporterPlatformsBytes
 }
 
+// platformState returns the LLB state of the image for the platform.
+func platformState(opts BuildOptions, platformOpt PlatformBuildOptions, buildContextKey string) (llb.State, error) {
+	if platformOpt.BaseImage != "" || platformOpt.BaseArchivePath != "" {
+		state, err := baseImageState(platformOpt, buildContextKey)
+		if err != nil {
+			return llb.State{}, err
+		}
+
+		return installLayers(state, opts, platformOpt, buildContextKey)
+	}
+
+	state := scratch(platformOpt.Platform)
+
+	if platformOpt.RootFSArchivePath != "" {
+		rootFSArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.RootFSArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to root filesystem archive: %w", err)
+		}
+
+		// Only the root filesystem archive needs to be sent to BuildKit.
+		buildContext := llb.Local(buildContextKey, llb.IncludePatterns([]string{rootFSArchiveRelPath}))
+
+		state = state.File(llb.Copy(buildContext, rootFSArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+	} else {
+		dpkgConfArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.DpkgConfArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to dpkg configuration archive: %w", err)
+		}
+
+		state = state.File(llb.Copy(llb.Local(buildContextKey), dpkgConfArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+
+		for _, dataArchivePath := range platformOpt.DataArchivePaths {
+			dataArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, dataArchivePath)
+			if err != nil {
+				return llb.State{}, fmt.Errorf("failed to get relative path to data archive: %w", err)
+			}
+
+			state = state.File(llb.Copy(llb.Local(buildContextKey), dataArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+		}
+	}
+
+	if opts.SecondStageBinaryPath != "" {
+		// Copy the debco binary into the root filesystem.
+		state = state.File(llb.Copy(llb.Local("second-stage-bin"), filepath.Base(opts.SecondStageBinaryPath), "/usr/bin/debco", &llb.CopyInfo{}))
+	}
+
+	state = state.
+		Run(llb.Shlex("debco second-stage merge-usr")).                   // Merge the /usr directory into the root filesystem.
+		Run(llb.Shlex("/var/lib/dpkg/info/base-passwd.preinst install")). // Create the /etc/group and /etc/passwd files (needed by dpkg).
+		Run(llb.Shlex("dpkg --configure -a")).                            // Configure the packages.
+		// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
+		// These files are no longer needed and will lead to irreproducible builds.
+		File(llb.Rm("/var/log/dpkg.log")).
+		File(llb.Rm("/var/log/alternatives.log")).
+		File(llb.Rm("/var/cache/ldconfig/aux-cache"))
+
+	if len(platformOpt.LayerArchivePaths) > 0 {
+		// The debco binary is mounted when installing the other layers.
+		if opts.SecondStageBinaryPath != "" {
+			state = state.File(llb.Rm("/usr/bin/debco"))
+		}
+
+		// Squash the base system into a single layer, and install each
+		// of the other layers on top of it.
+		state = scratch(platformOpt.Platform).
+			File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
+
+		return installLayers(state, opts, platformOpt, buildContextKey)
+	}
+
+	// Provision image (eg. create users/groups etc).
+	state = state.
+		File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/debco/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
+		Run(llb.Shlex("debco second-stage provision -f /etc/debco/config.yaml")).
+		Root().
+		File(llb.Rm("/etc/debco"))
+
+	// Remove the no longer needed debco binary.
+	if opts.SecondStageBinaryPath != "" {
+		state = state.File(llb.Rm("/usr/bin/debco"))
+	} else {
+		state = state.Run(llb.Shlex("dpkg -r debco")).
+			Root()
+	}
+
+	// Squash everything into a single final layer.
+	state = llb.Scratch().
+		File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
+
+	return state, nil
+}
+
+// scratch returns an empty state for the platform, with the environment used
+// to install packages.
+func scratch(platform ocispecs.Platform) llb.State {
+	return llb.Scratch().
+		Platform(platforms.Normalize(platform)).
+		AddEnv("DEBIAN_FRONTEND", "noninteractive").
+		AddEnv("DEBCONF_NONINTERACTIVE_SEEN", "true").
+		AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+}
+
+// baseImageState returns the state of the base image that the layers are
+// installed on top of, with the environment of the base image.
+func baseImageState(platformOpt PlatformBuildOptions, buildContextKey string) (llb.State, error) {
+	var state llb.State
+	if platformOpt.BaseImage != "" {
+		state = llb.Image(platformOpt.BaseImage, llb.Platform(platformOpt.Platform))
+	} else {
+		baseArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.BaseArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to base archive: %w", err)
+		}
+
+		buildContext := llb.Local(buildContextKey, llb.IncludePatterns([]string{baseArchiveRelPath}))
+
+		state = llb.Scratch().
+			File(llb.Copy(buildContext, baseArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+	}
+
+	state = state.
+		Platform(platforms.Normalize(platformOpt.Platform)).
+		AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+
+	if platformOpt.BaseImageConfig != nil {
+		for _, env := range platformOpt.BaseImageConfig.Config.Env {
+			key, value, _ := strings.Cut(env, "=")
+			state = state.AddEnv(key, value)
+		}
+	}
+
+	return state.
+		AddEnv("DEBIAN_FRONTEND", "noninteractive").
+		AddEnv("DEBCONF_NONINTERACTIVE_SEEN", "true"), nil
+}
+
+// installLayers installs each of the layer archives on top of the base system
+// (and provisions the image in the final layer). Everything needed to install a
+// layer is mounted into a single run, so that each layer only contains the
+// changes made by installing its packages.
+func installLayers(state llb.State, opts BuildOptions, platformOpt PlatformBuildOptions, buildContextKey string) (llb.State, error) {
+	debcoPath := "debco"
+	var binaryMounts []llb.RunOption
+	if opts.SecondStageBinaryPath != "" {
+		binaryName := filepath.Base(opts.SecondStageBinaryPath)
+		debcoPath = filepath.Join("/run/debco/bin", binaryName)
+
+		binaryMounts = append(binaryMounts, llb.AddMount("/run/debco/bin",
+			llb.Local("second-stage-bin", llb.IncludePatterns([]string{binaryName})), llb.Readonly))
+	} else if platformOpt.SecondStageArchivePath != "" {
+		secondStageArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.SecondStageArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to second-stage archive: %w", err)
+		}
+
+		debcoPath = "/run/debco/second-stage/usr/bin/debco"
+
+		secondStage := llb.Scratch().
+			File(llb.Copy(llb.Local(buildContextKey, llb.IncludePatterns([]string{secondStageArchiveRelPath})),
+				secondStageArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+
+		binaryMounts = append(binaryMounts, llb.AddMount("/run/debco/second-stage", secondStage, llb.Readonly))
+	}
+
+	// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
+	removeLogs := "rm -f /var/log/dpkg.log /var/log/alternatives.log /var/cache/ldconfig/aux-cache"
+
+	for i, layerArchivePath := range platformOpt.LayerArchivePaths {
+		layerArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, layerArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to layer archive: %w", err)
+		}
+
+		runOpts := slices.Concat(binaryMounts, []llb.RunOption{
+			llb.AddMount("/run/debco/context",
+				llb.Local(buildContextKey, llb.IncludePatterns([]string{layerArchiveRelPath})), llb.Readonly),
+		})
+
+		commands := []string{
+			debcoPath + " second-stage unpack " + filepath.Join("/run/debco/context", layerArchiveRelPath),
+			debcoPath + " second-stage merge-usr",
+			"dpkg --configure -a",
+			removeLogs,
+		}
+
+		// Provision the image (eg. create users/groups etc) in the final layer.
+		if i == len(platformOpt.LayerArchivePaths)-1 {
+			recipeName := filepath.Base(opts.RecipePath)
+
+			runOpts = append(runOpts, llb.AddMount("/run/debco/conf",
+				llb.Local("conf", llb.IncludePatterns([]string{recipeName})), llb.Readonly))
+
+			commands = append(commands, debcoPath+" second-stage provision -f "+filepath.Join("/run/debco/conf", recipeName))
+
+			// Remove the no longer needed debco package.
+			if opts.SecondStageBinaryPath == "" && platformOpt.SecondStageArchivePath == "" {
+				commands = append(commands, "dpkg -r debco", removeLogs)
+			}
+		}
+
+		runOpts = append(runOpts, llb.Args([]string{"/bin/sh", "-c", strings.Join(commands, " && ")}))
+
+		state = state.Run(runOpts...).Root()
+	}
+
+	return state, nil
+}
+
 func exporterImageConfig(imageConf ocispecs.ImageConfig, platformOpt PlatformBuildOptions) ([]byte, error) {
 	defaultEnv := []string{
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
 		"TERM=xterm",
 	}
 
-	imageConf.Env = append(defaultEnv, imageConf.Env...)
-
 	img := ocispecs.Image{
 		Platform: platformOpt.Platform,
-		Config:   imageConf,
 		RootFS: ocispecs.RootFS{
 			Type: "layers",
 		},
 	}
 
+	if platformOpt.BaseImageConfig != nil {
+		// Inherit the configuration (and history) of the base image, unless it
+		// is overridden.
+		img.Config = platformOpt.BaseImageConfig.Config
+		img.History = platformOpt.BaseImageConfig.History
+		img.Config.Env = mergeEnv(img.Config.Env, imageConf.Env)
+
+		mergeImageConfig(&img.Config, imageConf)
+	} else {
+		imageConf.Env = append(defaultEnv, imageConf.Env...)
+		img.Config = imageConf
+	}
+
 	data, err := json.Marshal(img)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal image config: %w", err)
@@ -329,3 +657,71 @@ func exporterImageConfig(imageConf ocispecs.ImageConfig, platformOpt PlatformBui
 
 	return data, nil
 }
+
+// mergeImageConfig overrides the base image configuration with every field
+// that is set in the image configuration (apart from the environment).
+func mergeImageConfig(base *ocispecs.ImageConfig, imageConf ocispecs.ImageConfig) {
+	if imageConf.User != "" {
+		base.User = imageConf.User
+	}
+
+	for port := range imageConf.ExposedPorts {
+		if base.ExposedPorts == nil {
+			base.ExposedPorts = make(map[string]struct{})
+		}
+		base.ExposedPorts[port] = struct{}{}
+	}
+
+	if len(imageConf.Entrypoint) > 0 {
+		base.Entrypoint = imageConf.Entrypoint
+		// The command of the base image is an argument to its entrypoint.
+		base.Cmd = nil
+	}
+
+	if len(imageConf.Cmd) > 0 {
+		base.Cmd = imageConf.Cmd
+	}
+
+	for volume := range imageConf.Volumes {
+		if base.Volumes == nil {
+			base.Volumes = make(map[string]struct{})
+		}
+		base.Volumes[volume] = struct{}{}
+	}
+
+	if imageConf.WorkingDir != "" {
+		base.WorkingDir = imageConf.WorkingDir
+	}
+
+	for key, value := range imageConf.Labels {
+		if base.Labels == nil {
+			base.Labels = make(map[string]string)
+		}
+		base.Labels[key] = value
+	}
+
+	if imageConf.StopSignal != "" {
+		base.StopSignal = imageConf.StopSignal
+	}
+}
+
+// mergeEnv overrides the base environment variables with the given ones
+// (keeping the order of the base environment).
+func mergeEnv(base, env []string) []string {
+	merged := slices.Clone(base)
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+
+		i := slices.IndexFunc(merged, func(existing string) bool {
+			existingKey, _, _ := strings.Cut(existing, "=")
+			return existingKey == key
+		})
+		if i >= 0 {
+			merged[i] = kv
+		} else {
+			merged = append(merged, kv)
+		}
+	}
+
+	return merged
+}
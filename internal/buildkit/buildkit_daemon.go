@@ -42,8 +42,18 @@ import (
 	"golang.org/x/term"
 )
 
-// StartDaemon starts the BuildKit daemon in a Docker container (if it is not already running).
+// StartDaemon starts the BuildKit daemon in a Docker container (if it is not
+// already running). When using an existing daemon, it only checks that the
+// daemon is reachable.
 func (b *BuildKit) StartDaemon(ctx context.Context) error {
+	if b.remote {
+		return b.checkRemoteDaemon(ctx)
+	}
+
+	if b.stateDir != "" {
+		return b.startProcess(ctx)
+	}
+
 	needsRestart, err := refreshCertificates(b.certsDir)
 	if err != nil {
 		return fmt.Errorf("failed to refresh certificates: %w", err)
@@ -112,21 +122,8 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 			},
 		}
 
-		// Check if the buildkit image is already available.
-		_, _, err := cli.ImageInspectWithRaw(ctx, config.Image)
-		if err != nil {
-			slog.Info("Pulling buildkit image", slog.String("image", config.Image))
-
-			// Pull the buildkit image.
-			pullProgressReader, err := cli.ImagePull(ctx, config.Image, types.ImagePullOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to pull buildkit image: %w", err)
-			}
-			defer pullProgressReader.Close()
-
-			if err := displayImagePullProgress(ctx, pullProgressReader); err != nil {
-				return fmt.Errorf("failed to display buildkit image pull progress: %w", err)
-			}
+		if err := b.ensureImage(ctx, cli); err != nil {
+			return err
 		}
 
 		slog.Debug("Starting buildkit container", slog.String("name", b.containerName))
@@ -157,8 +154,80 @@ BUILDKITD_ALREADY_RUNNING:
 	return nil
 }
 
-// StopDaemon stops the BuildKit daemon running in a Docker container.
+// DockerAvailable returns true if the Docker daemon is reachable.
+func DockerAvailable(ctx context.Context) bool {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return false
+	}
+	defer cli.Close()
+
+	_, err = cli.Ping(ctx)
+	return err == nil
+}
+
+// SaveImage writes the BuildKit image as a tarball (that can be loaded with
+// "docker load"), pulling the image first if necessary.
+func (b *BuildKit) SaveImage(ctx context.Context, w io.Writer) error {
+	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	if err := b.ensureImage(ctx, cli); err != nil {
+		return err
+	}
+
+	imageReader, err := cli.ImageSave(ctx, []string{constants.BuildKitImage})
+	if err != nil {
+		return fmt.Errorf("failed to save buildkit image: %w", err)
+	}
+	defer imageReader.Close()
+
+	if _, err := io.Copy(w, imageReader); err != nil {
+		return fmt.Errorf("failed to save buildkit image: %w", err)
+	}
+
+	return nil
+}
+
+// ensureImage pulls the BuildKit image (if it is not already available).
+func (b *BuildKit) ensureImage(ctx context.Context, cli *dockerclient.Client) error {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, constants.BuildKitImage); err == nil {
+		return nil
+	}
+
+	if b.Offline {
+		return fmt.Errorf("buildkit image %s is not available offline", constants.BuildKitImage)
+	}
+
+	slog.Info("Pulling buildkit image", slog.String("image", constants.BuildKitImage))
+
+	pullProgressReader, err := cli.ImagePull(ctx, constants.BuildKitImage, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull buildkit image: %w", err)
+	}
+	defer pullProgressReader.Close()
+
+	if err := displayImagePullProgress(ctx, pullProgressReader); err != nil {
+		return fmt.Errorf("failed to display buildkit image pull progress: %w", err)
+	}
+
+	return nil
+}
+
+// StopDaemon stops the BuildKit daemon running in a Docker container (an
+// existing daemon is left running).
 func (b *BuildKit) StopDaemon(ctx context.Context) error {
+	if b.remote {
+		return nil
+	}
+
+	if b.stateDir != "" {
+		return b.stopProcess(ctx)
+	}
+
 	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("failed to create Docker client: %w", err)
@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// ReferenceFS is a read-only fs.FS over the root filesystem of a solved
+// BuildKit reference.
+type ReferenceFS struct {
+	ctx context.Context
+	ref gateway.Reference
+}
+
+// NewReferenceFS returns a read-only fs.FS over the root filesystem of the
+// reference. It is only valid for the lifetime of the build.
+func NewReferenceFS(ctx context.Context, ref gateway.Reference) *ReferenceFS {
+	return &ReferenceFS{ctx: ctx, ref: ref}
+}
+
+func (fsys *ReferenceFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	st, err := fsys.ref.StatFile(fsys.ctx, gateway.StatRequest{Path: name})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fsys.notExist(name, err)}
+	}
+
+	fi := &statInfo{stat: st, name: path.Base(name)}
+	if fi.IsDir() {
+		return &referenceDir{fsys: fsys, name: name, info: fi}, nil
+	}
+
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &referenceFile{Reader: bytes.NewReader(data), info: fi}, nil
+}
+
+func (fsys *ReferenceFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	data, err := fsys.ref.ReadFile(fsys.ctx, gateway.ReadRequest{Filename: name})
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fsys.notExist(name, err)}
+	}
+
+	return data, nil
+}
+
+func (fsys *ReferenceFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	stats, err := fsys.ref.ReadDir(fsys.ctx, gateway.ReadDirRequest{Path: name})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fsys.notExist(name, err)}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(stats))
+	for _, st := range stats {
+		entries = append(entries, fs.FileInfoToDirEntry(&statInfo{stat: st, name: path.Base(st.Path)}))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+// notExist returns fs.ErrNotExist if the named file does not exist (BuildKit
+// doesn't return typed errors), and otherwise the original error.
+func (fsys *ReferenceFS) notExist(name string, err error) error {
+	if name == "." {
+		return err
+	}
+
+	stats, dirErr := fsys.ref.ReadDir(fsys.ctx, gateway.ReadDirRequest{
+		Path:           path.Dir(name),
+		IncludePattern: path.Base(name),
+	})
+	if dirErr == nil && len(stats) == 0 {
+		return fs.ErrNotExist
+	}
+
+	// The parent directory is missing too.
+	if dirErr != nil && errors.Is(fsys.notExist(path.Dir(name), dirErr), fs.ErrNotExist) {
+		return fs.ErrNotExist
+	}
+
+	return err
+}
+
+type statInfo struct {
+	stat *fstypes.Stat
+	name string
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.stat.Size_ }
+func (fi *statInfo) Mode() fs.FileMode  { return fs.FileMode(fi.stat.Mode) }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(0, fi.stat.ModTime) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() any           { return fi.stat }
+
+type referenceFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *referenceFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *referenceFile) Close() error               { return nil }
+
+type referenceDir struct {
+	fsys    *ReferenceFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *referenceDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *referenceDir) Close() error               { return nil }
+
+func (d *referenceDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *referenceDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/debco/internal/buildkit"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/stretchr/testify/require"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+func TestReferenceFS(t *testing.T) {
+	ref := &fakeReference{fsys: fstest.MapFS{
+		"var/lib/dpkg/status":          &fstest.MapFile{Data: []byte("Package: hello\n")},
+		"var/lib/dpkg/info/hello.list": &fstest.MapFile{Data: []byte("/.\n/usr\n")},
+		"usr/bin/hello":                &fstest.MapFile{Data: []byte("hello"), Mode: 0o755},
+	}}
+
+	fsys := buildkit.NewReferenceFS(context.Background(), ref)
+
+	require.NoError(t, fstest.TestFS(fsys, "var/lib/dpkg/status", "var/lib/dpkg/info/hello.list", "usr/bin/hello"))
+
+	t.Run("Not Exist", func(t *testing.T) {
+		_, err := fs.ReadFile(fsys, "var/lib/dpkg/info/missing.list")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fs.ReadDir(fsys, "var/lib/dpkg/updates")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fs.Stat(fsys, "missing/file")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+// fakeReference is a gateway reference backed by an in-memory filesystem,
+// that (like BuildKit) returns untyped errors.
+type fakeReference struct {
+	gateway.Reference
+	fsys fstest.MapFS
+}
+
+func (r *fakeReference) ReadFile(_ context.Context, req gateway.ReadRequest) ([]byte, error) {
+	data, err := fs.ReadFile(r.fsys, req.Filename)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	return data, nil
+}
+
+func (r *fakeReference) StatFile(_ context.Context, req gateway.StatRequest) (*fstypes.Stat, error) {
+	fi, err := fs.Stat(r.fsys, req.Path)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	return &fstypes.Stat{Path: req.Path, Mode: uint32(fi.Mode()), Size_: fi.Size()}, nil
+}
+
+func (r *fakeReference) ReadDir(_ context.Context, req gateway.ReadDirRequest) ([]*fstypes.Stat, error) {
+	entries, err := fs.ReadDir(r.fsys, req.Path)
+	if err != nil {
+		return nil, errors.New(err.Error())
+	}
+
+	var stats []*fstypes.Stat
+	for _, entry := range entries {
+		if req.IncludePattern != "" {
+			if ok, _ := path.Match(req.IncludePattern, entry.Name()); !ok {
+				continue
+			}
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, &fstypes.Stat{Path: entry.Name(), Mode: uint32(fi.Mode()), Size_: fi.Size()})
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,333 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	// processStartTimeout is how long to wait for the BuildKit daemon process
+	// to start accepting connections.
+	processStartTimeout = 60 * time.Second
+	// processStopTimeout is how long to wait for the BuildKit daemon process to
+	// exit before killing it.
+	processStopTimeout = 10 * time.Second
+	// processLockRetryDelay is how often to retry locking the state directory.
+	processLockRetryDelay = 100 * time.Millisecond
+)
+
+// NewProcess creates a new BuildKit instance that runs the BuildKit daemon as
+// a local process (rootless, unless running as root), for hosts without
+// Docker. The daemon listens on a unix socket in the state directory.
+func NewProcess(stateDir string) *BuildKit {
+	return &BuildKit{
+		stateDir: stateDir,
+		address:  "unix://" + filepath.Join(stateDir, "buildkitd.sock"),
+	}
+}
+
+// ProcessAvailable returns true if the BuildKit daemon can be run as a local
+// process (ie. buildkitd, and rootlesskit if needed, are installed).
+func ProcessAvailable() bool {
+	_, err := processCommand()
+	return err == nil
+}
+
+// startProcess starts the BuildKit daemon process (if it is not already
+// running).
+func (b *BuildKit) startProcess(ctx context.Context) error {
+	if err := os.MkdirAll(b.stateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create buildkit state directory: %w", err)
+	}
+
+	// Only one command can start (or stop) the daemon at a time.
+	unlock, err := b.lockState(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if pid, ok := b.runningProcess(); ok {
+		slog.Debug("Using running buildkit daemon", slog.Int("pid", pid))
+
+		if err := b.waitForProcess(ctx, pid); err == nil {
+			return nil
+		}
+
+		slog.Debug("Restarting unresponsive buildkit daemon", slog.Int("pid", pid))
+
+		if err := b.killProcess(); err != nil {
+			return err
+		}
+	}
+
+	args, err := processCommand()
+	if err != nil {
+		return err
+	}
+
+	socketPath := strings.TrimPrefix(b.address, "unix://")
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale buildkit socket: %w", err)
+	}
+
+	args = append(args,
+		"--addr", b.address,
+		"--root", filepath.Join(b.stateDir, "root"),
+	)
+
+	logFile, err := os.OpenFile(filepath.Join(b.stateDir, "buildkitd.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open buildkit log file: %w", err)
+	}
+	defer logFile.Close()
+
+	slog.Debug("Starting buildkit daemon", slog.String("command", strings.Join(args, " ")))
+
+	// The daemon outlives the command (like the BuildKit container), so that
+	// its cache can be reused by later builds.
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start buildkit daemon: %w", err)
+	}
+
+	pid := cmd.Process.Pid
+
+	if err := os.WriteFile(b.pidPath(), []byte(strconv.Itoa(pid)), 0o600); err != nil {
+		return fmt.Errorf("failed to write buildkit pid file: %w", err)
+	}
+
+	// Reap the process if it exits while we are still running.
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	if err := b.waitForProcess(ctx, pid); err != nil {
+		return fmt.Errorf("failed to wait for buildkit daemon to start (see %s): %w",
+			logFile.Name(), err)
+	}
+
+	return nil
+}
+
+// stopProcess stops the BuildKit daemon process (if it is running).
+func (b *BuildKit) stopProcess(ctx context.Context) error {
+	if _, err := os.Stat(b.stateDir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	unlock, err := b.lockState(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return b.killProcess()
+}
+
+// killProcess stops the BuildKit daemon process (if it is running), while
+// holding the state directory lock.
+func (b *BuildKit) killProcess() error {
+	pid, ok := b.runningProcess()
+	if ok {
+		slog.Debug("Stopping buildkit daemon", slog.Int("pid", pid))
+
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			return fmt.Errorf("failed to find buildkit daemon process: %w", err)
+		}
+
+		if err := p.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("failed to stop buildkit daemon: %w", err)
+		}
+
+		deadline := time.Now().Add(processStopTimeout)
+		for processRunning(pid) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if processRunning(pid) {
+			if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				return fmt.Errorf("failed to kill buildkit daemon: %w", err)
+			}
+		}
+	}
+
+	if err := os.Remove(b.pidPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove buildkit pid file: %w", err)
+	}
+
+	return nil
+}
+
+// runningProcess returns the pid of the BuildKit daemon process, if it is
+// running. As pids are reused, the process must also be listening on the
+// address of this daemon.
+func (b *BuildKit) runningProcess() (int, bool) {
+	data, err := os.ReadFile(b.pidPath())
+	if err != nil {
+		return 0, false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+
+	if !processRunning(pid) {
+		return 0, false
+	}
+
+	args, err := processArgs(pid)
+	if err != nil {
+		// Without procfs (eg. on macOS) the process can't be verified.
+		if errors.Is(err, errProcfsUnavailable) {
+			return pid, true
+		}
+
+		return 0, false
+	}
+
+	if !slices.Contains(args, b.address) {
+		slog.Debug("Ignoring buildkit pid file of another process", slog.Int("pid", pid))
+		return 0, false
+	}
+
+	return pid, true
+}
+
+// lockState takes an exclusive lock on the state directory, returning a
+// function that releases it.
+func (b *BuildKit) lockState(ctx context.Context) (func(), error) {
+	lock := flock.New(filepath.Join(b.stateDir, "buildkitd.lock"))
+
+	locked, err := lock.TryLockContext(ctx, processLockRetryDelay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock buildkit state directory: %w", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("failed to lock buildkit state directory")
+	}
+
+	return func() {
+		_ = lock.Unlock()
+	}, nil
+}
+
+// waitForProcess waits until the BuildKit daemon is accepting connections,
+// making sure the process is still running.
+func (b *BuildKit) waitForProcess(ctx context.Context, pid int) error {
+	socketPath := strings.TrimPrefix(b.address, "unix://")
+
+	ctx, cancel := context.WithTimeout(ctx, processStartTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if !processRunning(pid) {
+				return fmt.Errorf("buildkit daemon is not running")
+			}
+
+			// Check if we can connect to the BuildKit daemon.
+			conn, err := net.Dial("unix", socketPath)
+			if err != nil {
+				continue
+			}
+			_ = conn.Close()
+
+			// And that it is ready to build.
+			return b.checkRemoteDaemon(ctx)
+		}
+	}
+}
+
+func (b *BuildKit) pidPath() string {
+	return filepath.Join(b.stateDir, "buildkitd.pid")
+}
+
+// processCommand returns the command used to run the BuildKit daemon. Unless
+// running as root, the daemon is run in a user namespace using rootlesskit.
+func processCommand() ([]string, error) {
+	buildkitdPath, err := exec.LookPath("buildkitd")
+	if err != nil {
+		return nil, fmt.Errorf("buildkitd is not installed: %w", err)
+	}
+
+	if os.Geteuid() == 0 {
+		return []string{buildkitdPath}, nil
+	}
+
+	rootlesskitPath, err := exec.LookPath("rootlesskit")
+	if err != nil {
+		return nil, fmt.Errorf("rootlesskit is required to run buildkitd as a non-root user: %w", err)
+	}
+
+	return []string{rootlesskitPath, buildkitdPath}, nil
+}
+
+var errProcfsUnavailable = errors.New("procfs is not available")
+
+// processArgs returns the command line arguments of the process.
+func processArgs(pid int) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		if _, statErr := os.Stat("/proc/self"); errors.Is(statErr, os.ErrNotExist) {
+			return nil, errProcfsUnavailable
+		}
+
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+}
+
+// processRunning returns true if the process exists.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	return p.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/moby/buildkit/client"
+	// Register the docker-container:// and kube-pod:// connection helpers.
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer"
+	_ "github.com/moby/buildkit/client/connhelper/kubepod"
+)
+
+// TLSConfig is the TLS material used to connect to an existing BuildKit
+// daemon.
+type TLSConfig struct {
+	// CACertPath is the path to the CA certificate used to verify the daemon.
+	CACertPath string
+	// CertPath is the optional path to the client certificate.
+	CertPath string
+	// KeyPath is the optional path to the client key.
+	KeyPath string
+	// ServerName optionally overrides the name used to verify the daemon
+	// certificate (defaults to the host of the address).
+	ServerName string
+}
+
+// NewRemote creates a new BuildKit instance that uses an existing BuildKit
+// daemon (instead of running one in a Docker container). The address is one
+// of "tcp://host:port", "unix:///path/to/buildkitd.sock",
+// "docker-container://container" or "kube-pod://pod". TLS is optional.
+func NewRemote(address string, tlsConf *TLSConfig) (*BuildKit, error) {
+	addressURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+	}
+
+	switch addressURL.Scheme {
+	case "tcp", "unix", "docker-container", "kube-pod":
+	default:
+		return nil, fmt.Errorf("unsupported buildkit address scheme: %q", addressURL.Scheme)
+	}
+
+	if tlsConf != nil {
+		if tlsConf.CACertPath == "" {
+			return nil, fmt.Errorf("a CA certificate is required to connect to buildkit using TLS")
+		}
+
+		if (tlsConf.CertPath == "") != (tlsConf.KeyPath == "") {
+			return nil, fmt.Errorf("both a client certificate and key are required")
+		}
+	}
+
+	return &BuildKit{
+		address: address,
+		remote:  true,
+		tlsConf: tlsConf,
+	}, nil
+}
+
+// newRemoteClient connects to an existing BuildKit daemon.
+func (b *BuildKit) newRemoteClient(ctx context.Context) (*client.Client, error) {
+	var opts []client.ClientOpt
+	if b.tlsConf != nil {
+		opts = append(opts, client.WithCredentials(b.tlsConf.ServerName,
+			b.tlsConf.CACertPath, b.tlsConf.CertPath, b.tlsConf.KeyPath))
+	}
+
+	c, err := client.New(ctx, b.address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buildkit client: %w", err)
+	}
+
+	return c, nil
+}
+
+// checkRemoteDaemon makes sure the existing BuildKit daemon is reachable (and
+// has at least one worker).
+func (b *BuildKit) checkRemoteDaemon(ctx context.Context) error {
+	c, err := b.newRemoteClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	workers, err := c.ListWorkers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to buildkit daemon %s: %w", b.address, err)
+	}
+
+	if len(workers) == 0 {
+		return fmt.Errorf("buildkit daemon %s has no workers", b.address)
+	}
+
+	return nil
+}
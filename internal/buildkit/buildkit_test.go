@@ -28,16 +28,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/containerd/containerd/platforms"
 	"github.com/dpeckett/debco/internal/buildkit"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
 	"github.com/dpeckett/debco/internal/testutil"
 	"github.com/dpeckett/debco/internal/unpack"
 	"github.com/dpeckett/debco/internal/util/diskcache"
-	"github.com/gregjones/httpcache"
 	"github.com/stretchr/testify/require"
 )
 
@@ -78,7 +79,7 @@ func TestBuild(t *testing.T) {
 		packagePaths = append(packagePaths, filepath.Join(packagesDir, e.Name()))
 	}
 
-	dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{})
 	require.NoError(t, err)
 
 	outputDir := t.TempDir()
@@ -170,7 +171,7 @@ func downloadPackages(packagesDir string) error {
 	}
 
 	httpClient := &http.Client{
-		Transport: httpcache.NewTransport(cache),
+		Transport: diskcache.NewTransport(cache),
 	}
 
 	for _, pkgURL := range packageURLs {
@@ -228,3 +229,139 @@ func buildDebcoBinary(ctx context.Context, binaryDir string) error {
 
 	return nil
 }
+
+func TestNewRemote(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	_, err := buildkit.NewRemote("tcp://buildkitd:1234", nil)
+	require.NoError(t, err)
+
+	_, err = buildkit.NewRemote("unix:///run/buildkit/buildkitd.sock", nil)
+	require.NoError(t, err)
+
+	_, err = buildkit.NewRemote("docker-container://buildkitd", nil)
+	require.NoError(t, err)
+
+	_, err = buildkit.NewRemote("kube-pod://buildkitd-0?namespace=buildkit", nil)
+	require.NoError(t, err)
+
+	_, err = buildkit.NewRemote("ssh://buildkitd", nil)
+	require.Error(t, err)
+
+	t.Run("TLS", func(t *testing.T) {
+		_, err := buildkit.NewRemote("tcp://buildkitd:1234", &buildkit.TLSConfig{
+			CACertPath: "ca.pem",
+			CertPath:   "cert.pem",
+			KeyPath:    "key.pem",
+		})
+		require.NoError(t, err)
+
+		_, err = buildkit.NewRemote("tcp://buildkitd:1234", &buildkit.TLSConfig{
+			CertPath: "cert.pem",
+			KeyPath:  "key.pem",
+		})
+		require.Error(t, err)
+
+		_, err = buildkit.NewRemote("tcp://buildkitd:1234", &buildkit.TLSConfig{
+			CACertPath: "ca.pem",
+			CertPath:   "cert.pem",
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestFromConfig(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	t.Run("Remote", func(t *testing.T) {
+		b, err := buildkit.FromConfig(ctx, latestrecipe.BuildKitConfig{
+			Address: "tcp://buildkitd:1234",
+		}, t.TempDir())
+		require.NoError(t, err)
+		require.NotNil(t, b)
+
+		_, err = buildkit.FromConfig(ctx, latestrecipe.BuildKitConfig{
+			Address: "ssh://buildkitd",
+		}, t.TempDir())
+		require.Error(t, err)
+	})
+
+	t.Run("Remote TLS", func(t *testing.T) {
+		_, err := buildkit.FromConfig(ctx, latestrecipe.BuildKitConfig{
+			Address: "tcp://buildkitd:1234",
+			CACert:  "ca.pem",
+			Cert:    "cert.pem",
+			Key:     "key.pem",
+		}, t.TempDir())
+		require.NoError(t, err)
+
+		// TLS is used as soon as any of the TLS settings are specified.
+		_, err = buildkit.FromConfig(ctx, latestrecipe.BuildKitConfig{
+			Address: "tcp://buildkitd:1234",
+			Cert:    "cert.pem",
+			Key:     "key.pem",
+		}, t.TempDir())
+		require.Error(t, err)
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		stateDir := t.TempDir()
+
+		b, err := buildkit.FromConfig(ctx, latestrecipe.BuildKitConfig{}, stateDir)
+		require.NoError(t, err)
+		require.NotNil(t, b)
+
+		// Either the Docker certificates directory is created, or the daemon
+		// is run as a local process.
+		if !buildkit.DockerAvailable(ctx) && buildkit.ProcessAvailable() {
+			require.NoDirExists(t, filepath.Join(stateDir, "certs"))
+		} else {
+			require.DirExists(t, filepath.Join(stateDir, "certs"))
+		}
+	})
+}
+
+func TestProcess(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	if !buildkit.ProcessAvailable() {
+		t.Skip("buildkitd is not available")
+	}
+
+	ctx := context.Background()
+
+	b := buildkit.NewProcess(t.TempDir())
+
+	require.NoError(t, b.StartDaemon(ctx))
+	t.Cleanup(func() {
+		require.NoError(t, b.StopDaemon(ctx))
+	})
+
+	// Starting the daemon again reuses the running process.
+	require.NoError(t, b.StartDaemon(ctx))
+}
+
+func TestProcessReusedPID(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("procfs is not available")
+	}
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+
+	// The pid has been reused by an unrelated process (this one).
+	pidPath := filepath.Join(stateDir, "buildkitd.pid")
+	require.NoError(t, os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0o600))
+
+	b := buildkit.NewProcess(stateDir)
+
+	// The unrelated process is not stopped.
+	require.NoError(t, b.StopDaemon(ctx))
+
+	_, err := os.Stat(pidPath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bundle
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/dpeckett/debco/internal/aptrepo"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/localpkg"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/types"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The layout of a vendored bundle (relative to the bundle directory).
+const (
+	// RecipeFile is the rewritten recipe.
+	RecipeFile = "recipe.yaml"
+	// RepoDir is the local APT repository of the selected packages.
+	RepoDir = "repo"
+	// BaseImageFile is the base image archive.
+	BaseImageFile = "base-image.tar"
+)
+
+// Recipe rewrites the recipe to only use the packages in the vendored
+// repository, and the base image archive copied into the bundle (if any).
+// Paths in the rewritten recipe are relative to the bundle directory.
+func Recipe(r *latestrecipe.Recipe, includeNameVersions []string, localPackages []types.Package, platformList []ocispecs.Platform) (*latestrecipe.Recipe, error) {
+	vendoredRecipe := *r
+
+	if err := CheckBaseImage(r); err != nil {
+		return nil, err
+	}
+
+	if r.From != "" {
+		vendoredRecipe.From = "oci-archive:" + BaseImageFile
+	}
+
+	vendoredRecipe.Sources = []latestrecipe.SourceConfig{
+		{
+			URL:      RepoDir,
+			SignedBy: filepath.Join(RepoDir, aptrepo.PublicKeyFile),
+		},
+	}
+
+	options := latestrecipe.OptionsConfig{}
+	if r.Options != nil {
+		options = *r.Options
+	}
+	// The debco package is included in the vendored repository.
+	options.OmitUpstreamAPT = true
+	// The BuildKit daemon (and its certificates) are specific to this machine.
+	options.BuildKit = nil
+	vendoredRecipe.Options = &options
+
+	// Local, dummy, and generated packages are now in the repository.
+	packagesConf := r.Packages
+	packagesConf.Include = slices.Clone(includeNameVersions)
+	packagesConf.Dummy = nil
+	packagesConf.Generated = nil
+
+	// The recipe is shared by every platform, so each platform must install
+	// the same local packages.
+	var localNameVersions []string
+	for i, platform := range platformList {
+		nameVersions, err := localpkg.Add(database.NewPackageDB(), platform, localPackages)
+		if err != nil {
+			return nil, err
+		}
+
+		slices.Sort(nameVersions)
+		nameVersions = slices.Compact(nameVersions)
+
+		if i > 0 && !slices.Equal(nameVersions, localNameVersions) {
+			return nil, fmt.Errorf("local packages differ between platforms %s and %s, vendor each platform separately",
+				platforms.Format(platformList[0]), platforms.Format(platform))
+		}
+
+		localNameVersions = nameVersions
+	}
+	packagesConf.Include = append(packagesConf.Include, localNameVersions...)
+	vendoredRecipe.Packages = packagesConf
+
+	return &vendoredRecipe, nil
+}
+
+// CheckBaseImage returns an error if the base image of the recipe can't be
+// copied into a bundle (only base images in OCI archives can be).
+func CheckBaseImage(r *latestrecipe.Recipe) error {
+	if r.From != "" && !strings.HasPrefix(r.From, "oci-archive:") {
+		return fmt.Errorf("cannot vendor base image %s, save it to an OCI archive and use \"oci-archive:\" instead", r.From)
+	}
+
+	return nil
+}
+
+// CopyBaseImage copies the base image archive of the recipe (if it has one)
+// into the bundle directory.
+func CopyBaseImage(bundleDir string, r *latestrecipe.Recipe) error {
+	if err := CheckBaseImage(r); err != nil {
+		return err
+	}
+
+	archivePath, ok := strings.CutPrefix(r.From, "oci-archive:")
+	if !ok {
+		return nil
+	}
+
+	if err := copyFile(archivePath, filepath.Join(bundleDir, BaseImageFile)); err != nil {
+		return fmt.Errorf("failed to copy base image: %w", err)
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	return dstFile.Close()
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bundle_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/bundle"
+	"github.com/dpeckett/debco/internal/recipe"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/types"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecipe(t *testing.T) {
+	r := &latestrecipe.Recipe{
+		From: "oci-archive:/home/user/recipes/base.tar",
+		Options: &latestrecipe.OptionsConfig{
+			PathExclude: []string{"/usr/share/doc/*"},
+			BuildKit: &latestrecipe.BuildKitConfig{
+				Address: "tcp://buildkitd:1234",
+				CACert:  "/home/user/recipes/ca.pem",
+			},
+		},
+		Sources: []latestrecipe.SourceConfig{
+			{URL: "https://deb.debian.org/debian", SignedBy: "https://ftp-master.debian.org/keys/archive-key-12.asc"},
+			{URL: "/home/user/recipes/myrepo", SignedBy: "/home/user/recipes/myrepo/signing_key.asc"},
+		},
+		Packages: latestrecipe.PackagesConfig{
+			Include: []string{"bash", "/home/user/recipes/hello_*.deb"},
+			Dummy:   []latestrecipe.DummyPackageConfig{{Name: "dummy", Version: "1.0"}},
+			Generated: []latestrecipe.GeneratedPackageConfig{{
+				Name:    "motd",
+				Version: "1.0",
+				Files:   []latestrecipe.FileConfig{{Source: "/home/user/recipes/motd", Destination: "/etc/motd"}},
+			}},
+		},
+	}
+
+	localPackages := []types.Package{
+		localPackage("hello", "1.0", "amd64"),
+		localPackage("hello", "1.0", "arm64"),
+		localPackage("dummy", "1.0", "all"),
+	}
+
+	platformList := []ocispecs.Platform{platforms.MustParse("linux/amd64"), platforms.MustParse("linux/arm64")}
+
+	vendoredRecipe, err := bundle.Recipe(r, []string{"bash"}, localPackages, platformList)
+	require.NoError(t, err)
+
+	require.Equal(t, "oci-archive:base-image.tar", vendoredRecipe.From)
+	require.Equal(t, []latestrecipe.SourceConfig{
+		{URL: "repo", SignedBy: "repo/signing_key.asc"},
+	}, vendoredRecipe.Sources)
+	require.Equal(t, &latestrecipe.OptionsConfig{
+		OmitUpstreamAPT: true,
+		PathExclude:     []string{"/usr/share/doc/*"},
+	}, vendoredRecipe.Options)
+	require.Equal(t, []string{"bash", "dummy=1.0", "hello=1.0"}, vendoredRecipe.Packages.Include)
+	require.Empty(t, vendoredRecipe.Packages.Dummy)
+	require.Empty(t, vendoredRecipe.Packages.Generated)
+
+	// The original recipe is unchanged.
+	require.Equal(t, "oci-archive:/home/user/recipes/base.tar", r.From)
+	require.False(t, r.Options.OmitUpstreamAPT)
+	require.NotNil(t, r.Options.BuildKit)
+
+	// Once loaded from the bundle, the paths are relative to the bundle.
+	recipe.ResolvePaths(vendoredRecipe, "/srv/bundle")
+
+	require.Equal(t, "oci-archive:/srv/bundle/base-image.tar", vendoredRecipe.From)
+	require.Equal(t, []latestrecipe.SourceConfig{
+		{URL: "/srv/bundle/repo", SignedBy: "/srv/bundle/repo/signing_key.asc"},
+	}, vendoredRecipe.Sources)
+
+	t.Run("Image Reference", func(t *testing.T) {
+		_, err := bundle.Recipe(&latestrecipe.Recipe{From: "debian:bookworm"}, nil, nil, platformList)
+		require.ErrorContains(t, err, "cannot vendor base image debian:bookworm")
+	})
+
+	t.Run("Platform Specific Local Packages", func(t *testing.T) {
+		_, err := bundle.Recipe(r, nil, []types.Package{
+			localPackage("hello", "1.0", "amd64"),
+			localPackage("hello", "2.0", "arm64"),
+		}, platformList)
+		require.ErrorContains(t, err, "local packages differ between platforms linux/amd64 and linux/arm64")
+	})
+}
+
+func TestCopyBaseImage(t *testing.T) {
+	recipeDir := t.TempDir()
+	bundleDir := t.TempDir()
+
+	archivePath := filepath.Join(recipeDir, "base.tar")
+	require.NoError(t, os.WriteFile(archivePath, []byte("image"), 0o644))
+
+	require.NoError(t, bundle.CopyBaseImage(bundleDir, &latestrecipe.Recipe{From: "oci-archive:" + archivePath}))
+
+	data, err := os.ReadFile(filepath.Join(bundleDir, bundle.BaseImageFile))
+	require.NoError(t, err)
+	require.Equal(t, "image", string(data))
+
+	t.Run("No Base Image", func(t *testing.T) {
+		bundleDir := t.TempDir()
+
+		require.NoError(t, bundle.CopyBaseImage(bundleDir, &latestrecipe.Recipe{}))
+
+		_, err := os.Stat(filepath.Join(bundleDir, bundle.BaseImageFile))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Image Reference", func(t *testing.T) {
+		err := bundle.CopyBaseImage(t.TempDir(), &latestrecipe.Recipe{From: "debian:bookworm"})
+		require.Error(t, err)
+	})
+}
+
+func localPackage(name, pkgVersion, pkgArch string) types.Package {
+	return types.Package{
+		Package: debtypes.Package{
+			Name:         name,
+			Version:      version.MustParse(pkgVersion),
+			Architecture: arch.MustParse(pkgArch),
+		},
+	}
+}
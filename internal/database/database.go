@@ -19,9 +19,12 @@
 package database
 
 import (
+	"slices"
+	"sort"
 	"sync"
 
 	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/dependency"
 	"github.com/dpeckett/deb822/types/version"
 	"github.com/dpeckett/debco/internal/types"
 
@@ -29,15 +32,55 @@ import (
 )
 
 // PackageDB is a package database.
+//
+// Packages are stored once in a slice and referenced by their index (slot)
+// everywhere else. Virtual packages reference their providers by slot rather
+// than holding copies of them, and strings shared between packages (names,
+// maintainers, dependency names, etc.) are interned.
 type PackageDB struct {
-	mu   sync.RWMutex
-	tree *btree.BTree
+	mu sync.RWMutex
+	// names is an index of package names (in sorted order) to the slots of
+	// all packages and virtual packages with that name.
+	names *btree.BTree
+	// chunks holds the stored packages, indexed by slot. Packages are stored
+	// in fixed size chunks so that growing the database never copies them.
+	chunks [][]types.Package
+	// slots is the number of slots that have been allocated.
+	slots int
+	// providers holds, for virtual package slots, the slots of the packages
+	// that provide them.
+	providers [][]int
+	// dependents is a reverse dependency index of package names to the slots
+	// of the packages that depend (or pre-depend) on them.
+	dependents map[string][]int
+	// free is a list of slots that can be reused.
+	free []int
+	// strings is used to intern strings shared between packages.
+	strings map[string]string
+	// count is the number of non-virtual packages in the database.
+	count int
+}
+
+// chunkSize is the number of packages stored in each chunk.
+const chunkSize = 1024
+
+// nameEntry holds the slots of all the packages with a given name, ordered by
+// version and architecture.
+type nameEntry struct {
+	name  string
+	slots []int
+}
+
+func (e *nameEntry) Less(than btree.Item) bool {
+	return e.name < than.(*nameEntry).name
 }
 
 // NewPackageDB creates a new package database.
 func NewPackageDB() *PackageDB {
 	return &PackageDB{
-		tree: btree.New(2),
+		names:      btree.New(32),
+		dependents: make(map[string][]int),
+		strings:    make(map[string]string),
 	}
 }
 
@@ -46,18 +89,7 @@ func (db *PackageDB) Len() int {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	var count int
-	db.tree.Ascend(func(item btree.Item) bool {
-		pkg := item.(types.Package)
-
-		if !pkg.IsVirtual {
-			count++
-		}
-
-		return true
-	})
-
-	return count
+	return db.count
 }
 
 // Add adds a package to the database.
@@ -79,9 +111,24 @@ func (db *PackageDB) AddAll(packageList []types.Package) {
 }
 
 func (db *PackageDB) addPackage(pkg types.Package) {
+	db.internPackage(&pkg)
+
+	entry := db.nameEntry(pkg.Name, true)
+
 	// Do we already have this package?
-	if existing := db.tree.Get(pkg); existing != nil {
-		existing := existing.(types.Package)
+	if slot, ok := db.find(entry, pkg.Package, pkg.IsVirtual); ok {
+		existing := db.pkg(slot)
+
+		if pkg.IsVirtual {
+			// Merge the providers of a directly added virtual package.
+			for _, provider := range pkg.Providers {
+				if !containsPackage(existing.Providers, provider) {
+					existing.Providers = append(existing.Providers, provider)
+				}
+			}
+
+			return
+		}
 
 		// Append the url to the existing package (if an identical url does not already exist).
 		for _, url := range pkg.URLs {
@@ -97,44 +144,56 @@ func (db *PackageDB) addPackage(pkg types.Package) {
 			}
 		}
 
-		pkg = existing
+		// Prefer local package files over downloading the package.
+		if pkg.LocalPath != "" {
+			existing.LocalPath = pkg.LocalPath
+			existing.SHA256 = pkg.SHA256
+		}
+
+		return
 	}
 
-	db.tree.ReplaceOrInsert(pkg)
+	slot := db.insert(entry, pkg)
+	if pkg.IsVirtual {
+		return
+	}
+
+	db.count++
+
+	for _, name := range dependencyNames(pkg) {
+		db.dependents[name] = append(db.dependents[name], slot)
+	}
 
 	// Does this package provide any virtual packages?
-	if len(pkg.Provides.Relations) > 0 {
-		for _, rel := range pkg.Provides.Relations {
-			for _, possi := range rel.Possibilities {
-				virtualPkg := types.Package{
-					Package:   debtypes.Package{Name: possi.Name},
-					IsVirtual: true,
-				}
+	for _, rel := range pkg.Provides.Relations {
+		for _, possi := range rel.Possibilities {
+			virtualPkg := types.Package{
+				Package:   debtypes.Package{Name: possi.Name},
+				IsVirtual: true,
+			}
 
-				if possi.Version != nil {
-					virtualPkg.Version = possi.Version.Version
-				}
+			if possi.Version != nil {
+				virtualPkg.Version = possi.Version.Version
+			}
 
-				// Do we already have a virtual package?
-				if existing := db.tree.Get(virtualPkg); existing != nil {
-					virtualPkg = existing.(types.Package)
-				}
+			virtualEntry := db.nameEntry(possi.Name, true)
 
-				// Make sure the package is not already in the providers list.
-				var found bool
-				for _, provider := range virtualPkg.Providers {
-					if provider.Compare(pkg) == 0 {
-						found = true
-						break
-					}
-				}
+			virtualSlot, ok := db.find(virtualEntry, virtualPkg.Package, true)
+			if !ok {
+				virtualSlot = db.insert(virtualEntry, virtualPkg)
+			}
 
-				// Add the package to the providers list (if it is not already there).
-				if !found {
-					virtualPkg.Providers = append(virtualPkg.Providers, pkg)
-					db.tree.ReplaceOrInsert(virtualPkg)
+			// Add the package to the providers list (if it is not already there).
+			var found bool
+			for _, providerSlot := range db.providers[virtualSlot] {
+				if providerSlot == slot {
+					found = true
+					break
 				}
 			}
+			if !found {
+				db.providers[virtualSlot] = append(db.providers[virtualSlot], slot)
+			}
 		}
 	}
 }
@@ -144,41 +203,72 @@ func (db *PackageDB) Remove(pkg types.Package) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.tree.Delete(pkg)
+	entry := db.nameEntry(pkg.Name, false)
+	if entry == nil {
+		return
+	}
+
+	slot, ok := db.find(entry, pkg.Package, pkg.IsVirtual)
+	if !ok {
+		return
+	}
+
+	// Use the stored package, as the provided package might be incomplete.
+	stored := *db.pkg(slot)
+	db.remove(entry, slot)
+
+	if stored.IsVirtual {
+		return
+	}
+
+	db.count--
+
+	for _, name := range dependencyNames(stored) {
+		var updatedDependents []int
+		for _, dependentSlot := range db.dependents[name] {
+			if dependentSlot != slot {
+				updatedDependents = append(updatedDependents, dependentSlot)
+			}
+		}
+
+		if len(updatedDependents) > 0 {
+			db.dependents[name] = updatedDependents
+		} else {
+			delete(db.dependents, name)
+		}
+	}
 
 	// If the package provides any virtual packages, update the providers.
-	if len(pkg.Provides.Relations) > 0 {
-		for _, rel := range pkg.Provides.Relations {
-			for _, possi := range rel.Possibilities {
-				virtualPkg := types.Package{
-					Package:   debtypes.Package{Name: possi.Name},
-					IsVirtual: true,
-				}
+	for _, rel := range stored.Provides.Relations {
+		for _, possi := range rel.Possibilities {
+			virtualPkg := debtypes.Package{Name: possi.Name}
+			if possi.Version != nil {
+				virtualPkg.Version = possi.Version.Version
+			}
 
-				if possi.Version != nil {
-					virtualPkg.Version = possi.Version.Version
-				}
+			virtualEntry := db.nameEntry(possi.Name, false)
+			if virtualEntry == nil {
+				continue
+			}
 
-				if virtualPkg := db.tree.Get(virtualPkg); virtualPkg != nil {
-					virtualPkg := virtualPkg.(types.Package)
-
-					// Remove the package from the providers list.
-					var updatedProviders []types.Package
-					for _, provider := range virtualPkg.Providers {
-						if provider.Compare(pkg) != 0 {
-							updatedProviders = append(updatedProviders, provider)
-						}
-					}
-					virtualPkg.Providers = updatedProviders
-
-					// If there are no more providers, remove the virtual package.
-					if len(virtualPkg.Providers) == 0 {
-						db.tree.Delete(virtualPkg)
-					} else {
-						db.tree.ReplaceOrInsert(virtualPkg)
-					}
+			virtualSlot, ok := db.find(virtualEntry, virtualPkg, true)
+			if !ok {
+				continue
+			}
+
+			// Remove the package from the providers list.
+			var updatedProviders []int
+			for _, providerSlot := range db.providers[virtualSlot] {
+				if providerSlot != slot {
+					updatedProviders = append(updatedProviders, providerSlot)
 				}
 			}
+			db.providers[virtualSlot] = updatedProviders
+
+			// If there are no more providers, remove the virtual package.
+			if len(updatedProviders) == 0 && len(db.pkg(virtualSlot).Providers) == 0 {
+				db.remove(virtualEntry, virtualSlot)
+			}
 		}
 	}
 }
@@ -190,156 +280,377 @@ func (db *PackageDB) ForEach(fn func(pkg types.Package) error) error {
 	defer db.mu.RUnlock()
 
 	var err error
-	db.tree.Ascend(func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	db.names.Ascend(func(item btree.Item) bool {
+		for _, slot := range item.(*nameEntry).slots {
+			pkg := *db.pkg(slot)
 
-		if !pkg.IsVirtual {
-			err = fn(pkg)
+			if !pkg.IsVirtual {
+				if err = fn(pkg); err != nil {
+					return false
+				}
+			}
 		}
-		return err == nil
+
+		return true
 	})
 	return err
 }
 
 // Get returns all packages that match the provided name.
-func (db *PackageDB) Get(name string) (packageList []types.Package) {
+func (db *PackageDB) Get(name string) []types.Package {
+	return db.query(name, func(version.Version) bool { return true }, false)
+}
+
+// StrictlyEarlier returns all packages that match the provided name and are
+// strictly earlier than the provided version.
+func (db *PackageDB) StrictlyEarlier(name string, v version.Version) []types.Package {
+	return db.query(name, func(other version.Version) bool {
+		return other.Compare(v) < 0
+	}, true)
+}
+
+// EarlierOrEqual returns all packages that match the provided name and are
+// earlier or equal to the provided version.
+func (db *PackageDB) EarlierOrEqual(name string, v version.Version) []types.Package {
+	return db.query(name, func(other version.Version) bool {
+		return other.Compare(v) <= 0
+	}, true)
+}
+
+// ExactlyEqual returns the package that matches the provided name and version.
+func (db *PackageDB) ExactlyEqual(name string, v version.Version) (*types.Package, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	db.tree.AscendGreaterOrEqual(types.Package{
-		Package: debtypes.Package{Name: name},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	entry := db.nameEntry(name, false)
+	if entry == nil {
+		return nil, false
+	}
 
-		if pkg.Package.Name != name {
-			return false
-		}
+	i := sort.Search(len(entry.slots), func(i int) bool {
+		return db.pkg(entry.slots[i]).Version.Compare(v) >= 0
+	})
+	if i < len(entry.slots) && db.pkg(entry.slots[i]).Version.Compare(v) == 0 {
+		pkg := db.get(entry.slots[i])
+		return &pkg, true
+	}
 
-		packageList = append(packageList, pkg)
+	return nil, false
+}
 
-		return true
-	})
-	return
+// LaterOrEqual returns all packages that match the provided name and are
+// later or equal to the provided version.
+func (db *PackageDB) LaterOrEqual(name string, v version.Version) []types.Package {
+	return db.query(name, func(other version.Version) bool {
+		return other.Compare(v) >= 0
+	}, false)
 }
 
-// StrictlyEarlier returns all packages that match the provided name and are
-// strictly earlier than the provided version.
-func (db *PackageDB) StrictlyEarlier(name string, version version.Version) (packageList []types.Package) {
+// StrictlyLater returns all packages that match the provided name and are
+// strictly later than the provided version.
+func (db *PackageDB) StrictlyLater(name string, v version.Version) []types.Package {
+	return db.query(name, func(other version.Version) bool {
+		return other.Compare(v) > 0
+	}, false)
+}
+
+// ReverseDepends returns all packages that depend (or pre-depend) on the
+// provided package name, regardless of any version constraints.
+func (db *PackageDB) ReverseDepends(name string) []types.Package {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.sorted(db.dependents[name])
+}
+
+// ReverseProvides returns all packages that provide the provided virtual
+// package name (in any version).
+func (db *PackageDB) ReverseProvides(name string) []types.Package {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	db.tree.DescendLessOrEqual(types.Package{
-		Package: debtypes.Package{Name: name, Version: version},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	entry := db.nameEntry(name, false)
+	if entry == nil {
+		return nil
+	}
 
-		if pkg.Package.Name != name {
-			return false
+	var slots []int
+	for _, slot := range entry.slots {
+		for _, providerSlot := range db.providers[slot] {
+			if !slices.Contains(slots, providerSlot) {
+				slots = append(slots, providerSlot)
+			}
 		}
+	}
 
-		// Skip the package if it is the same version (since we want strictly earlier)
-		if pkg.Version.Compare(version) == 0 {
-			return true
+	return db.sorted(slots)
+}
+
+// Dependent is a package that depends on another package.
+type Dependent struct {
+	// Package is the dependent package.
+	Package types.Package
+	// Relation is the dependency (or pre-dependency) on the other package.
+	Relation dependency.Relation
+}
+
+// Dependents returns the packages that depend (or pre-depend) on the named
+// package, either directly or through one of the virtual packages it
+// provides, along with the relation that refers to it.
+func (db *PackageDB) Dependents(name string) []Dependent {
+	names := []string{name}
+	for _, pkg := range db.Get(name) {
+		if pkg.IsVirtual {
+			continue
 		}
 
-		packageList = append(packageList, pkg)
+		for _, rel := range pkg.Provides.Relations {
+			for _, possi := range rel.Possibilities {
+				if !slices.Contains(names, possi.Name) {
+					names = append(names, possi.Name)
+				}
+			}
+		}
+	}
 
-		return true
+	var dependents []Dependent
+	for _, name := range names {
+		for _, pkg := range db.ReverseDepends(name) {
+			for _, rel := range slices.Concat(pkg.PreDepends.Relations, pkg.Depends.Relations) {
+				if slices.ContainsFunc(rel.Possibilities, func(possi dependency.Possibility) bool {
+					return possi.Name == name
+				}) {
+					dependents = append(dependents, Dependent{Package: pkg, Relation: rel})
+				}
+			}
+		}
+	}
+
+	return dependents
+}
+
+// sorted returns copies of the packages stored in the slots, ordered by name,
+// version, and architecture.
+func (db *PackageDB) sorted(slots []int) []types.Package {
+	if len(slots) == 0 {
+		return nil
+	}
+
+	packageList := make([]types.Package, 0, len(slots))
+	for _, slot := range slots {
+		packageList = append(packageList, db.get(slot))
+	}
+
+	sort.SliceStable(packageList, func(i, j int) bool {
+		return packageList[i].Compare(packageList[j]) < 0
 	})
-	return
+
+	return packageList
 }
 
-// EarlierOrEqual returns all packages that match the provided name and are
-// earlier or equal to the provided version.
-func (db *PackageDB) EarlierOrEqual(name string, version version.Version) (packageList []types.Package) {
+// query returns all packages with the provided name whose version satisfies
+// the match function. Packages are returned in ascending version order, or
+// descending order if descending is true.
+func (db *PackageDB) query(name string, match func(version.Version) bool, descending bool) (packageList []types.Package) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	db.tree.DescendLessOrEqual(types.Package{
-		Package: debtypes.Package{Name: name, Version: version},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	entry := db.nameEntry(name, false)
+	if entry == nil {
+		return nil
+	}
 
-		if pkg.Package.Name != name {
-			return false
+	for i := range entry.slots {
+		if descending {
+			i = len(entry.slots) - 1 - i
 		}
 
-		packageList = append(packageList, pkg)
+		slot := entry.slots[i]
+		if match(db.pkg(slot).Version) {
+			packageList = append(packageList, db.get(slot))
+		}
+	}
 
-		return true
-	})
 	return
 }
 
-// ExactlyEqual returns the package that matches the provided name and version.
-func (db *PackageDB) ExactlyEqual(name string, version version.Version) (*types.Package, bool) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// get returns a copy of the package stored in the slot, with the providers
+// of virtual packages populated.
+func (db *PackageDB) get(slot int) types.Package {
+	pkg := *db.pkg(slot)
+
+	if pkg.IsVirtual && len(db.providers[slot]) > 0 {
+		providers := make([]types.Package, 0, len(pkg.Providers)+len(db.providers[slot]))
+		providers = append(providers, pkg.Providers...)
+		for _, providerSlot := range db.providers[slot] {
+			providers = append(providers, *db.pkg(providerSlot))
+		}
+		pkg.Providers = providers
+	}
+
+	return pkg
+}
+
+// pkg returns a pointer to the package stored in the slot.
+func (db *PackageDB) pkg(slot int) *types.Package {
+	return &db.chunks[slot/chunkSize][slot%chunkSize]
+}
 
-	var foundPackage *types.Package
-	db.tree.AscendGreaterOrEqual(types.Package{
-		Package: debtypes.Package{Name: name, Version: version},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+func (db *PackageDB) nameEntry(name string, create bool) *nameEntry {
+	if item := db.names.Get(&nameEntry{name: name}); item != nil {
+		return item.(*nameEntry)
+	}
+
+	if !create {
+		return nil
+	}
 
-		if pkg.Package.Name != name {
-			return false
+	entry := &nameEntry{name: name}
+	db.names.ReplaceOrInsert(entry)
+
+	return entry
+}
+
+// find returns the slot of the package in the name entry (if present).
+func (db *PackageDB) find(entry *nameEntry, pkg debtypes.Package, isVirtual bool) (int, bool) {
+	for i := db.search(entry, pkg); i < len(entry.slots); i++ {
+		stored := db.pkg(entry.slots[i])
+		if stored.Package.Compare(pkg) != 0 {
+			break
 		}
 
-		if pkg.Version.Compare(version) == 0 {
-			foundPackage = &pkg
+		if stored.IsVirtual == isVirtual {
+			return entry.slots[i], true
 		}
+	}
+
+	return 0, false
+}
 
-		return false
+// search returns the index of the first slot in the name entry that is not
+// ordered before the package.
+func (db *PackageDB) search(entry *nameEntry, pkg debtypes.Package) int {
+	return sort.Search(len(entry.slots), func(i int) bool {
+		return db.pkg(entry.slots[i]).Package.Compare(pkg) >= 0
 	})
-	return foundPackage, foundPackage != nil
 }
 
-// LaterOrEqual returns all packages that match the provided name and are
-// later or equal to the provided version.
-func (db *PackageDB) LaterOrEqual(name string, version version.Version) (packageList []types.Package) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// insert stores the package in a free slot and adds it to the name entry.
+func (db *PackageDB) insert(entry *nameEntry, pkg types.Package) int {
+	var slot int
+	if n := len(db.free); n > 0 {
+		slot = db.free[n-1]
+		db.free = db.free[:n-1]
+		*db.pkg(slot) = pkg
+		db.providers[slot] = nil
+	} else {
+		slot = db.slots
+		db.slots++
+
+		if slot%chunkSize == 0 {
+			db.chunks = append(db.chunks, make([]types.Package, chunkSize))
+		}
+
+		*db.pkg(slot) = pkg
+		db.providers = append(db.providers, nil)
+	}
+
+	i := db.search(entry, pkg.Package)
+	entry.slots = append(entry.slots, 0)
+	copy(entry.slots[i+1:], entry.slots[i:])
+	entry.slots[i] = slot
 
-	db.tree.AscendGreaterOrEqual(types.Package{
-		Package: debtypes.Package{Name: name, Version: version},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	return slot
+}
 
-		if pkg.Package.Name != name {
-			return false
+// remove removes the slot from the name entry and frees it.
+func (db *PackageDB) remove(entry *nameEntry, slot int) {
+	for i, s := range entry.slots {
+		if s == slot {
+			entry.slots = append(entry.slots[:i], entry.slots[i+1:]...)
+			break
 		}
+	}
 
-		packageList = append(packageList, pkg)
+	if len(entry.slots) == 0 {
+		db.names.Delete(entry)
+	}
 
-		return true
-	})
-	return
+	*db.pkg(slot) = types.Package{}
+	db.providers[slot] = nil
+	db.free = append(db.free, slot)
 }
 
-// StrictlyLater returns all packages that match the provided name and are
-// strictly later than the provided version.
-func (db *PackageDB) StrictlyLater(name string, version version.Version) (packageList []types.Package) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// intern returns a canonical instance of the string, so that identical
+// strings share the same memory.
+func (db *PackageDB) intern(s string) string {
+	if s == "" {
+		return s
+	}
+
+	if interned, ok := db.strings[s]; ok {
+		return interned
+	}
 
-	db.tree.AscendGreaterOrEqual(types.Package{
-		Package: debtypes.Package{Name: name, Version: version},
-	}, func(item btree.Item) bool {
-		pkg := item.(types.Package)
+	db.strings[s] = s
+	return s
+}
+
+func (db *PackageDB) internVersion(v *version.Version) {
+	v.Version = db.intern(v.Version)
+	v.Revision = db.intern(v.Revision)
+}
 
-		if pkg.Package.Name != name {
-			return false
+func (db *PackageDB) internPackage(pkg *types.Package) {
+	pkg.Name = db.intern(pkg.Name)
+	pkg.Source = db.intern(pkg.Source)
+	pkg.Maintainer = db.intern(pkg.Maintainer)
+	pkg.MultiArch = db.intern(pkg.MultiArch)
+	pkg.Homepage = db.intern(pkg.Homepage)
+	pkg.Section = db.intern(pkg.Section)
+	pkg.Priority = db.intern(pkg.Priority)
+	db.internVersion(&pkg.Version)
+
+	for _, dep := range []*dependency.Dependency{
+		&pkg.Replaces, &pkg.Breaks, &pkg.Provides, &pkg.Conflicts, &pkg.Enhances,
+		&pkg.Depends, &pkg.Recommends, &pkg.Suggests, &pkg.PreDepends,
+	} {
+		for i := range dep.Relations {
+			for j := range dep.Relations[i].Possibilities {
+				possi := &dep.Relations[i].Possibilities[j]
+
+				possi.Name = db.intern(possi.Name)
+				if possi.Version != nil {
+					db.internVersion(&possi.Version.Version)
+				}
+			}
 		}
+	}
+}
 
-		// Skip the package if it is the same version (since we want strictly later)
-		if pkg.Version.Compare(version) == 0 {
-			return true
+// dependencyNames returns the unique names of all packages the package depends
+// (or pre-depends) on.
+func dependencyNames(pkg types.Package) []string {
+	var names []string
+	for _, dep := range []dependency.Dependency{pkg.PreDepends, pkg.Depends} {
+		for _, rel := range dep.Relations {
+			for _, possi := range rel.Possibilities {
+				if !slices.Contains(names, possi.Name) {
+					names = append(names, possi.Name)
+				}
+			}
 		}
+	}
 
-		packageList = append(packageList, pkg)
+	return names
+}
 
-		return true
-	})
-	return
+func containsPackage(packageList []types.Package, pkg types.Package) bool {
+	for _, other := range packageList {
+		if other.Compare(pkg) == 0 {
+			return true
+		}
+	}
+
+	return false
 }
@@ -19,6 +19,7 @@
 package database_test
 
 import (
+	"fmt"
 	"testing"
 
 	debtypes "github.com/dpeckett/deb822/types"
@@ -153,4 +154,145 @@ func TestPackageDB(t *testing.T) {
 		require.Equal(t, "baz", packages[0].Providers[0].Name)
 		require.Equal(t, version.MustParse("3.0"), packages[0].Providers[0].Version)
 	})
+
+	t.Run("Reverse Dependencies", func(t *testing.T) {
+		pkg := types.Package{
+			Package: debtypes.Package{
+				Name:       "qux",
+				Version:    version.MustParse("4.0"),
+				Depends:    dependency.MustParse("foo (>= 1.0) | bar"),
+				PreDepends: dependency.MustParse("bazz"),
+			},
+		}
+
+		db.Add(pkg)
+
+		packages := db.ReverseDepends("bar")
+
+		require.Len(t, packages, 1)
+		require.Equal(t, "qux", packages[0].Name)
+
+		require.Len(t, db.ReverseDepends("bazz"), 1)
+		require.Empty(t, db.ReverseDepends("qux"))
+
+		packages = db.ReverseProvides("bazz")
+
+		require.Len(t, packages, 1)
+		require.Equal(t, "baz", packages[0].Name)
+
+		db.Remove(pkg)
+
+		require.Empty(t, db.ReverseDepends("bar"))
+	})
+}
+
+func TestDependents(t *testing.T) {
+	db := database.NewPackageDB()
+	db.AddAll([]types.Package{
+		{Package: debtypes.Package{
+			Name:     "mawk",
+			Version:  version.MustParse("1.3"),
+			Provides: dependency.MustParse("awk"),
+		}},
+		{Package: debtypes.Package{
+			Name:    "foo",
+			Version: version.MustParse("1.0"),
+			Depends: dependency.MustParse("libc6, mawk (>= 1.0)"),
+		}},
+		{Package: debtypes.Package{
+			Name:       "bar",
+			Version:    version.MustParse("2.0"),
+			PreDepends: dependency.MustParse("gawk | awk"),
+		}},
+		{Package: debtypes.Package{
+			Name:    "baz",
+			Version: version.MustParse("3.0"),
+			Depends: dependency.MustParse("gawk"),
+		}},
+	})
+
+	relations := func(dependents []database.Dependent) map[string]string {
+		result := make(map[string]string)
+		for _, dependent := range dependents {
+			result[dependent.Package.Name] = dependent.Relation.String()
+		}
+
+		return result
+	}
+
+	// Dependencies on the virtual packages the package provides are included.
+	require.Equal(t, map[string]string{
+		"foo": "mawk (>= 1.0)",
+		"bar": "gawk | awk",
+	}, relations(db.Dependents("mawk")))
+
+	require.Equal(t, map[string]string{
+		"bar": "gawk | awk",
+		"baz": "gawk",
+	}, relations(db.Dependents("gawk")))
+
+	require.Empty(t, db.Dependents("foo"))
+}
+
+func BenchmarkPackageDB(b *testing.B) {
+	packageList := generatePackages(b)
+
+	b.Run("AddAll", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			db := database.NewPackageDB()
+			db.AddAll(packageList)
+		}
+	})
+
+	db := database.NewPackageDB()
+	db.AddAll(packageList)
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			_ = db.Get(packageList[i%len(packageList)].Name)
+		}
+	})
+
+	b.Run("Len", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = db.Len()
+		}
+	})
+}
+
+// generatePackages generates a package list roughly the size and shape of a
+// Debian main Packages index (multiple versions, dependencies and virtual
+// packages).
+func generatePackages(b *testing.B) []types.Package {
+	const n = 60000
+
+	packageList := make([]types.Package, 0, n)
+	for i := 0; i < n; i++ {
+		pkg := types.Package{
+			Package: debtypes.Package{
+				Name:    fmt.Sprintf("package-%d", i/2),
+				Version: version.MustParse(fmt.Sprintf("1.%d-%d", i/2, i%2+1)),
+			},
+		}
+
+		if i > 1 {
+			depends, err := dependency.Parse(fmt.Sprintf("package-%d (>= 1.0), virtual-%d | package-%d", i/4, i%100, i/3))
+			require.NoError(b, err)
+			pkg.Depends = depends
+		}
+
+		if i%10 == 0 {
+			provides, err := dependency.Parse(fmt.Sprintf("virtual-%d", i%100))
+			require.NoError(b, err)
+			pkg.Provides = provides
+		}
+
+		packageList = append(packageList, pkg)
+	}
+
+	return packageList
 }
@@ -0,0 +1,332 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package debgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+)
+
+// modTime is the modification time used for all generated archive entries
+// (so that the generated packages are reproducible).
+var modTime = time.Unix(0, 0)
+
+// File is a file or directory to include in a generated package.
+type File struct {
+	// Path is the absolute path where the file will be installed.
+	Path string
+	// SourcePath is the path to the file on the local filesystem. If it is a
+	// directory, its contents will be included recursively.
+	SourcePath string
+}
+
+// Write writes a Debian binary package with the provided control metadata
+// and files to the writer.
+func Write(w io.Writer, control types.Package, files []File) error {
+	// The data archive could be large, so buffer it on disk.
+	dataArchiveFile, err := os.CreateTemp("", "debgen-data-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create data archive: %w", err)
+	}
+	defer func() {
+		_ = dataArchiveFile.Close()
+		_ = os.Remove(dataArchiveFile.Name())
+	}()
+
+	md5sums, installedSize, err := writeDataArchive(dataArchiveFile, files)
+	if err != nil {
+		return fmt.Errorf("failed to create data archive: %w", err)
+	}
+
+	if control.InstalledSize == 0 {
+		control.InstalledSize = int((installedSize + 1023) / 1024)
+	}
+
+	var controlBuf bytes.Buffer
+	if err := deb822.Marshal(&controlBuf, control); err != nil {
+		return fmt.Errorf("failed to marshal control file: %w", err)
+	}
+
+	var controlArchive bytes.Buffer
+	err = writeTarGz(&controlArchive, func(tw *tar.Writer) error {
+		if err := writeTarFile(tw, "./control", 0o644, controlBuf.Bytes()); err != nil {
+			return err
+		}
+
+		if len(md5sums) > 0 {
+			return writeTarFile(tw, "./md5sums", 0o644, md5sums)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create control archive: %w", err)
+	}
+
+	dataArchiveSize, err := dataArchiveFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get data archive size: %w", err)
+	}
+
+	if _, err := dataArchiveFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind data archive: %w", err)
+	}
+
+	if _, err := io.WriteString(w, "!<arch>\n"); err != nil {
+		return fmt.Errorf("failed to write ar header: %w", err)
+	}
+
+	debianBinary := "2.0\n"
+	if err := writeArEntry(w, "debian-binary", strings.NewReader(debianBinary), int64(len(debianBinary))); err != nil {
+		return fmt.Errorf("failed to write debian-binary: %w", err)
+	}
+
+	if err := writeArEntry(w, "control.tar.gz", &controlArchive, int64(controlArchive.Len())); err != nil {
+		return fmt.Errorf("failed to write control archive: %w", err)
+	}
+
+	if err := writeArEntry(w, "data.tar.gz", dataArchiveFile, dataArchiveSize); err != nil {
+		return fmt.Errorf("failed to write data archive: %w", err)
+	}
+
+	return nil
+}
+
+// writeDataArchive writes the files to a compressed tar archive, returning the
+// contents of the md5sums control file and the total size of the files.
+func writeDataArchive(w io.Writer, files []File) ([]byte, int64, error) {
+	// Collect the entries to include, keyed by their installed path.
+	entries := map[string]string{
+		".": "",
+	}
+
+	for _, f := range files {
+		if !path.IsAbs(f.Path) {
+			return nil, 0, fmt.Errorf("path must be absolute: %s", f.Path)
+		}
+
+		dest := strings.TrimPrefix(path.Clean(f.Path), "/")
+
+		// Create any missing parent directories.
+		for dir := path.Dir(dest); dir != "."; dir = path.Dir(dir) {
+			if _, ok := entries[dir]; !ok {
+				entries[dir] = ""
+			}
+		}
+
+		err := filepath.WalkDir(f.SourcePath, func(sourcePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relPath, err := filepath.Rel(f.SourcePath, sourcePath)
+			if err != nil {
+				return err
+			}
+
+			entries[path.Join(dest, filepath.ToSlash(relPath))] = sourcePath
+
+			return nil
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to walk %s: %w", f.SourcePath, err)
+		}
+	}
+
+	// Sort the entries so that the archive is reproducible.
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var md5sums bytes.Buffer
+	var installedSize int64
+
+	err := writeTarGz(w, func(tw *tar.Writer) error {
+		for _, name := range names {
+			sourcePath := entries[name]
+
+			tarName := "./" + name
+			if name == "." {
+				tarName = "."
+			}
+
+			// A generated parent directory.
+			if sourcePath == "" {
+				if err := writeTarDir(tw, tarName+"/"); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			fi, err := os.Lstat(sourcePath)
+			if err != nil {
+				return err
+			}
+
+			var link string
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				if link, err = os.Readlink(sourcePath); err != nil {
+					return err
+				}
+			}
+
+			hdr, err := tar.FileInfoHeader(fi, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = tarName
+			if fi.IsDir() {
+				hdr.Name += "/"
+			}
+			hdr.Uid, hdr.Gid = 0, 0
+			hdr.Uname, hdr.Gname = "root", "root"
+			hdr.ModTime = modTime
+			hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+			hdr.Format = tar.FormatGNU
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+
+			installedSize += fi.Size()
+
+			if err := copyFile(tw, &md5sums, name, sourcePath); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return md5sums.Bytes(), installedSize, nil
+}
+
+// copyFile copies the file into the tar archive and appends its checksum to
+// the md5sums file.
+func copyFile(tw *tar.Writer, md5sums io.Writer, name, sourcePath string) error {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", sourcePath, err)
+	}
+
+	_, err = fmt.Fprintf(md5sums, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	return err
+}
+
+func writeArEntry(w io.Writer, name string, r io.Reader, size int64) error {
+	hdr := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n",
+		name, modTime.Unix(), 0, 0, 0o100644, size)
+
+	if _, err := io.WriteString(w, hdr); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(w, r, size); err != nil {
+		return err
+	}
+
+	// Entries are aligned to an even byte boundary.
+	if size%2 != 0 {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTarGz(w io.Writer, fn func(tw *tar.Writer) error) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	if err := fn(tw); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+
+	return nil
+}
+
+func writeTarDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0o755,
+		Uname:    "root",
+		Gname:    "root",
+		ModTime:  modTime,
+		Format:   tar.FormatGNU,
+	})
+}
+
+func writeTarFile(tw *tar.Writer, name string, mode int64, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		Uname:    "root",
+		Gname:    "root",
+		ModTime:  modTime,
+		Format:   tar.FormatGNU,
+	}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package debgen_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs/arfs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/debgen"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	control := types.Package{
+		Name:         "foo",
+		Version:      version.MustParse("1.0"),
+		Architecture: arch.MustParse("all"),
+		Provides:     dependency.MustParse("bar"),
+		Depends:      dependency.MustParse("baz (>= 2.0)"),
+		Description:  "Test package",
+	}
+
+	sourceDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sourceDir, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "bin/foo"), []byte("hello"), 0o755))
+
+	var buf bytes.Buffer
+	require.NoError(t, debgen.Write(&buf, control, []debgen.File{
+		{Path: "/opt/foo", SourcePath: sourceDir},
+	}))
+
+	debFS, err := arfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	debianBinaryFile, err := debFS.Open("debian-binary")
+	require.NoError(t, err)
+
+	debianBinary, err := io.ReadAll(debianBinaryFile)
+	require.NoError(t, err)
+	require.Equal(t, "2.0\n", string(debianBinary))
+
+	controlArchiveFile, err := debFS.Open("control.tar.gz")
+	require.NoError(t, err)
+
+	dr, err := compressmagic.NewReader(controlArchiveFile)
+	require.NoError(t, err)
+
+	controlArchive, err := io.ReadAll(dr)
+	require.NoError(t, err)
+
+	controlFS, err := tarfs.Open(bytes.NewReader(controlArchive))
+	require.NoError(t, err)
+
+	controlFile, err := controlFS.Open("control")
+	require.NoError(t, err)
+
+	decoder, err := deb822.NewDecoder(controlFile, nil)
+	require.NoError(t, err)
+
+	var pkg types.Package
+	require.NoError(t, decoder.Decode(&pkg))
+
+	require.Equal(t, "foo", pkg.Name)
+	require.Equal(t, "1.0", pkg.Version.String())
+	require.Equal(t, "bar", pkg.Provides.String())
+	require.Equal(t, "baz (>= 2.0)", pkg.Depends.String())
+
+	require.Equal(t, 1, pkg.InstalledSize)
+
+	md5sumsFile, err := controlFS.Open("md5sums")
+	require.NoError(t, err)
+
+	md5sums, err := io.ReadAll(md5sumsFile)
+	require.NoError(t, err)
+	require.Equal(t, "5d41402abc4b2a76b9719d911017c592  opt/foo/bin/foo\n", string(md5sums))
+
+	dataArchiveFile, err := debFS.Open("data.tar.gz")
+	require.NoError(t, err)
+
+	dr, err = compressmagic.NewReader(dataArchiveFile)
+	require.NoError(t, err)
+
+	dataArchive, err := io.ReadAll(dr)
+	require.NoError(t, err)
+
+	dataFS, err := tarfs.Open(bytes.NewReader(dataArchive))
+	require.NoError(t, err)
+
+	var filesList []string
+	err = fs.WalkDir(dataFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+
+		filesList = append(filesList, path)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"opt", "opt/foo", "opt/foo/bin", "opt/foo/bin/foo"}, filesList)
+}
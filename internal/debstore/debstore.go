@@ -0,0 +1,372 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package debstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/debco/internal/util/hashreader"
+	"github.com/gofrs/flock"
+)
+
+const extension = ".deb"
+
+// partialDir is the directory (within the store) where incomplete downloads
+// are kept, so they can be resumed.
+const partialDir = ".partial"
+
+// lockExtension is the extension of the lock files that prevent concurrent
+// processes from writing to the same incomplete download.
+const lockExtension = ".lock"
+
+// lockRetryDelay is how often a locked download is checked while waiting for
+// another process to finish with it.
+const lockRetryDelay = 100 * time.Millisecond
+
+// Store is a content-addressed store of Debian package files, keyed by the
+// SHA256 sum of the package. As packages are identified by their contents,
+// the same package fetched from different mirrors is only stored once.
+type Store struct {
+	dir string
+}
+
+// Entry is a package file in the store.
+type Entry struct {
+	// SHA256 is the SHA256 sum of the package file.
+	SHA256 string
+	// Path is the path of the package file.
+	Path string
+	// Size is the size of the package file in bytes.
+	Size int64
+	// LastUsed is when the package file was last used.
+	LastUsed time.Time
+}
+
+// PruneOptions configures which entries are removed from the store.
+type PruneOptions struct {
+	// MaxAge removes entries that have not been used for longer than this
+	// duration (if non-zero).
+	MaxAge time.Duration
+	// MaxSize removes the least recently used entries until the total size of
+	// the store is no larger than this many bytes (if non-zero).
+	MaxSize int64
+}
+
+// New creates a new package store in the given directory.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, partialDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// Get returns the path of the package file with the given SHA256 sum (if
+// present in the store).
+func (s *Store) Get(sha256 string) (string, bool) {
+	if !validSHA256(sha256) {
+		return "", false
+	}
+
+	path := s.path(sha256)
+
+	if _, err := os.Stat(path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error reading stored package", slog.String("path", path), slog.Any("error", err))
+		}
+
+		return "", false
+	}
+
+	// Mark the entry as recently used.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return path, true
+}
+
+// Put reads a package file from r and adds it to the store, returning the
+// path of the stored file. The contents are verified against the SHA256 sum
+// before the package is added.
+func (s *Store) Put(sha256 string, r io.Reader) (string, error) {
+	if !validSHA256(sha256) {
+		return "", fmt.Errorf("invalid SHA256 sum: %q", sha256)
+	}
+
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	hr := hashreader.NewReader(r)
+
+	if _, err := io.Copy(f, hr); err != nil {
+		return "", fmt.Errorf("failed to read package: %w", err)
+	}
+
+	if err := hr.Verify(sha256); err != nil {
+		return "", fmt.Errorf("failed to verify package: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	path := s.path(sha256)
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	return path, nil
+}
+
+// LockPartial locks the incomplete download of the package with the given
+// SHA256 sum for exclusive use by the caller, waiting for any other process
+// that is downloading the same package to finish. It returns the path the
+// download should be written to, and a function that releases the lock.
+func (s *Store) LockPartial(ctx context.Context, sha256 string) (string, func(), error) {
+	if !validSHA256(sha256) {
+		return "", nil, fmt.Errorf("invalid SHA256 sum: %q", sha256)
+	}
+
+	partialPath := s.partialPath(sha256)
+
+	lock := flock.New(partialPath + lockExtension)
+	if _, err := lock.TryLockContext(ctx, lockRetryDelay); err != nil {
+		return "", nil, fmt.Errorf("failed to lock download: %w", err)
+	}
+
+	unlock := func() {
+		if err := lock.Unlock(); err != nil {
+			slog.Warn("Failed to unlock download", slog.String("path", partialPath), slog.Any("error", err))
+		}
+	}
+
+	return partialPath, unlock, nil
+}
+
+// Commit verifies a completed download (written to the partial path) against
+// the SHA256 sum and moves it into the store, returning the path of the
+// stored file. If verification fails, the partial download is removed. The
+// caller must hold the lock on the partial download (see LockPartial).
+func (s *Store) Commit(sha256 string) (string, error) {
+	if !validSHA256(sha256) {
+		return "", fmt.Errorf("invalid SHA256 sum: %q", sha256)
+	}
+
+	partialPath := s.partialPath(sha256)
+
+	f, err := os.Open(partialPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open download: %w", err)
+	}
+	defer f.Close()
+
+	hr := hashreader.NewReader(f)
+	if _, err := io.Copy(io.Discard, hr); err != nil {
+		return "", fmt.Errorf("failed to read download: %w", err)
+	}
+
+	if err := hr.Verify(sha256); err != nil {
+		_ = os.Remove(partialPath)
+		return "", fmt.Errorf("failed to verify package: %w", err)
+	}
+
+	path := s.path(sha256)
+	if err := os.Rename(partialPath, path); err != nil {
+		return "", fmt.Errorf("failed to rename download: %w", err)
+	}
+
+	return path, nil
+}
+
+// List returns all the entries in the store, most recently used first.
+func (s *Store) List() ([]Entry, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	var entries []Entry
+	for _, e := range dirEntries {
+		sha256, ok := strings.CutSuffix(e.Name(), extension)
+		if !ok || !validSHA256(sha256) {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to stat %s: %w", e.Name(), err)
+		}
+
+		entries = append(entries, Entry{
+			SHA256:   sha256,
+			Path:     filepath.Join(s.dir, e.Name()),
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+
+	return entries, nil
+}
+
+// Prune removes entries from the store according to the provided options,
+// returning the removed entries.
+func (s *Store) Prune(opts PruneOptions) ([]Entry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var totalSize int64
+	for _, e := range entries {
+		totalSize += e.Size
+	}
+
+	// Entries are ordered by most recently used, so evict from the end.
+	var removed []Entry
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+
+		expired := opts.MaxAge > 0 && time.Since(e.LastUsed) > opts.MaxAge
+		oversized := opts.MaxSize > 0 && totalSize > opts.MaxSize
+		if !expired && !oversized {
+			continue
+		}
+
+		slog.Debug("Removing stored package", slog.String("sha256", e.SHA256))
+
+		if err := os.Remove(e.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove %s: %w", e.Path, err)
+		}
+
+		totalSize -= e.Size
+		removed = append(removed, e)
+	}
+
+	if err := s.prunePartial(); err != nil {
+		return removed, err
+	}
+
+	return removed, nil
+}
+
+// prunePartial removes incomplete downloads that are not in use by another
+// process. The lock files themselves are kept, as removing them would allow
+// two processes to lock different files for the same download.
+func (s *Store) prunePartial() error {
+	dirEntries, err := os.ReadDir(filepath.Join(s.dir, partialDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to read partial directory: %w", err)
+	}
+
+	for _, e := range dirEntries {
+		if !strings.HasSuffix(e.Name(), extension) {
+			continue
+		}
+
+		partialPath := filepath.Join(s.dir, partialDir, e.Name())
+
+		lock := flock.New(partialPath + lockExtension)
+		locked, err := lock.TryLock()
+		if err != nil {
+			return fmt.Errorf("failed to lock %s: %w", e.Name(), err)
+		}
+		if !locked {
+			continue
+		}
+
+		slog.Debug("Removing incomplete download", slog.String("path", partialPath))
+
+		err = os.Remove(partialPath)
+		_ = lock.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", partialPath, err)
+		}
+	}
+
+	return nil
+}
+
+// Clear removes all entries from the store.
+func (s *Store) Clear() error {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	for _, e := range dirEntries {
+		if err := os.RemoveAll(filepath.Join(s.dir, e.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, partialDir), 0o755); err != nil {
+		return fmt.Errorf("failed to create partial directory: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) path(sha256 string) string {
+	return filepath.Join(s.dir, strings.ToLower(sha256)+extension)
+}
+
+func (s *Store) partialPath(sha256 string) string {
+	return filepath.Join(s.dir, partialDir, strings.ToLower(sha256)+extension)
+}
+
+func validSHA256(sha256 string) bool {
+	if len(sha256) != 64 {
+		return false
+	}
+
+	for _, c := range strings.ToLower(sha256) {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
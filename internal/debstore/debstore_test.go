@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package debstore_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/debco/internal/debstore"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	s, err := debstore.New(t.TempDir())
+	require.NoError(t, err)
+
+	put := func(t *testing.T, contents string) debstore.Entry {
+		sum := sha256.Sum256([]byte(contents))
+
+		path, err := s.Put(hex.EncodeToString(sum[:]), strings.NewReader(contents))
+		require.NoError(t, err)
+
+		return debstore.Entry{SHA256: hex.EncodeToString(sum[:]), Path: path, Size: int64(len(contents))}
+	}
+
+	t.Run("Get and Put", func(t *testing.T) {
+		_, ok := s.Get(strings.Repeat("a", 64))
+		require.False(t, ok)
+
+		e := put(t, "foo")
+
+		path, ok := s.Get(e.SHA256)
+		require.True(t, ok)
+		require.Equal(t, e.Path, path)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "foo", string(data))
+	})
+
+	t.Run("Hash Mismatch", func(t *testing.T) {
+		_, err := s.Put(strings.Repeat("a", 64), strings.NewReader("foo"))
+		require.Error(t, err)
+
+		_, ok := s.Get(strings.Repeat("a", 64))
+		require.False(t, ok)
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		sum := sha256.Sum256([]byte("bar"))
+		sha256Sum := hex.EncodeToString(sum[:])
+
+		partialPath, unlock, err := s.LockPartial(ctx, sha256Sum)
+		require.NoError(t, err)
+		t.Cleanup(unlock)
+
+		require.NoError(t, os.WriteFile(partialPath, []byte("baz"), 0o644))
+
+		_, err = s.Commit(sha256Sum)
+		require.Error(t, err)
+
+		require.NoError(t, os.WriteFile(partialPath, []byte("bar"), 0o644))
+
+		path, err := s.Commit(sha256Sum)
+		require.NoError(t, err)
+
+		storedPath, ok := s.Get(sha256Sum)
+		require.True(t, ok)
+		require.Equal(t, path, storedPath)
+	})
+
+	t.Run("Lock Partial", func(t *testing.T) {
+		sha256Sum := strings.Repeat("b", 64)
+
+		partialPath, unlock, err := s.LockPartial(ctx, sha256Sum)
+		require.NoError(t, err)
+
+		// The download is locked by another user.
+		lockCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		t.Cleanup(cancel)
+
+		_, _, err = s.LockPartial(lockCtx, sha256Sum)
+		require.Error(t, err)
+
+		unlock()
+
+		otherPartialPath, unlock, err := s.LockPartial(ctx, sha256Sum)
+		require.NoError(t, err)
+		unlock()
+
+		require.Equal(t, partialPath, otherPartialPath)
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		require.NoError(t, s.Clear())
+
+		old := put(t, "old")
+		oldTime := time.Now().Add(-48 * time.Hour)
+		require.NoError(t, os.Chtimes(old.Path, oldTime, oldTime))
+
+		large := put(t, "larger")
+		largeTime := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(large.Path, largeTime, largeTime))
+
+		recent := put(t, "new")
+
+		removed, err := s.Prune(debstore.PruneOptions{MaxAge: 24 * time.Hour})
+		require.NoError(t, err)
+		require.Len(t, removed, 1)
+		require.Equal(t, old.SHA256, removed[0].SHA256)
+
+		removed, err = s.Prune(debstore.PruneOptions{MaxSize: 5})
+		require.NoError(t, err)
+		require.Len(t, removed, 1)
+		require.Equal(t, large.SHA256, removed[0].SHA256)
+
+		entries, err := s.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, recent.SHA256, entries[0].SHA256)
+	})
+
+	t.Run("Prune Partial", func(t *testing.T) {
+		unusedPath, unlock, err := s.LockPartial(ctx, strings.Repeat("c", 64))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(unusedPath, []byte("foo"), 0o644))
+		unlock()
+
+		inUsePath, unlock, err := s.LockPartial(ctx, strings.Repeat("d", 64))
+		require.NoError(t, err)
+		t.Cleanup(unlock)
+		require.NoError(t, os.WriteFile(inUsePath, []byte("bar"), 0o644))
+
+		_, err = s.Prune(debstore.PruneOptions{})
+		require.NoError(t, err)
+
+		_, err = os.Stat(unusedPath)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = os.Stat(inUsePath)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,313 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRetries is the default number of times a failed download is retried.
+	DefaultRetries = 3
+	// DefaultMaxConcurrency is the default maximum number of concurrent downloads.
+	DefaultMaxConcurrency = 10
+	// DefaultMaxConcurrencyPerHost is the default maximum number of concurrent
+	// downloads from a single host.
+	DefaultMaxConcurrencyPerHost = 4
+)
+
+// The delay before the first retry, doubled after each subsequent attempt.
+var (
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Options configures a Downloader.
+type Options struct {
+	// Client is used to make requests (if nil, a default client is used).
+	Client *http.Client
+	// Retries is the number of times a failed download is retried.
+	Retries int
+	// MaxConcurrencyPerHost is the maximum number of concurrent downloads from
+	// a single host (0 for unlimited).
+	MaxConcurrencyPerHost int
+	// BandwidthLimit is the maximum total download rate in bytes per second
+	// (0 for unlimited).
+	BandwidthLimit int64
+}
+
+// Downloader downloads files over HTTP. Failed downloads are retried with
+// exponential backoff, and interrupted downloads are resumed where they left
+// off (using HTTP range requests).
+type Downloader struct {
+	client         *http.Client
+	retries        int
+	maxPerHost     int
+	limiter        *rate.Limiter
+	hostsMu        sync.Mutex
+	hostSemaphores map[string]chan struct{}
+}
+
+// New creates a new Downloader.
+func New(opts Options) *Downloader {
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	var limiter *rate.Limiter
+	if opts.BandwidthLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.BandwidthLimit), int(min(opts.BandwidthLimit, 256*1024)))
+	}
+
+	return &Downloader{
+		client:         client,
+		retries:        max(opts.Retries, 0),
+		maxPerHost:     opts.MaxConcurrencyPerHost,
+		limiter:        limiter,
+		hostSemaphores: make(map[string]chan struct{}),
+	}
+}
+
+// Download downloads the file at the URL to the destination path. If the
+// destination already contains part of the file, the download is resumed.
+func (d *Downloader) Download(ctx context.Context, fileURL, dst string) error {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse URL: %w", err)
+	}
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		// The host is only held while downloading (not during the backoff).
+		release, err := d.acquire(ctx, u.Host)
+		if err != nil {
+			return err
+		}
+
+		err = d.download(ctx, fileURL, dst)
+		release()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= d.retries || ctx.Err() != nil {
+			return err
+		}
+
+		slog.Debug("Retrying download", slog.String("url", fileURL),
+			slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (d *Downloader) download(ctx context.Context, fileURL, dst string) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return &permanentError{fmt.Errorf("failed to open file: %w", err)}
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &permanentError{fmt.Errorf("failed to seek file: %w", err)}
+	}
+
+	var resp *http.Response
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+		if err != nil {
+			return &permanentError{fmt.Errorf("failed to create request: %w", err)}
+		}
+
+		if offset > 0 {
+			slog.Debug("Resuming download", slog.String("url", fileURL), slog.Int64("offset", offset))
+
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+
+		resp, err = d.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to download: %w", err)
+		}
+
+		// Only append to the partial file if the server resumed exactly where
+		// it ends, otherwise download the entire file again.
+		if resp.StatusCode == http.StatusPartialContent && offset > 0 && !resumesAt(resp, offset) {
+			slog.Debug("Download did not resume at the end of the partial file, starting over",
+				slog.String("url", fileURL), slog.String("contentRange", resp.Header.Get("Content-Range")))
+
+			_ = resp.Body.Close()
+
+			if err := truncate(f); err != nil {
+				return &permanentError{err}
+			}
+			offset = 0
+
+			continue
+		}
+
+		break
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Append to the existing partial file.
+	case resp.StatusCode == http.StatusOK:
+		// The server doesn't support range requests, so start over.
+		if err := truncate(f); err != nil {
+			return &permanentError{err}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Did we already download the entire file?
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size == offset {
+			return nil
+		}
+
+		// The partial file is invalid, so start over on the next attempt.
+		if err := truncate(f); err != nil {
+			return &permanentError{err}
+		}
+
+		return fmt.Errorf("failed to download: %s", resp.Status)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("failed to download: %s", resp.Status)
+	default:
+		return &permanentError{fmt.Errorf("failed to download: %s", resp.Status)}
+	}
+
+	var body io.Reader = resp.Body
+	if d.limiter != nil {
+		body = &rateLimitedReader{ctx: ctx, r: resp.Body, limiter: d.limiter}
+	}
+
+	if _, err := io.Copy(f, body); err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return &permanentError{fmt.Errorf("failed to close file: %w", err)}
+	}
+
+	return nil
+}
+
+// acquire waits until a download from the host can start, returning a
+// function that must be called once the download is finished.
+func (d *Downloader) acquire(ctx context.Context, host string) (func(), error) {
+	if d.maxPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	d.hostsMu.Lock()
+	sem, ok := d.hostSemaphores[host]
+	if !ok {
+		sem = make(chan struct{}, d.maxPerHost)
+		d.hostSemaphores[host] = sem
+	}
+	d.hostsMu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resumesAt returns true if the partial content response starts at the
+// offset.
+func resumesAt(resp *http.Response, offset int64) bool {
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil {
+		return false
+	}
+
+	return start == offset
+}
+
+func truncate(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	return nil
+}
+
+// permanentError is an error that will not be resolved by retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// rateLimitedReader limits the rate at which data is read (shared across all
+// readers using the same limiter).
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
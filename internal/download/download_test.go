@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/debco/internal/download"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloader(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	content := make([]byte, 256*1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	var requests, rangeRequests, unavailable atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+
+		switch r.URL.Path {
+		case "/flaky.deb":
+			if r.Header.Get("Range") != "" {
+				rangeRequests.Add(1)
+			}
+
+			// Drop the connection halfway through the first attempt.
+			if n == 1 {
+				w.Header().Set("Content-Length", "262144")
+				_, _ = w.Write(content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+
+			http.ServeContent(w, r, "flaky.deb", time.Time{}, bytes.NewReader(content))
+		case "/misaligned.deb":
+			// Answer range requests from the start of the file.
+			if r.Header.Get("Range") != "" {
+				rangeRequests.Add(1)
+
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+
+			_, _ = w.Write(content)
+		case "/unavailable.deb":
+			if unavailable.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			_, _ = w.Write(content)
+		case "/available.deb":
+			_, _ = w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	d := download.New(download.Options{
+		Retries:               3,
+		MaxConcurrencyPerHost: 1,
+		BandwidthLimit:        10 * 1024 * 1024,
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "flaky.deb")
+
+		require.NoError(t, d.Download(context.Background(), srv.URL+"/flaky.deb", dst))
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(content, data))
+
+		require.Equal(t, int32(1), rangeRequests.Load())
+	})
+
+	t.Run("Misaligned Resume", func(t *testing.T) {
+		requests.Store(0)
+		rangeRequests.Store(0)
+
+		dst := filepath.Join(t.TempDir(), "misaligned.deb")
+		require.NoError(t, os.WriteFile(dst, content[:1000], 0o644))
+
+		require.NoError(t, d.Download(context.Background(), srv.URL+"/misaligned.deb", dst))
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(content, data))
+
+		// The file is downloaded again from the start.
+		require.Equal(t, int32(1), rangeRequests.Load())
+		require.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("Release Host During Backoff", func(t *testing.T) {
+		dir := t.TempDir()
+
+		unavailableDone := make(chan error, 1)
+		go func() {
+			unavailableDone <- d.Download(context.Background(), srv.URL+"/unavailable.deb", filepath.Join(dir, "unavailable.deb"))
+		}()
+
+		require.Eventually(t, func() bool {
+			return unavailable.Load() == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// Other downloads from the host can proceed while the failed download
+		// is waiting to be retried.
+		require.NoError(t, d.Download(context.Background(), srv.URL+"/available.deb", filepath.Join(dir, "available.deb")))
+
+		select {
+		case <-unavailableDone:
+			t.Fatal("download finished before the retry backoff elapsed")
+		default:
+		}
+
+		require.NoError(t, <-unavailableDone)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		requests.Store(0)
+
+		err := d.Download(context.Background(), srv.URL+"/missing.deb", filepath.Join(t.TempDir(), "missing.deb"))
+		require.Error(t, err)
+
+		// Permanent errors should not be retried.
+		require.Equal(t, int32(1), requests.Load())
+	})
+}
@@ -0,0 +1,232 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layers
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/debco/internal/database"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/types"
+)
+
+const (
+	// StrategySquashed installs every package in a single layer.
+	StrategySquashed = "squashed"
+	// StrategyEssential installs the essential packages in a base layer, and
+	// everything else in a second layer.
+	StrategyEssential = "essential"
+	// StrategyGroups is like StrategyEssential, but with a layer for each
+	// group of packages in between.
+	StrategyGroups = "groups"
+)
+
+// Group is a named list of packages to install in the same layer.
+type Group struct {
+	// Name is the name of the group.
+	Name string
+	// Packages is a list of package names (or virtual package names).
+	Packages []string
+}
+
+// Layer is a set of packages that are installed in the same layer.
+type Layer struct {
+	// Name is the name of the layer.
+	Name string
+	// Packages are the packages installed in the layer.
+	Packages []types.Package
+}
+
+// FromConfig splits the selected packages into layers using the layer
+// strategy from the recipe (a nil config is the default squashed strategy).
+// The named base packages are installed in the first layer.
+func FromConfig(conf *latestrecipe.LayersConfig, selectedDB *database.PackageDB, base []string) ([]Layer, error) {
+	var layersConf latestrecipe.LayersConfig
+	if conf != nil {
+		layersConf = *conf
+	}
+
+	if layersConf.Strategy != StrategyGroups && len(layersConf.Groups) > 0 {
+		return nil, fmt.Errorf("layer groups require the %q layer strategy", StrategyGroups)
+	}
+
+	switch layersConf.Strategy {
+	case "", StrategySquashed:
+		var packageList []types.Package
+		_ = selectedDB.ForEach(func(pkg types.Package) error {
+			packageList = append(packageList, pkg)
+			return nil
+		})
+
+		return []Layer{{Name: StrategySquashed, Packages: packageList}}, nil
+	case StrategyEssential, StrategyGroups:
+		var groups []Group
+		for _, groupConf := range layersConf.Groups {
+			groups = append(groups, Group{
+				Name:     groupConf.Name,
+				Packages: groupConf.Packages,
+			})
+		}
+
+		return Partition(selectedDB, base, groups)
+	default:
+		return nil, fmt.Errorf("unsupported layer strategy: %s", layersConf.Strategy)
+	}
+}
+
+// Partition assigns the selected packages to layers. The first layer contains
+// the essential packages (those that are needed to install the others), and
+// the named base packages. Each group gets its own layer, and any remaining
+// packages are installed in a final layer. Every layer also contains the
+// dependencies of its packages that are not in a lower layer, so that the
+// lower layers only depend on their own packages. Empty layers are omitted.
+func Partition(selectedDB *database.PackageDB, base []string, groups []Group) ([]Layer, error) {
+	p := &partitioner{
+		selectedDB: selectedDB,
+		assigned:   make(map[string]bool),
+	}
+
+	essential := slices.Clone(base)
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		if pkg.Essential != nil && *pkg.Essential {
+			essential = append(essential, pkg.Name)
+		}
+
+		return nil
+	})
+
+	if err := p.addLayer("essential", essential); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if err := p.addLayer(group.Name, group.Packages); err != nil {
+			return nil, err
+		}
+	}
+
+	var remaining []string
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		if !p.assigned[packageKey(pkg)] {
+			remaining = append(remaining, pkg.Name)
+		}
+
+		return nil
+	})
+
+	if err := p.addLayer("remaining", remaining); err != nil {
+		return nil, err
+	}
+
+	return p.layers, nil
+}
+
+type partitioner struct {
+	selectedDB *database.PackageDB
+	assigned   map[string]bool
+	layers     []Layer
+}
+
+func (p *partitioner) addLayer(name string, packageNames []string) error {
+	layer := Layer{Name: name}
+
+	assign := func(pkg types.Package) {
+		p.assigned[packageKey(pkg)] = true
+		layer.Packages = append(layer.Packages, pkg)
+	}
+
+	var queue []types.Package
+	for _, packageName := range packageNames {
+		candidates := p.candidates(packageName)
+		if len(candidates) == 0 {
+			return fmt.Errorf("package %s in layer %s is not selected", packageName, name)
+		}
+
+		for _, pkg := range candidates {
+			if !p.assigned[packageKey(pkg)] {
+				assign(pkg)
+				queue = append(queue, pkg)
+			}
+		}
+	}
+
+	// Add the dependencies that are not already in a layer.
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+
+		for _, rel := range slices.Concat(pkg.PreDepends.Relations, pkg.Depends.Relations) {
+			dep, ok := p.unsatisfied(rel)
+			if ok {
+				assign(dep)
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	if len(layer.Packages) > 0 {
+		p.layers = append(p.layers, layer)
+	}
+
+	return nil
+}
+
+// unsatisfied returns the selected package that satisfies the relation, if it
+// is not already satisfied by a package in a layer.
+func (p *partitioner) unsatisfied(rel dependency.Relation) (types.Package, bool) {
+	var first *types.Package
+	for _, possi := range rel.Possibilities {
+		for _, pkg := range p.candidates(possi.Name) {
+			if p.assigned[packageKey(pkg)] {
+				return types.Package{}, false
+			}
+
+			if first == nil {
+				first = &pkg
+			}
+		}
+	}
+
+	if first == nil {
+		return types.Package{}, false
+	}
+
+	return *first, true
+}
+
+// candidates returns the selected packages with the given name (or that
+// provide the given virtual package).
+func (p *partitioner) candidates(name string) []types.Package {
+	var candidates []types.Package
+	for _, pkg := range p.selectedDB.Get(name) {
+		if pkg.IsVirtual {
+			candidates = append(candidates, pkg.Providers...)
+		} else {
+			candidates = append(candidates, pkg)
+		}
+	}
+
+	return candidates
+}
+
+func packageKey(pkg types.Package) string {
+	return pkg.Name + "_" + pkg.Version.String() + "_" + pkg.Architecture.String()
+}
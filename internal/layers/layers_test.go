@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layers_test
+
+import (
+	"testing"
+
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/boolean"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/layers"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/dpeckett/debco/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartition(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	essential := boolean.Boolean(true)
+
+	newPackage := func(name, depends, provides string, isEssential bool) types.Package {
+		pkg := types.Package{
+			Package: debtypes.Package{
+				Name:     name,
+				Version:  version.MustParse("1.0"),
+				Depends:  dependency.MustParse(depends),
+				Provides: dependency.MustParse(provides),
+			},
+		}
+
+		if isEssential {
+			pkg.Essential = &essential
+		}
+
+		return pkg
+	}
+
+	selectedDB := database.NewPackageDB()
+	selectedDB.AddAll([]types.Package{
+		newPackage("libc6", "", "", false),
+		newPackage("dash", "libc6", "", true),
+		newPackage("debco", "libc6", "", false),
+		newPackage("mawk", "libc6", "awk", false),
+		newPackage("libpython3", "libc6, libssl", "", false),
+		newPackage("libssl", "libc6", "", false),
+		newPackage("python3", "libpython3, gawk | awk", "", false),
+		newPackage("hello", "python3", "", false),
+	})
+
+	layerNames := func(layerList []layers.Layer) map[string][]string {
+		names := make(map[string][]string)
+		for _, layer := range layerList {
+			for _, pkg := range layer.Packages {
+				names[layer.Name] = append(names[layer.Name], pkg.Name)
+			}
+		}
+
+		return names
+	}
+
+	t.Run("Essential", func(t *testing.T) {
+		layerList, err := layers.Partition(selectedDB, []string{"debco"}, nil)
+		require.NoError(t, err)
+
+		require.Len(t, layerList, 2)
+		names := layerNames(layerList)
+		require.ElementsMatch(t, []string{"dash", "debco", "libc6"}, names["essential"])
+		require.ElementsMatch(t, []string{"hello", "libpython3", "libssl", "mawk", "python3"}, names["remaining"])
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		layerList, err := layers.Partition(selectedDB, nil, []layers.Group{
+			{Name: "ssl", Packages: []string{"libssl"}},
+			{Name: "python", Packages: []string{"python3"}},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"essential", "ssl", "python", "remaining"},
+			[]string{layerList[0].Name, layerList[1].Name, layerList[2].Name, layerList[3].Name})
+
+		names := layerNames(layerList)
+		require.ElementsMatch(t, []string{"dash", "libc6"}, names["essential"])
+		require.ElementsMatch(t, []string{"libssl"}, names["ssl"])
+		// Virtual dependencies are satisfied by their providers.
+		require.ElementsMatch(t, []string{"libpython3", "mawk", "python3"}, names["python"])
+		require.ElementsMatch(t, []string{"debco", "hello"}, names["remaining"])
+	})
+
+	t.Run("Not Selected", func(t *testing.T) {
+		_, err := layers.Partition(selectedDB, nil, []layers.Group{
+			{Name: "perl", Packages: []string{"perl"}},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestFromConfig(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	essential := boolean.Boolean(true)
+
+	selectedDB := database.NewPackageDB()
+	selectedDB.AddAll([]types.Package{
+		{Package: debtypes.Package{Name: "libc6", Version: version.MustParse("1.0")}},
+		{Package: debtypes.Package{Name: "dash", Version: version.MustParse("1.0"), Essential: &essential}},
+		{Package: debtypes.Package{Name: "debco", Version: version.MustParse("1.0")}},
+		{Package: debtypes.Package{Name: "hello", Version: version.MustParse("1.0")}},
+	})
+
+	layerNames := func(layerList []layers.Layer) []string {
+		var names []string
+		for _, layer := range layerList {
+			names = append(names, layer.Name)
+		}
+
+		return names
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		layerList, err := layers.FromConfig(nil, selectedDB, []string{"debco"})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{layers.StrategySquashed}, layerNames(layerList))
+		require.Len(t, layerList[0].Packages, 4)
+	})
+
+	t.Run("Essential", func(t *testing.T) {
+		layerList, err := layers.FromConfig(&latestrecipe.LayersConfig{
+			Strategy: layers.StrategyEssential,
+		}, selectedDB, []string{"debco"})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"essential", "remaining"}, layerNames(layerList))
+		require.Len(t, layerList[0].Packages, 2)
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		layerList, err := layers.FromConfig(&latestrecipe.LayersConfig{
+			Strategy: layers.StrategyGroups,
+			Groups: []latestrecipe.LayerGroupConfig{
+				{Name: "libc", Packages: []string{"libc6"}},
+			},
+		}, selectedDB, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"essential", "libc", "remaining"}, layerNames(layerList))
+	})
+
+	t.Run("Groups Without Strategy", func(t *testing.T) {
+		_, err := layers.FromConfig(&latestrecipe.LayersConfig{
+			Groups: []latestrecipe.LayerGroupConfig{
+				{Name: "libc", Packages: []string{"libc6"}},
+			},
+		}, selectedDB, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("Unsupported Strategy", func(t *testing.T) {
+		_, err := layers.FromConfig(&latestrecipe.LayersConfig{Strategy: "bogus"}, selectedDB, nil)
+		require.Error(t, err)
+	})
+}
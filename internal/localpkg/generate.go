@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package localpkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/debgen"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/types"
+)
+
+// packageNamePattern matches valid Debian package names (see Debian Policy
+// 5.6.1).
+var packageNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// BuildDummy generates a Debian package in the directory for each of the dummy
+// packages declared in the recipe.
+func BuildDummy(dir string, dummyConfs []latestrecipe.DummyPackageConfig) ([]types.Package, error) {
+	var packageList []types.Package
+	for _, dummyConf := range dummyConfs {
+		control, err := newControl(dummyConf.Name, dummyConf.Version, "all", dummyConf.Provides, dummyConf.Depends)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dummy package %s: %w", dummyConf.Name, err)
+		}
+		control.Description = "Dummy package generated by debco"
+
+		pkg, err := generatePackage(dir, *control, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build dummy package %s: %w", dummyConf.Name, err)
+		}
+
+		packageList = append(packageList, *pkg)
+	}
+
+	return packageList, nil
+}
+
+// BuildGenerated generates a Debian package in the directory for each of the
+// packages declared in the recipe that bundle local files.
+func BuildGenerated(dir string, generatedConfs []latestrecipe.GeneratedPackageConfig) ([]types.Package, error) {
+	var packageList []types.Package
+	for _, generatedConf := range generatedConfs {
+		pkgArch := generatedConf.Architecture
+		if pkgArch == "" {
+			pkgArch = "all"
+		}
+
+		control, err := newControl(generatedConf.Name, generatedConf.Version, pkgArch, generatedConf.Provides, generatedConf.Depends)
+		if err != nil {
+			return nil, fmt.Errorf("invalid generated package %s: %w", generatedConf.Name, err)
+		}
+		control.Description = generatedConf.Description
+		if control.Description == "" {
+			control.Description = "Package generated by debco"
+		}
+
+		var files []debgen.File
+		for _, fileConf := range generatedConf.Files {
+			destination, err := cleanDestination(fileConf.Destination)
+			if err != nil {
+				return nil, fmt.Errorf("invalid generated package %s: %w", generatedConf.Name, err)
+			}
+
+			files = append(files, debgen.File{
+				Path:       destination,
+				SourcePath: fileConf.Source,
+			})
+		}
+
+		pkg, err := generatePackage(dir, *control, files)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build generated package %s: %w", generatedConf.Name, err)
+		}
+
+		packageList = append(packageList, *pkg)
+	}
+
+	return packageList, nil
+}
+
+func newControl(name, pkgVersion, pkgArch string, provides, depends []string) (*debtypes.Package, error) {
+	if !packageNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+
+	parsedVersion, err := version.Parse(pkgVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version %q: %w", pkgVersion, err)
+	}
+
+	if strings.HasSuffix(pkgVersion, "-") {
+		return nil, fmt.Errorf("invalid version %q: empty revision", pkgVersion)
+	}
+
+	parsedArch, err := arch.Parse(pkgArch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid architecture: %w", err)
+	}
+
+	parsedProvides, err := dependency.Parse(strings.Join(provides, ", "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid provides: %w", err)
+	}
+
+	parsedDepends, err := dependency.Parse(strings.Join(depends, ", "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid depends: %w", err)
+	}
+
+	return &debtypes.Package{
+		Name:         name,
+		Version:      parsedVersion,
+		Architecture: parsedArch,
+		Maintainer:   "debco",
+		Provides:     parsedProvides,
+		Depends:      parsedDepends,
+		Priority:     "optional",
+	}, nil
+}
+
+// cleanDestination cleans the absolute path that a file is installed at,
+// rejecting paths that escape (or replace) the root directory.
+func cleanDestination(destination string) (string, error) {
+	if !path.IsAbs(destination) {
+		return "", fmt.Errorf("destination must be an absolute path: %q", destination)
+	}
+
+	var depth int
+	for _, elem := range strings.Split(destination, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("destination escapes the root directory: %q", destination)
+			}
+		default:
+			depth++
+		}
+	}
+
+	cleaned := path.Clean(destination)
+	if cleaned == "/" {
+		return "", fmt.Errorf("destination cannot be the root directory: %q", destination)
+	}
+
+	return cleaned, nil
+}
+
+// generatePackage writes a Debian package file into the given directory and
+// returns its database entry.
+func generatePackage(dir string, control debtypes.Package, files []debgen.File) (*types.Package, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create package directory: %w", err)
+	}
+
+	pkg := types.Package{Package: control}
+	pkg.Filename = fmt.Sprintf("%s_%s_%s.deb", control.Name, control.Version.StringWithoutEpoch(), control.Architecture.String())
+	pkg.LocalPath = filepath.Join(dir, pkg.Filename)
+
+	f, err := os.Create(pkg.LocalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create package file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if err := debgen.Write(io.MultiWriter(f, h), control, files); err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close package file: %w", err)
+	}
+
+	pkg.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return &pkg, nil
+}
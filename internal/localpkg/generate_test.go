@@ -0,0 +1,217 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package localpkg_test
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/debco/internal/localpkg"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/dpeckett/debco/internal/unpack"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildDummy(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tests := []struct {
+		name     string
+		conf     latestrecipe.DummyPackageConfig
+		filename string
+		provides string
+		depends  string
+		err      string
+	}{
+		{
+			name:     "Minimal",
+			conf:     latestrecipe.DummyPackageConfig{Name: "foo", Version: "1.0"},
+			filename: "foo_1.0_all.deb",
+		},
+		{
+			name: "Relations",
+			conf: latestrecipe.DummyPackageConfig{
+				Name:     "libc6-dummy",
+				Version:  "1:2.36-9",
+				Provides: []string{"libc6 (= 2.36-9)", "libc-dev"},
+				Depends:  []string{"base-files", "mawk | awk"},
+			},
+			filename: "libc6-dummy_2.36-9_all.deb",
+			provides: "libc6 (= 2.36-9), libc-dev",
+			depends:  "base-files, mawk | awk",
+		},
+		{
+			name: "Invalid Name",
+			conf: latestrecipe.DummyPackageConfig{Name: "Foo_Bar", Version: "1.0"},
+			err:  `invalid name "Foo_Bar"`,
+		},
+		{
+			name: "Single Character Name",
+			conf: latestrecipe.DummyPackageConfig{Name: "f", Version: "1.0"},
+			err:  `invalid name "f"`,
+		},
+		{
+			name: "Name With Newline",
+			conf: latestrecipe.DummyPackageConfig{Name: "foo\nEssential: yes", Version: "1.0"},
+			err:  "invalid name",
+		},
+		{
+			name: "Missing Version",
+			conf: latestrecipe.DummyPackageConfig{Name: "foo"},
+			err:  `invalid version ""`,
+		},
+		{
+			name: "Invalid Version",
+			conf: latestrecipe.DummyPackageConfig{Name: "foo", Version: "latest"},
+			err:  `invalid version "latest"`,
+		},
+		{
+			name: "Empty Revision",
+			conf: latestrecipe.DummyPackageConfig{Name: "foo", Version: "1.0-"},
+			err:  `invalid version "1.0-"`,
+		},
+		{
+			name: "Invalid Depends",
+			conf: latestrecipe.DummyPackageConfig{Name: "foo", Version: "1.0", Depends: []string{"bar (>> )"}},
+			err:  "invalid depends",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packageList, err := localpkg.BuildDummy(t.TempDir(), []latestrecipe.DummyPackageConfig{tt.conf})
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, packageList, 1)
+
+			// The control file written to the package matches the database entry.
+			pkg, err := localpkg.Read(packageList[0].LocalPath)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.filename, pkg.Filename)
+			require.Equal(t, packageList[0].SHA256, pkg.SHA256)
+
+			require.Equal(t, tt.conf.Name, pkg.Name)
+			require.Equal(t, tt.conf.Version, pkg.Version.String())
+			require.Equal(t, "all", pkg.Architecture.String())
+			require.Equal(t, tt.provides, pkg.Provides.String())
+			require.Equal(t, tt.depends, pkg.Depends.String())
+			require.Equal(t, "Dummy package generated by debco", pkg.Description)
+		})
+	}
+}
+
+func TestBuildGenerated(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	sourceDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "motd"), []byte("hello"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(sourceDir, "conf.d"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "conf.d", "app.conf"), []byte("key=value"), 0o644))
+
+	generatedConf := latestrecipe.GeneratedPackageConfig{
+		Name:         "site-config",
+		Version:      "1.0",
+		Architecture: "amd64",
+		Depends:      []string{"base-files"},
+		Files: []latestrecipe.FileConfig{
+			{Source: filepath.Join(sourceDir, "motd"), Destination: "/etc/./motd"},
+			{Source: filepath.Join(sourceDir, "conf.d"), Destination: "/opt/app/../app/conf.d/"},
+		},
+	}
+
+	packageList, err := localpkg.BuildGenerated(t.TempDir(), []latestrecipe.GeneratedPackageConfig{generatedConf})
+	require.NoError(t, err)
+	require.Len(t, packageList, 1)
+
+	pkg, err := localpkg.Read(packageList[0].LocalPath)
+	require.NoError(t, err)
+
+	require.Equal(t, "site-config_1.0_amd64.deb", pkg.Filename)
+	require.Equal(t, "amd64", pkg.Architecture.String())
+	require.Equal(t, "base-files", pkg.Depends.String())
+	require.Equal(t, "Package generated by debco", pkg.Description)
+
+	_, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), []string{pkg.LocalPath}, unpack.Options{})
+	require.NoError(t, err)
+	require.Len(t, dataArchivePaths, 1)
+
+	f, err := os.Open(dataArchivePaths[0])
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		files[path.Clean("/"+hdr.Name)] = string(data)
+	}
+
+	// The destinations are cleaned.
+	require.Equal(t, map[string]string{
+		"/etc/motd":                "hello",
+		"/opt/app/conf.d/app.conf": "key=value",
+	}, files)
+
+	t.Run("Invalid Destination", func(t *testing.T) {
+		for _, destination := range []string{"etc/motd", "/../etc/motd", "/etc/../../motd", "/", "/etc/.."} {
+			generatedConf := generatedConf
+			generatedConf.Files = []latestrecipe.FileConfig{
+				{Source: filepath.Join(sourceDir, "motd"), Destination: destination},
+			}
+
+			_, err := localpkg.BuildGenerated(t.TempDir(), []latestrecipe.GeneratedPackageConfig{generatedConf})
+			require.Error(t, err, destination)
+		}
+	})
+
+	t.Run("Invalid Name", func(t *testing.T) {
+		generatedConf := generatedConf
+		generatedConf.Name = "site config"
+
+		_, err := localpkg.BuildGenerated(t.TempDir(), []latestrecipe.GeneratedPackageConfig{generatedConf})
+		require.ErrorContains(t, err, `invalid name "site config"`)
+	})
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package localpkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/types"
+	"github.com/dpeckett/debco/internal/unpack"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Load separates local package files (paths or globs ending in .deb) from the
+// list of included packages and reads their control metadata.
+func Load(includes []string) ([]string, []types.Package, error) {
+	var includeNameVersions []string
+	var packageList []types.Package
+
+	for _, include := range includes {
+		if !strings.HasSuffix(include, ".deb") {
+			includeNameVersions = append(includeNameVersions, include)
+			continue
+		}
+
+		packagePaths, err := filepath.Glob(include)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid package path %q: %w", include, err)
+		}
+
+		if len(packagePaths) == 0 {
+			return nil, nil, fmt.Errorf("no package files match %q", include)
+		}
+
+		for _, packagePath := range packagePaths {
+			pkg, err := Read(packagePath)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load package %s: %w", packagePath, err)
+			}
+
+			packageList = append(packageList, *pkg)
+		}
+	}
+
+	return includeNameVersions, packageList, nil
+}
+
+// Read reads the control metadata of a local package file.
+func Read(packagePath string) (*types.Package, error) {
+	control, err := unpack.ReadControl(packagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read package file: %w", err)
+	}
+
+	absPath, err := filepath.Abs(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	pkg := types.Package{
+		Package:   *control,
+		LocalPath: absPath,
+	}
+	pkg.Filename = filepath.Base(packagePath)
+	pkg.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return &pkg, nil
+}
+
+// Add adds the local packages built for the target architecture to the
+// package database, returning their names and versions.
+func Add(packageDB *database.PackageDB, platform ocispecs.Platform, localPackages []types.Package) ([]string, error) {
+	targetArch, err := arch.Parse(platform.Architecture)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target architecture: %w", err)
+	}
+
+	var nameVersions []string
+	allArch := arch.MustParse("all")
+	skipped := make(map[string]bool)
+	for _, pkg := range localPackages {
+		if pkg.Architecture.Is(&allArch) || pkg.Architecture.Is(&targetArch) {
+			packageDB.Add(pkg)
+			nameVersions = append(nameVersions, pkg.Name+"="+pkg.Version.String())
+		} else {
+			skipped[pkg.Name] = true
+		}
+	}
+
+	// Local packages can be built for several architectures (eg. for multi-
+	// platform images), but at least one of them must match the target.
+	for name := range skipped {
+		if !slices.ContainsFunc(nameVersions, func(nameVersion string) bool {
+			return strings.HasPrefix(nameVersion, name+"=")
+		}) {
+			return nil, fmt.Errorf("local package %s is not built for %s", name, targetArch)
+		}
+	}
+
+	return nameVersions, nil
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package localpkg_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/debgen"
+	"github.com/dpeckett/debco/internal/localpkg"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	dir := t.TempDir()
+	fooPath := writePackage(t, dir, "foo", "1.0", "amd64")
+	writePackage(t, dir, "foo", "1.0", "arm64")
+
+	includeNameVersions, packageList, err := localpkg.Load([]string{"bash", filepath.Join(dir, "foo_*.deb"), "curl=7.88"})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"bash", "curl=7.88"}, includeNameVersions)
+	require.Len(t, packageList, 2)
+
+	pkg := packageList[0]
+	require.Equal(t, "foo", pkg.Name)
+	require.Equal(t, "amd64", pkg.Architecture.String())
+	require.Equal(t, fooPath, pkg.LocalPath)
+	require.Equal(t, "foo_1.0_amd64.deb", pkg.Filename)
+
+	data, err := os.ReadFile(fooPath)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	require.Equal(t, hex.EncodeToString(sum[:]), pkg.SHA256)
+
+	t.Run("No Matches", func(t *testing.T) {
+		_, _, err := localpkg.Load([]string{filepath.Join(dir, "missing_*.deb")})
+		require.ErrorContains(t, err, "no package files match")
+	})
+}
+
+func TestAdd(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	dir := t.TempDir()
+
+	_, packageList, err := localpkg.Load([]string{
+		writePackage(t, dir, "foo", "1.0", "amd64"),
+		writePackage(t, dir, "foo", "1.0", "arm64"),
+		writePackage(t, dir, "bar", "2.0", "all"),
+	})
+	require.NoError(t, err)
+
+	packageDB := database.NewPackageDB()
+	nameVersions, err := localpkg.Add(packageDB, platforms.MustParse("linux/arm64"), packageList)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"foo=1.0", "bar=2.0"}, nameVersions)
+	require.Equal(t, 2, packageDB.Len())
+	require.Equal(t, "arm64", packageDB.Get("foo")[0].Architecture.String())
+
+	t.Run("Wrong Architecture", func(t *testing.T) {
+		_, err := localpkg.Add(database.NewPackageDB(), platforms.MustParse("linux/riscv64"), packageList)
+		require.ErrorContains(t, err, "local package foo is not built for riscv64")
+	})
+}
+
+func writePackage(t *testing.T, dir, name, pkgVersion, pkgArch string) string {
+	packagePath := filepath.Join(dir, name+"_"+pkgVersion+"_"+pkgArch+".deb")
+
+	f, err := os.Create(packagePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, debgen.Write(f, debtypes.Package{
+		Name:         name,
+		Version:      version.MustParse(pkgVersion),
+		Architecture: arch.MustParse(pkgArch),
+		Maintainer:   "debco",
+	}, nil))
+
+	require.NoError(t, f.Close())
+
+	return packagePath
+}
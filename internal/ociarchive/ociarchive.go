@@ -0,0 +1,456 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ociarchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/debco/internal/util/tarutil"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker media types, which are used interchangeably with the OCI ones.
+const (
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Whiteout files mark paths that are deleted by a layer (see the OCI image
+// layer specification).
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Image is an image read from an OCI archive.
+type Image struct {
+	// Config is the configuration of the image.
+	Config ocispecs.Image
+	// RootFSArchivePath is the path to the flattened root filesystem of the image.
+	RootFSArchivePath string
+}
+
+// Extract reads the image for the platform from the OCI archive (eg. as
+// written by "skopeo copy ... oci-archive:image.tar"), and flattens its layers
+// into a single root filesystem archive in the temporary directory.
+func Extract(tempDir, archivePath string, platform ocispecs.Platform) (*Image, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open oci archive: %w", err)
+	}
+	defer archiveFile.Close()
+
+	fsys, err := tarfs.Open(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read oci archive: %w", err)
+	}
+
+	var index ocispecs.Index
+	if err := readJSON(fsys, "index.json", "", &index); err != nil {
+		return nil, err
+	}
+
+	manifest, config, err := findManifest(fsys, index.Manifests, platforms.Only(platform))
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("oci archive does not contain an image for %s", platforms.Format(platform))
+	}
+
+	var layerPaths []string
+	defer func() {
+		for _, layerPath := range layerPaths {
+			_ = os.Remove(layerPath)
+		}
+	}()
+
+	for i, layer := range manifest.Layers {
+		layerPath := filepath.Join(tempDir, fmt.Sprintf("base-layer-%d.tar", i))
+		if err := decompressLayer(fsys, layer, layerPath); err != nil {
+			return nil, fmt.Errorf("failed to decompress layer %s: %w", layer.Digest, err)
+		}
+
+		layerPaths = append(layerPaths, layerPath)
+	}
+
+	rootFSArchivePath := filepath.Join(tempDir, "base-rootfs.tar")
+	if err := flatten(rootFSArchivePath, layerPaths); err != nil {
+		return nil, fmt.Errorf("failed to flatten image layers: %w", err)
+	}
+
+	return &Image{
+		Config:            *config,
+		RootFSArchivePath: rootFSArchivePath,
+	}, nil
+}
+
+// ReadFile returns the contents of the named regular file in a tar archive.
+func ReadFile(archivePath, name string) ([]byte, error) {
+	var data []byte
+	err := tarutil.Walk(archivePath, func(_ int, hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg || tarutil.CleanPath(hdr.Name) != tarutil.CleanPath(name) {
+			return nil
+		}
+
+		var err error
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, os.ErrNotExist)
+	}
+
+	return data, nil
+}
+
+// findManifest returns the first image manifest (and its configuration) that
+// matches the platform, searching nested indexes.
+func findManifest(fsys fs.FS, descs []ocispecs.Descriptor, matcher platforms.Matcher) (*ocispecs.Manifest, *ocispecs.Image, error) {
+	for _, desc := range descs {
+		if desc.Platform != nil && !matcher.Match(*desc.Platform) {
+			continue
+		}
+
+		switch desc.MediaType {
+		case ocispecs.MediaTypeImageIndex, mediaTypeDockerManifestList:
+			var index ocispecs.Index
+			if err := readJSON(fsys, blobPath(desc.Digest), desc.Digest, &index); err != nil {
+				return nil, nil, err
+			}
+
+			manifest, config, err := findManifest(fsys, index.Manifests, matcher)
+			if err != nil || manifest != nil {
+				return manifest, config, err
+			}
+		case ocispecs.MediaTypeImageManifest, mediaTypeDockerManifest:
+			var manifest ocispecs.Manifest
+			if err := readJSON(fsys, blobPath(desc.Digest), desc.Digest, &manifest); err != nil {
+				return nil, nil, err
+			}
+
+			var config ocispecs.Image
+			if err := readJSON(fsys, blobPath(manifest.Config.Digest), manifest.Config.Digest, &config); err != nil {
+				return nil, nil, err
+			}
+
+			if matcher.Match(ocispecs.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}) {
+				return &manifest, &config, nil
+			}
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// readJSON unmarshals a JSON file from the OCI archive, verifying its digest
+// (if known).
+func readJSON(fsys fs.FS, name string, dgst digest.Digest, v any) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	if dgst != "" && digest.FromBytes(data) != dgst {
+		return fmt.Errorf("digest mismatch for %s", name)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// decompressLayer writes the decompressed layer to the given path, verifying
+// the digest of the layer.
+func decompressLayer(fsys fs.FS, layer ocispecs.Descriptor, layerPath string) error {
+	f, err := fsys.Open(blobPath(layer.Digest))
+	if err != nil {
+		return fmt.Errorf("failed to open layer: %w", err)
+	}
+	defer f.Close()
+
+	verifier := layer.Digest.Verifier()
+
+	dr, err := compressmagic.NewReader(io.TeeReader(f, verifier))
+	if err != nil {
+		return fmt.Errorf("failed to decompress layer: %w", err)
+	}
+	defer dr.Close()
+
+	layerFile, err := os.Create(layerPath)
+	if err != nil {
+		return fmt.Errorf("failed to create layer archive: %w", err)
+	}
+	defer layerFile.Close()
+
+	if _, err := io.Copy(layerFile, dr); err != nil {
+		return fmt.Errorf("failed to write layer archive: %w", err)
+	}
+
+	// Make sure the whole blob has been read before verifying it.
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	if !verifier.Verified() {
+		return errors.New("digest mismatch")
+	}
+
+	return layerFile.Close()
+}
+
+// flatten writes the (decompressed) layers into a single root filesystem
+// archive, applying whiteouts, so that each path is written once with the
+// contents of the uppermost layer. Hardlinks whose target is not written
+// before them (eg. because it was deleted, or replaced by an upper layer) are
+// written as copies of the file they were linked to.
+func flatten(rootFSArchivePath string, layerPaths []string) error {
+	winners := make(map[string]tarutil.EntryRef)
+	// The uppermost layer that deleted each path (and everything below it).
+	deleted := make(map[string]int)
+	// The uppermost layer that deleted everything below each path.
+	deletedBelow := make(map[string]int)
+
+	isDir := make(map[string]bool)
+
+	// The file that each hardlink refers to (at the time it was linked).
+	linkSources := make(map[tarutil.EntryRef]linkSource)
+
+	for i, layerPath := range layerPaths {
+		err := tarutil.Walk(layerPath, func(index int, hdr *tar.Header, _ io.Reader) error {
+			name := tarutil.CleanPath(hdr.Name)
+			dir, base := tarutil.Dir(name), path.Base(name)
+
+			switch {
+			case base == whiteoutOpaque:
+				deletedBelow[dir] = i
+			case strings.HasPrefix(base, whiteoutPrefix):
+				deleted[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = i
+			default:
+				// Replacing a directory removes its contents.
+				if isDir[name] && hdr.Typeflag != tar.TypeDir {
+					deletedBelow[name] = i
+				}
+
+				ref := tarutil.EntryRef{Archive: i, Index: index}
+				if hdr.Typeflag == tar.TypeLink {
+					target := tarutil.CleanPath(hdr.Linkname)
+					targetRef, ok := winners[target]
+					if !ok {
+						return fmt.Errorf("hardlink %s to missing file %s", hdr.Name, hdr.Linkname)
+					}
+
+					// Links to links refer to the same file.
+					source, ok := linkSources[targetRef]
+					if !ok {
+						source = linkSource{name: target, ref: targetRef}
+					}
+
+					linkSources[ref] = source
+				}
+
+				winners[name] = ref
+				isDir[name] = hdr.Typeflag == tar.TypeDir
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Returns true if the entry was deleted by a layer above it.
+	isDeleted := func(name string, ref tarutil.EntryRef) bool {
+		if layer, ok := deleted[name]; ok && layer > ref.Archive {
+			return true
+		}
+
+		for dir := name; dir != ""; {
+			dir = tarutil.Dir(dir)
+			if layer, ok := deleted[dir]; ok && layer > ref.Archive {
+				return true
+			}
+			if layer, ok := deletedBelow[dir]; ok && layer > ref.Archive {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	isWritten := func(name string, ref tarutil.EntryRef) bool {
+		return winners[name] == ref && !isDeleted(name, ref)
+	}
+
+	// Hardlinks can only be kept if the file they refer to is written (as
+	// entries are written in order, it is always written before the link).
+	// Otherwise the file is copied.
+	copiedSources := make(map[tarutil.EntryRef]*copiedFile)
+	for _, source := range linkSources {
+		if !isWritten(source.name, source.ref) {
+			copiedSources[source.ref] = nil
+		}
+	}
+
+	copiesDir, err := os.MkdirTemp(filepath.Dir(rootFSArchivePath), "hardlinks-*")
+	if err != nil {
+		return fmt.Errorf("failed to create hardlinks directory: %w", err)
+	}
+	defer os.RemoveAll(copiesDir)
+
+	rootFSArchiveFile, err := os.Create(rootFSArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to create root filesystem archive: %w", err)
+	}
+	defer rootFSArchiveFile.Close()
+
+	bw := bufio.NewWriter(rootFSArchiveFile)
+	tw := tar.NewWriter(bw)
+
+	buf := make([]byte, 1<<16)
+
+	for i, layerPath := range layerPaths {
+		err := tarutil.Walk(layerPath, func(index int, hdr *tar.Header, r io.Reader) error {
+			name := tarutil.CleanPath(hdr.Name)
+
+			ref := tarutil.EntryRef{Archive: i, Index: index}
+
+			if _, ok := copiedSources[ref]; ok {
+				copied, err := copyFile(copiesDir, hdr, r)
+				if err != nil {
+					return fmt.Errorf("failed to copy %s: %w", hdr.Name, err)
+				}
+				copiedSources[ref] = copied
+
+				f, err := copied.open()
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				r = f
+			}
+
+			if !isWritten(name, ref) {
+				return nil
+			}
+
+			if source, ok := linkSources[ref]; ok {
+				if copied := copiedSources[source.ref]; copied != nil {
+					f, err := copied.open()
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+
+					hdr, r = copied.header(hdr.Name), f
+				}
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("failed to write tar header: %w", err)
+			}
+
+			if _, err := io.CopyBuffer(tw, r, buf); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", hdr.Name, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close root filesystem archive: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write root filesystem archive: %w", err)
+	}
+
+	return rootFSArchiveFile.Close()
+}
+
+// linkSource is the file that a hardlink refers to.
+type linkSource struct {
+	name string
+	ref  tarutil.EntryRef
+}
+
+// copiedFile is a copy of a file that hardlinks refer to.
+type copiedFile struct {
+	hdr  tar.Header
+	path string
+}
+
+func copyFile(dir string, hdr *tar.Header, r io.Reader) (*copiedFile, error) {
+	f, err := os.CreateTemp(dir, "file-*")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return &copiedFile{hdr: *hdr, path: f.Name()}, nil
+}
+
+// header returns the header of the file, for a copy with the given name.
+func (c *copiedFile) header(name string) *tar.Header {
+	hdr := c.hdr
+	hdr.Name = name
+	return &hdr
+}
+
+func (c *copiedFile) open() (*os.File, error) {
+	return os.Open(c.path)
+}
+
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
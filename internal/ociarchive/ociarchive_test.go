@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ociarchive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/dpeckett/debco/internal/ociarchive"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	testutil.WriteOCIArchive(t, archivePath, [][]testutil.TarEntry{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir},
+			{Name: "etc/hostname", Content: "base"},
+			{Name: "etc/motd", Content: "hello"},
+			{Name: "opt/", Typeflag: tar.TypeDir},
+			{Name: "opt/app/", Typeflag: tar.TypeDir},
+			{Name: "opt/app/old", Content: "old"},
+			{Name: "var/", Typeflag: tar.TypeDir},
+			{Name: "var/lib/", Typeflag: tar.TypeDir},
+			{Name: "var/lib/dpkg/", Typeflag: tar.TypeDir},
+			{Name: "var/lib/dpkg/status", Content: "Package: base-files\n"},
+		},
+		{
+			{Name: "etc/.wh.motd"},
+			{Name: "etc/hostname", Content: "updated"},
+			{Name: "opt/app/", Typeflag: tar.TypeDir},
+			{Name: "opt/app/.wh..wh..opq"},
+			{Name: "opt/app/new", Content: "new"},
+		},
+	})
+
+	image, err := ociarchive.Extract(tempDir, archivePath, platforms.MustParse("linux/amd64"))
+	require.NoError(t, err)
+
+	require.Equal(t, "amd64", image.Config.Architecture)
+	require.Equal(t, []string{"/bin/sh"}, image.Config.Config.Cmd)
+
+	files := make(map[string]string)
+	tr := tar.NewReader(mustOpen(t, image.RootFSArchivePath))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(tr)
+		require.NoError(t, err)
+
+		files[hdr.Name] = buf.String()
+	}
+
+	require.Equal(t, map[string]string{
+		"etc/":                "",
+		"etc/hostname":        "updated",
+		"opt/":                "",
+		"opt/app/":            "",
+		"opt/app/new":         "new",
+		"var/":                "",
+		"var/lib/":            "",
+		"var/lib/dpkg/":       "",
+		"var/lib/dpkg/status": "Package: base-files\n",
+	}, files)
+
+	status, err := ociarchive.ReadFile(image.RootFSArchivePath, "/var/lib/dpkg/status")
+	require.NoError(t, err)
+	require.Equal(t, "Package: base-files\n", string(status))
+
+	_, err = ociarchive.Extract(tempDir, archivePath, platforms.MustParse("linux/arm64"))
+	require.Error(t, err)
+}
+
+func TestExtractHardlinks(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	testutil.WriteOCIArchive(t, archivePath, [][]testutil.TarEntry{
+		{
+			{Name: "bin/", Typeflag: tar.TypeDir},
+			{Name: "bin/kept", Content: "kept"},
+			{Name: "bin/kept-link", Typeflag: tar.TypeLink, Linkname: "bin/kept"},
+			{Name: "bin/replaced", Content: "old"},
+			{Name: "bin/replaced-link", Typeflag: tar.TypeLink, Linkname: "bin/replaced"},
+			{Name: "bin/replaced-link-link", Typeflag: tar.TypeLink, Linkname: "bin/replaced-link"},
+			{Name: "bin/deleted", Content: "deleted"},
+			{Name: "bin/deleted-link", Typeflag: tar.TypeLink, Linkname: "bin/deleted"},
+		},
+		{
+			{Name: "bin/replaced", Content: "new"},
+			{Name: "bin/.wh.deleted"},
+			// Links to a file in a lower layer.
+			{Name: "bin/upper-link", Typeflag: tar.TypeLink, Linkname: "bin/kept"},
+		},
+	})
+
+	image, err := ociarchive.Extract(tempDir, archivePath, platforms.MustParse("linux/amd64"))
+	require.NoError(t, err)
+
+	type result struct {
+		typeflag byte
+		content  string
+		linkname string
+	}
+
+	files := make(map[string]result)
+	tr := tar.NewReader(mustOpen(t, image.RootFSArchivePath))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(tr)
+		require.NoError(t, err)
+
+		// Hardlinks must come after their target.
+		if hdr.Typeflag == tar.TypeLink {
+			require.Contains(t, files, hdr.Linkname)
+		}
+
+		files[hdr.Name] = result{typeflag: hdr.Typeflag, content: buf.String(), linkname: hdr.Linkname}
+	}
+
+	require.Equal(t, map[string]result{
+		"bin/":                   {typeflag: tar.TypeDir},
+		"bin/kept":               {typeflag: tar.TypeReg, content: "kept"},
+		"bin/kept-link":          {typeflag: tar.TypeLink, linkname: "bin/kept"},
+		"bin/replaced":           {typeflag: tar.TypeReg, content: "new"},
+		"bin/replaced-link":      {typeflag: tar.TypeReg, content: "old"},
+		"bin/replaced-link-link": {typeflag: tar.TypeReg, content: "old"},
+		"bin/deleted-link":       {typeflag: tar.TypeReg, content: "deleted"},
+		"bin/upper-link":         {typeflag: tar.TypeLink, linkname: "bin/kept"},
+	}, files)
+
+	// The copies are cleaned up.
+	matches, err := filepath.Glob(filepath.Join(tempDir, "hardlinks-*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func mustOpen(t *testing.T, name string) *os.File {
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	return f
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recipe
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+)
+
+// ResolvePaths makes the local paths referenced by the recipe (which are
+// relative to the recipe file) absolute, given the directory that contains
+// the recipe file.
+func ResolvePaths(r *latestrecipe.Recipe, dir string) {
+	// Base image archive.
+	if archivePath, ok := strings.CutPrefix(r.From, "oci-archive:"); ok {
+		r.From = "oci-archive:" + resolvePath(dir, archivePath)
+	}
+
+	// Local repositories and signing keys.
+	for i := range r.Sources {
+		sourceConf := &r.Sources[i]
+
+		if sourceURL, err := url.Parse(sourceConf.URL); err == nil && sourceURL.Scheme == "" {
+			sourceConf.URL = resolvePath(dir, sourceConf.URL)
+		}
+
+		if !strings.Contains(sourceConf.SignedBy, "://") {
+			sourceConf.SignedBy = resolvePath(dir, sourceConf.SignedBy)
+		}
+	}
+
+	// BuildKit TLS certificates.
+	if r.Options != nil && r.Options.BuildKit != nil {
+		buildkitConf := r.Options.BuildKit
+		buildkitConf.CACert = resolvePath(dir, buildkitConf.CACert)
+		buildkitConf.Cert = resolvePath(dir, buildkitConf.Cert)
+		buildkitConf.Key = resolvePath(dir, buildkitConf.Key)
+	}
+
+	// Local package files.
+	for i, include := range r.Packages.Include {
+		if strings.HasSuffix(include, ".deb") {
+			r.Packages.Include[i] = resolvePath(dir, include)
+		}
+	}
+
+	// Files bundled into generated packages.
+	for i := range r.Packages.Generated {
+		for j := range r.Packages.Generated[i].Files {
+			fileConf := &r.Packages.Generated[i].Files[j]
+			fileConf.Source = resolvePath(dir, fileConf.Source)
+		}
+	}
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
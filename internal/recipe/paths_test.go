@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recipe_test
+
+import (
+	"testing"
+
+	"github.com/dpeckett/debco/internal/recipe"
+	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePaths(t *testing.T) {
+	r := &latestrecipe.Recipe{
+		From: "oci-archive:images/base.tar",
+		Options: &latestrecipe.OptionsConfig{
+			BuildKit: &latestrecipe.BuildKitConfig{
+				Address: "tcp://buildkitd:1234",
+				CACert:  "certs/ca.pem",
+				Cert:    "/etc/buildkit/cert.pem",
+			},
+		},
+		Sources: []latestrecipe.SourceConfig{
+			{
+				URL:      "repo",
+				SignedBy: "repo/signing_key.asc",
+			},
+			{
+				URL:      "https://deb.debian.org/debian",
+				SignedBy: "https://ftp-master.debian.org/keys/archive-key-12.asc",
+			},
+		},
+		Packages: latestrecipe.PackagesConfig{
+			Include: []string{"bash", "debs/*.deb", "/srv/debs/foo.deb"},
+			Generated: []latestrecipe.GeneratedPackageConfig{
+				{
+					Name: "motd",
+					Files: []latestrecipe.FileConfig{
+						{Source: "files/motd", Destination: "/etc/motd"},
+						{Source: "/srv/files/issue", Destination: "/etc/issue"},
+					},
+				},
+			},
+		},
+	}
+
+	recipe.ResolvePaths(r, "/home/user/recipes")
+
+	require.Equal(t, "oci-archive:/home/user/recipes/images/base.tar", r.From)
+
+	require.Equal(t, "/home/user/recipes/certs/ca.pem", r.Options.BuildKit.CACert)
+	require.Equal(t, "/etc/buildkit/cert.pem", r.Options.BuildKit.Cert)
+	require.Empty(t, r.Options.BuildKit.Key)
+
+	require.Equal(t, "/home/user/recipes/repo", r.Sources[0].URL)
+	require.Equal(t, "/home/user/recipes/repo/signing_key.asc", r.Sources[0].SignedBy)
+	require.Equal(t, "https://deb.debian.org/debian", r.Sources[1].URL)
+	require.Equal(t, "https://ftp-master.debian.org/keys/archive-key-12.asc", r.Sources[1].SignedBy)
+
+	require.Equal(t, []string{"bash", "/home/user/recipes/debs/*.deb", "/srv/debs/foo.deb"}, r.Packages.Include)
+	require.Equal(t, "/home/user/recipes/files/motd", r.Packages.Generated[0].Files[0].Source)
+	require.Equal(t, "/srv/files/issue", r.Packages.Generated[0].Files[1].Source)
+
+	t.Run("Image Reference", func(t *testing.T) {
+		r := &latestrecipe.Recipe{From: "debian:bookworm"}
+
+		recipe.ResolvePaths(r, "/home/user/recipes")
+
+		require.Equal(t, "debian:bookworm", r.From)
+	})
+}
@@ -28,6 +28,11 @@ const APIVersion = "debco/v1alpha1"
 
 type Recipe struct {
 	types.TypeMeta `yaml:",inline"`
+	// From is an optional base image to install the packages on top of. It is
+	// either an image reference (eg. "debian:bookworm"), or the path to an OCI
+	// archive (relative to the recipe file) prefixed with "oci-archive:" (eg.
+	// "oci-archive:base.tar").
+	From string `yaml:"from,omitempty"`
 	// Options contains configuration options for the image.
 	Options *OptionsConfig `yaml:"options,omitempty"`
 	// Sources is a list of apt repositories to use for downloading packages.
@@ -53,13 +58,83 @@ type OptionsConfig struct {
 	OmitUpstreamAPT bool `yaml:"omitUpstreamAPT,omitempty"`
 	// Slimify specifies whether to slimify the image by removing unnecessary files.
 	Slimify bool `yaml:"slimify,omitempty"`
+	// PathExclude is a list of glob patterns (eg. "/usr/share/doc/*") of files
+	// that will not be installed from packages (see dpkg's --path-exclude
+	// option). Unlike slimify, excluded files are never unpacked, and the rules
+	// also apply to packages installed later.
+	PathExclude []string `yaml:"pathExclude,omitempty"`
+	// PathInclude is a list of glob patterns of files that will be installed,
+	// even if they match a PathExclude pattern (eg. "/usr/share/doc/*/copyright").
+	PathInclude []string `yaml:"pathInclude,omitempty"`
+	// Download configures how packages are downloaded.
+	Download *DownloadConfig `yaml:"download,omitempty"`
+	// Layers configures how the image is split into layers.
+	Layers *LayersConfig `yaml:"layers,omitempty"`
+	// BuildKit configures an existing BuildKit daemon to build the image with.
+	BuildKit *BuildKitConfig `yaml:"buildkit,omitempty"`
+}
+
+type BuildKitConfig struct {
+	// Address is the address of an existing BuildKit daemon (eg.
+	// "tcp://buildkitd:1234", "unix:///run/buildkit/buildkitd.sock",
+	// "docker-container://buildkitd" or "kube-pod://buildkitd-0"). If not
+	// specified, a BuildKit daemon is started in a Docker container.
+	Address string `yaml:"address,omitempty"`
+	// CACert is the path to the CA certificate used to verify the daemon (TLS
+	// is only used if it is specified). Paths are relative to the recipe file.
+	CACert string `yaml:"caCert,omitempty"`
+	// Cert is the path to the client certificate.
+	Cert string `yaml:"cert,omitempty"`
+	// Key is the path to the client key.
+	Key string `yaml:"key,omitempty"`
+	// ServerName overrides the name used to verify the daemon certificate.
+	ServerName string `yaml:"serverName,omitempty"`
+}
+
+// LayersConfig configures how the image is split into layers.
+type LayersConfig struct {
+	// Strategy is one of "squashed" (a single layer, the default), "essential"
+	// (a base layer of essential packages, and a layer for everything else),
+	// or "groups" (like "essential", but with a layer for each group of
+	// packages in between). Images that share the same lower layers can share
+	// them in a registry.
+	Strategy string `yaml:"strategy,omitempty"`
+	// Groups is a list of package groups (used by the "groups" strategy).
+	Groups []LayerGroupConfig `yaml:"groups,omitempty"`
+}
+
+// LayerGroupConfig is the configuration for a group of packages that are
+// installed in their own layer.
+type LayerGroupConfig struct {
+	// Name is the name of the group.
+	Name string `yaml:"name"`
+	// Packages is a list of packages to install in the layer. Their
+	// dependencies are also installed in the layer (unless they are already in
+	// a lower layer).
+	Packages []string `yaml:"packages"`
+}
+
+// DownloadConfig configures how packages are downloaded.
+type DownloadConfig struct {
+	// Retries is the number of times a failed download is retried (with
+	// exponential backoff).
+	Retries *int `yaml:"retries,omitempty"`
+	// MaxConcurrency is the maximum number of concurrent downloads.
+	MaxConcurrency int `yaml:"maxConcurrency,omitempty"`
+	// MaxConcurrencyPerHost is the maximum number of concurrent downloads from
+	// a single host.
+	MaxConcurrencyPerHost int `yaml:"maxConcurrencyPerHost,omitempty"`
+	// BandwidthLimit is the maximum total download rate per second (eg. "10MB").
+	BandwidthLimit string `yaml:"bandwidthLimit,omitempty"`
 }
 
 // SourceConfig is the configuration for an apt repository.
 type SourceConfig struct {
-	// URL is the URL of the repository.
+	// URL is the URL of the repository (or the path of a local repository
+	// directory, relative to the recipe file).
 	URL string `yaml:"url"`
-	// Signed by is a public key URL (https) or file path to use for verifying the repository.
+	// Signed by is a public key URL (https) or file path (relative to the recipe
+	// file) to use for verifying the repository.
 	SignedBy string `yaml:"signedBy"`
 	// Distribution specifies the Debian distribution name (e.g., bullseye, buster)
 	// or class (e.g., stable, testing). If not specified, defaults to "stable".
@@ -71,10 +146,64 @@ type SourceConfig struct {
 
 // PackagesConfig is the configuration for packages.
 type PackagesConfig struct {
-	// Include is a list of packages to install.
+	// Include is a list of packages to install. Entries ending in ".deb" are
+	// local package files (or globs), relative to the recipe file.
 	Include []string `yaml:"include,omitempty"`
 	// Exclude is a list of packages to exclude from installation.
 	Exclude []string `yaml:"exclude,omitempty"`
+	// PreferredProviders maps virtual package names to the name of the package
+	// that should be used to satisfy them (eg. awk: mawk). It is used to break
+	// ties when a virtual package has multiple installation candidates.
+	PreferredProviders map[string]string `yaml:"preferredProviders,omitempty"`
+	// Dummy is a list of dummy (equivs-style) packages to install. Dummy
+	// packages contain no files and are used to satisfy dependencies without
+	// installing the real package.
+	Dummy []DummyPackageConfig `yaml:"dummy,omitempty"`
+	// Generated is a list of packages to generate from local files, so that
+	// the files are owned by dpkg like those of any other package.
+	Generated []GeneratedPackageConfig `yaml:"generated,omitempty"`
+}
+
+// DummyPackageConfig is the configuration for a dummy package.
+type DummyPackageConfig struct {
+	// Name is the name of the package.
+	Name string `yaml:"name"`
+	// Version is the version of the package.
+	Version string `yaml:"version"`
+	// Provides is a list of virtual packages that the package provides.
+	Provides []string `yaml:"provides,omitempty"`
+	// Depends is a list of packages that the package depends on.
+	Depends []string `yaml:"depends,omitempty"`
+}
+
+// GeneratedPackageConfig is the configuration for a package generated from
+// local files.
+type GeneratedPackageConfig struct {
+	// Name is the name of the package.
+	Name string `yaml:"name"`
+	// Version is the version of the package.
+	Version string `yaml:"version"`
+	// Architecture is the architecture of the package. If not specified,
+	// defaults to "all".
+	Architecture string `yaml:"architecture,omitempty"`
+	// Description is an optional description of the package.
+	Description string `yaml:"description,omitempty"`
+	// Provides is a list of virtual packages that the package provides.
+	Provides []string `yaml:"provides,omitempty"`
+	// Depends is a list of packages that the package depends on.
+	Depends []string `yaml:"depends,omitempty"`
+	// Files is a list of files and directories to include in the package.
+	Files []FileConfig `yaml:"files"`
+}
+
+// FileConfig is the configuration for a file included in a generated package.
+type FileConfig struct {
+	// Source is the path to a local file or directory (relative to the recipe
+	// file). Directories are included recursively.
+	Source string `yaml:"source"`
+	// Destination is the absolute path where the file or directory will be
+	// installed in the image.
+	Destination string `yaml:"destination"`
 }
 
 // GroupConfig is the configuration for a group.
@@ -30,8 +30,10 @@ import (
 )
 
 // Resolve resolves the dependencies of a list of packages, specified as a list
-// of package name and optional version strings.
-func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVersions []string) (*database.PackageDB, error) {
+// of package name and optional version strings. The preferredProviders map
+// (virtual package name to provider name) is used to choose between multiple
+// providers of a virtual package.
+func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVersions []string, preferredProviders map[string]string) (*database.PackageDB, error) {
 	requestedPackages := map[string]*version.Version{}
 	candidateDB := database.NewPackageDB()
 
@@ -52,6 +54,27 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 		excludedPackages[name] = packageVersion
 	}
 
+	// Warn about preferred providers that will never be used. Excluded
+	// preferred providers are ignored (so that one of the other providers is
+	// chosen as if there was no preference).
+	usablePreferredProviders := make(map[string]string, len(preferredProviders))
+	for virtualName, providerName := range preferredProviders {
+		if _, excluded := excludedPackages[providerName]; excluded {
+			slog.Warn("Preferred provider is excluded",
+				slog.String("virtual", virtualName), slog.String("provider", providerName))
+			continue
+		}
+
+		usablePreferredProviders[virtualName] = providerName
+
+		if !providesVirtualPackage(packageDB, virtualName, providerName) {
+			slog.Warn("Preferred provider does not provide virtual package",
+				slog.String("virtual", virtualName), slog.String("provider", providerName))
+		}
+	}
+
+	preferredProviders = usablePreferredProviders
+
 	for _, includeNameVersion := range includeNameVersions {
 		parts := strings.SplitN(includeNameVersion, "=", 2)
 		name := parts[0]
@@ -103,7 +126,7 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 		}
 		visited[id] = true
 
-		deps, err := getDependencies(packageDB, candidateDB, pkg)
+		deps, err := getDependencies(packageDB, candidateDB, pkg, preferredProviders)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get dependencies for package %s: %w", pkg.Name, err)
 		}
@@ -123,7 +146,7 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 
 	slog.Debug("Pruning candidates with unsatisfiable dependencies")
 
-	pruneUnsatisfied(candidateDB, packageDB)
+	pruneUnsatisfied(candidateDB, packageDB, preferredProviders)
 
 	// If there are multiple versions of the same package, select the newest
 	// version.
@@ -155,7 +178,7 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 		return nil
 	})
 
-	pruneUnsatisfied(selectedDB, packageDB)
+	pruneUnsatisfied(selectedDB, packageDB, preferredProviders)
 
 	slog.Debug("Confirming requested packages are still selected")
 
@@ -176,11 +199,11 @@ func Resolve(packageDB *database.PackageDB, includeNameVersions, excludeNameVers
 }
 
 // pruneUnsatisfied iteratively removes candidates with unsatisfiable dependencies.
-func pruneUnsatisfied(candidateDB, packageDB *database.PackageDB) {
+func pruneUnsatisfied(candidateDB, packageDB *database.PackageDB, preferredProviders map[string]string) {
 	for {
 		var pruneList []types.Package
 		_ = candidateDB.ForEach(func(pkg types.Package) error {
-			if _, err := getDependencies(packageDB, candidateDB, pkg); err != nil {
+			if _, err := getDependencies(packageDB, candidateDB, pkg, preferredProviders); err != nil {
 				slog.Debug("Pruning unsatisfiable candidate",
 					slog.String("name", pkg.Package.Name), slog.String("version", pkg.Version.String()),
 					slog.Any("error", err))
@@ -201,7 +224,7 @@ func pruneUnsatisfied(candidateDB, packageDB *database.PackageDB) {
 	}
 }
 
-func getDependencies(packageDB, candidateDB *database.PackageDB, pkg types.Package) ([]types.Package, error) {
+func getDependencies(packageDB, candidateDB *database.PackageDB, pkg types.Package, preferredProviders map[string]string) ([]types.Package, error) {
 	var dependencies []types.Package
 
 	var relations []dependency.Relation
@@ -240,7 +263,7 @@ func getDependencies(packageDB, candidateDB *database.PackageDB, pkg types.Packa
 			var resolvedPackages []types.Package
 			for _, pkg := range packageList {
 				if pkg.IsVirtual {
-					if resolvedPkg, err := resolveVirtualPackage(packageDB, candidateDB, pkg); err == nil {
+					if resolvedPkg, err := resolveVirtualPackage(packageDB, candidateDB, pkg, preferredProviders); err == nil {
 						resolvedPackages = append(resolvedPackages, resolvedPkg)
 					} else {
 						slog.Debug("Failed to resolve virtual package",
@@ -267,7 +290,7 @@ func getDependencies(packageDB, candidateDB *database.PackageDB, pkg types.Packa
 	return dependencies, nil
 }
 
-func resolveVirtualPackage(packageDB, candidateDB *database.PackageDB, virtualPkg types.Package) (types.Package, error) {
+func resolveVirtualPackage(packageDB, candidateDB *database.PackageDB, virtualPkg types.Package, preferredProviders map[string]string) (types.Package, error) {
 	var virtualProviders []types.Package
 	for _, provider := range virtualPkg.Providers {
 		if pkg, exists := packageDB.ExactlyEqual(provider.Package.Name, provider.Version); exists {
@@ -280,6 +303,33 @@ func resolveVirtualPackage(packageDB, candidateDB *database.PackageDB, virtualPk
 	} else if len(virtualProviders) == 1 {
 		return virtualProviders[0], nil
 	} else {
+		// Has the recipe specified a preferred provider?
+		if preferredName, ok := preferredProviders[virtualPkg.Name]; ok {
+			var preferred []types.Package
+			for _, pkg := range virtualProviders {
+				if pkg.Package.Name == preferredName {
+					preferred = append(preferred, pkg)
+				}
+			}
+
+			if len(preferred) > 0 {
+				// Use an already selected version of the preferred provider, or
+				// otherwise the newest version.
+				newest := preferred[0]
+				for _, pkg := range preferred {
+					if _, exists := candidateDB.ExactlyEqual(pkg.Package.Name, pkg.Version); exists {
+						return pkg, nil
+					}
+
+					if pkg.Version.Compare(newest.Version) > 0 {
+						newest = pkg
+					}
+				}
+
+				return newest, nil
+			}
+		}
+
 		// Has a provider already been selected? Eg. its part of the candidate list.
 		for _, pkg := range virtualProviders {
 			if _, exists := candidateDB.ExactlyEqual(pkg.Package.Name, pkg.Version); exists {
@@ -297,3 +347,21 @@ func resolveVirtualPackage(packageDB, candidateDB *database.PackageDB, virtualPk
 		return types.Package{}, fmt.Errorf("virtual package with multiple installation candidates: %s", virtualPkg.Name)
 	}
 }
+
+// providesVirtualPackage returns true if any version of the named provider
+// provides the virtual package.
+func providesVirtualPackage(packageDB *database.PackageDB, virtualName, providerName string) bool {
+	for _, pkg := range packageDB.Get(virtualName) {
+		if !pkg.IsVirtual {
+			continue
+		}
+
+		for _, provider := range pkg.Providers {
+			if provider.Package.Name == providerName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
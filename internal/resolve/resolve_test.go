@@ -26,6 +26,9 @@ import (
 
 	"github.com/dpeckett/compressmagic"
 	"github.com/dpeckett/deb822"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
 	"github.com/dpeckett/debco/internal/database"
 	"github.com/dpeckett/debco/internal/resolve"
 	"github.com/dpeckett/debco/internal/testutil"
@@ -57,7 +60,7 @@ func TestResolve(t *testing.T) {
 	packageDB := database.NewPackageDB()
 	packageDB.AddAll(packageList)
 
-	selectedDB, err := resolve.Resolve(packageDB, []string{"bash=5.2.15-2+b2"}, nil)
+	selectedDB, err := resolve.Resolve(packageDB, []string{"bash=5.2.15-2+b2"}, nil, nil)
 	require.NoError(t, err)
 
 	var selectedNameVersions []string
@@ -81,3 +84,69 @@ func TestResolve(t *testing.T) {
 
 	require.ElementsMatch(t, expectedNameVersions, selectedNameVersions)
 }
+
+func TestResolvePreferredProviders(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	awk := dependency.Dependency{
+		Relations: []dependency.Relation{
+			{Possibilities: []dependency.Possibility{{Name: "awk"}}},
+		},
+	}
+
+	packageDB := database.NewPackageDB()
+	packageDB.AddAll([]types.Package{
+		{
+			Package: debtypes.Package{
+				Name:    "foo",
+				Version: version.MustParse("1.0"),
+				Depends: awk,
+			},
+		},
+		{
+			Package: debtypes.Package{
+				Name:     "gawk",
+				Version:  version.MustParse("5.2.1"),
+				Provides: awk,
+			},
+		},
+		{
+			Package: debtypes.Package{
+				Name:     "mawk",
+				Version:  version.MustParse("1.3.4"),
+				Provides: awk,
+			},
+		},
+	})
+
+	t.Run("No Preference", func(t *testing.T) {
+		_, err := resolve.Resolve(packageDB, []string{"foo"}, nil, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("Preferred", func(t *testing.T) {
+		selectedDB, err := resolve.Resolve(packageDB, []string{"foo"}, nil, map[string]string{"awk": "mawk"})
+		require.NoError(t, err)
+
+		require.Len(t, selectedDB.Get("mawk"), 1)
+		require.Empty(t, selectedDB.Get("gawk"))
+	})
+
+	t.Run("Unavailable Preference", func(t *testing.T) {
+		_, err := resolve.Resolve(packageDB, []string{"foo"}, nil, map[string]string{"awk": "original-awk"})
+		require.Error(t, err)
+	})
+
+	t.Run("Excluded Preference", func(t *testing.T) {
+		// The excluded preferred provider is ignored, leaving an ambiguous choice.
+		_, err := resolve.Resolve(packageDB, []string{"foo"}, []string{"mawk"}, map[string]string{"awk": "mawk"})
+		require.Error(t, err)
+
+		// Unless one of the other providers is already selected.
+		selectedDB, err := resolve.Resolve(packageDB, []string{"foo", "gawk"}, []string{"mawk"}, map[string]string{"awk": "mawk"})
+		require.NoError(t, err)
+
+		require.Len(t, selectedDB.Get("gawk"), 1)
+		require.Empty(t, selectedDB.Get("mawk"))
+	})
+}
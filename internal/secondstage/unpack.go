@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Unpack extracts a root filesystem archive (see unpack.Merge) on top of the
+// existing system in rootDir. Like dpkg, existing directories (and symlinks
+// to directories, eg. merged /usr symlinks) are kept, and everything else is
+// replaced. Symlinks in existing paths are resolved by the OS, so rootDir
+// should be "/" (unless the symlinks are all relative).
+func Unpack(archivePath, rootDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		path := filepath.Join(rootDir, filepath.Join("/", hdr.Name))
+		if path == filepath.Clean(rootDir) {
+			continue
+		}
+
+		if err := unpackEntry(tr, hdr, rootDir, path); err != nil {
+			return fmt.Errorf("failed to unpack %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func unpackEntry(r io.Reader, hdr *tar.Header, rootDir, path string) error {
+	fi := hdr.FileInfo()
+
+	// Archives don't necessarily include every parent directory.
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	existing, err := os.Lstat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		// Keep existing directories (and symlinks to directories).
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return nil
+		}
+	} else if existing != nil && existing.IsDir() {
+		// Directories aren't replaced by symlinks (eg. if the directory is
+		// already usr merged).
+		if hdr.Typeflag == tar.TypeSymlink {
+			slog.Debug("Keeping existing directory", slog.String("path", hdr.Name))
+			return nil
+		}
+
+		return fmt.Errorf("refusing to replace directory with a non-directory")
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if existing != nil {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Mkdir(path, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		// Write to a temporary file first, so the existing file is replaced
+		// atomically (eg. running binaries).
+		tmpPath := path + ".debco-new"
+
+		f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, r); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		if err := setMetadata(tmpPath, hdr); err != nil {
+			return err
+		}
+
+		return os.Rename(tmpPath, path)
+	case tar.TypeSymlink:
+		if existing != nil {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if existing != nil {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Link(filepath.Join(rootDir, filepath.Join("/", hdr.Linkname)), path); err != nil {
+			return err
+		}
+
+		return nil
+	default:
+		slog.Warn("Skipping unsupported file type",
+			slog.String("path", hdr.Name), slog.String("type", string(hdr.Typeflag)))
+
+		return nil
+	}
+
+	return setMetadata(path, hdr)
+}
+
+// setMetadata sets the ownership, permissions, and modification time of the
+// unpacked file.
+func setMetadata(path string, hdr *tar.Header) error {
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	// Changing the ownership clears the setuid/setgid bits, so the mode is
+	// set afterwards.
+	if err := os.Chmod(path, hdr.FileInfo().Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage_test
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/debco/internal/secondstage"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpack(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	rootDir := t.TempDir()
+
+	// An existing usr merged system.
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "usr/lib"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0o755))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(rootDir, "lib")))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc/hostname"), []byte("old"), 0o644))
+
+	archivePath := filepath.Join(t.TempDir(), "rootfs.tar")
+
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+
+	tw := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755},
+		{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0o700},
+		{Typeflag: tar.TypeReg, Name: "./etc/hostname", Mode: 0o600, Size: 3},
+		{Typeflag: tar.TypeDir, Name: "./lib/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "./lib/libfoo.so", Mode: 0o644, Size: 3},
+		{Typeflag: tar.TypeLink, Name: "./lib/libfoo.so.1", Linkname: "./lib/libfoo.so"},
+		{Typeflag: tar.TypeSymlink, Name: "./usr/lib/libbar.so", Linkname: "libfoo.so"},
+		{Typeflag: tar.TypeReg, Name: "./var/lib/dpkg/updates/0000", Mode: 0o644, Size: 3},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("new"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	require.NoError(t, secondstage.Unpack(archivePath, rootDir))
+
+	// Existing files are replaced.
+	data, err := os.ReadFile(filepath.Join(rootDir, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+
+	fi, err := os.Stat(filepath.Join(rootDir, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// Existing directories are kept.
+	fi, err = os.Stat(filepath.Join(rootDir, "etc"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	// Symlinks to directories are kept.
+	fi, err = os.Lstat(filepath.Join(rootDir, "lib"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeSymlink)
+
+	for _, name := range []string{"libfoo.so", "libfoo.so.1", "libbar.so"} {
+		data, err := os.ReadFile(filepath.Join(rootDir, "usr/lib", name))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(data))
+	}
+
+	// Missing parent directories are created.
+	require.FileExists(t, filepath.Join(rootDir, "var/lib/dpkg/updates/0000"))
+}
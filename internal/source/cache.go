@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/debco/internal/types"
+)
+
+// cacheFormatVersion is incremented whenever the encoding of cached package
+// indexes changes, so that stale entries are ignored.
+const cacheFormatVersion = "v1"
+
+// cacheTrimAge is how long an unused cache entry is kept for.
+const cacheTrimAge = 5 * 24 * time.Hour
+
+// PackagesCache is a persistent on-disk cache of parsed Packages indexes.
+// Entries are keyed by the hash of the InRelease file that listed the
+// component, so a cached index is only reused while the release is unchanged.
+type PackagesCache struct {
+	dir string
+}
+
+type cachedPackages struct {
+	LastUpdated time.Time
+	Packages    []types.Package
+}
+
+// NewPackagesCache creates a new package index cache in the given directory.
+// Entries that have not been used recently are removed.
+func NewPackagesCache(dir string) (*PackagesCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &PackagesCache{dir: dir}
+	c.trim()
+
+	return c, nil
+}
+
+// Get returns the cached packages for the component (if present).
+func (c *PackagesCache) Get(component *Component) ([]types.Package, time.Time, bool) {
+	path := c.path(component)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error opening cached packages", slog.String("path", path), slog.Any("error", err))
+		}
+
+		return nil, time.Time{}, false
+	}
+	defer f.Close()
+
+	dr, err := compressmagic.NewReader(f)
+	if err != nil {
+		slog.Warn("Error decompressing cached packages", slog.String("path", path), slog.Any("error", err))
+		return nil, time.Time{}, false
+	}
+	defer dr.Close()
+
+	var cached cachedPackages
+	if err := gob.NewDecoder(dr).Decode(&cached); err != nil {
+		slog.Warn("Error decoding cached packages", slog.String("path", path), slog.Any("error", err))
+		return nil, time.Time{}, false
+	}
+
+	// Mark the entry as recently used.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return cached.Packages, cached.LastUpdated, true
+}
+
+// Put stores the packages for the component in the cache.
+func (c *PackagesCache) Put(component *Component, packageList []types.Package, lastUpdated time.Time) error {
+	path := c.path(component)
+
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	cw, err := compressmagic.NewWriter(f, path)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+
+	if err := gob.NewEncoder(cw).Encode(&cachedPackages{
+		LastUpdated: lastUpdated,
+		Packages:    packageList,
+	}); err != nil {
+		return fmt.Errorf("failed to encode packages: %w", err)
+	}
+
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("failed to close compressor: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	// Atomically replace any existing entry.
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *PackagesCache) path(component *Component) string {
+	h := sha256.New()
+	for _, s := range []string{cacheFormatVersion, component.ReleaseSHA256, component.URL.String(), component.Name, component.Arch.String()} {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+".gob.zst")
+}
+
+// trim removes cache entries that haven't been used recently.
+func (c *PackagesCache) trim() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		slog.Warn("Error reading cache directory", slog.String("dir", c.dir), slog.Any("error", err))
+		return
+	}
+
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if time.Since(fi.ModTime()) > cacheTrimAge {
+			slog.Debug("Removing unused cache entry", slog.String("name", e.Name()))
+
+			_ = os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/source"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/dpeckett/debco/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackagesCache(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	cache, err := source.NewPackagesCache(t.TempDir())
+	require.NoError(t, err)
+
+	component := &source.Component{
+		Name:          "main",
+		Arch:          arch.MustParse("amd64"),
+		URL:           &url.URL{Scheme: "http", Host: "deb.debian.org", Path: "/debian/dists/stable/main/binary-amd64"},
+		ReleaseSHA256: "a",
+	}
+
+	packageList := []types.Package{
+		{
+			Package: debtypes.Package{
+				Name:         "foo",
+				Version:      version.MustParse("1.0-1"),
+				Architecture: arch.MustParse("amd64"),
+				Depends:      dependency.MustParse("bar (>= 2.0) | baz"),
+			},
+			URLs: []string{"http://deb.debian.org/debian/pool/main/f/foo/foo_1.0-1_amd64.deb"},
+		},
+		{
+			Package: debtypes.Package{
+				Name:         "libbar",
+				Version:      version.MustParse("1:2.0~rc1-3"),
+				Architecture: arch.MustParse("all"),
+			},
+			URLs: []string{"http://deb.debian.org/debian/pool/main/libb/libbar/libbar_2.0~rc1-3_all.deb"},
+		},
+	}
+
+	lastUpdated := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Miss", func(t *testing.T) {
+		_, _, ok := cache.Get(component)
+		require.False(t, ok)
+	})
+
+	t.Run("Hit", func(t *testing.T) {
+		require.NoError(t, cache.Put(component, packageList, lastUpdated))
+
+		cachedPackageList, cachedLastUpdated, ok := cache.Get(component)
+		require.True(t, ok)
+
+		require.True(t, lastUpdated.Equal(cachedLastUpdated))
+		require.Len(t, cachedPackageList, 2)
+		for i, pkg := range packageList {
+			require.Equal(t, pkg.Name, cachedPackageList[i].Name)
+			require.Equal(t, pkg.Version.String(), cachedPackageList[i].Version.String())
+			require.Zero(t, pkg.Version.Compare(cachedPackageList[i].Version))
+			require.Equal(t, pkg.Architecture.String(), cachedPackageList[i].Architecture.String())
+			require.True(t, pkg.Architecture.Is(&cachedPackageList[i].Architecture))
+			require.Equal(t, pkg.URLs, cachedPackageList[i].URLs)
+		}
+		require.Equal(t, "bar (>= 2.0) | baz", cachedPackageList[0].Depends.String())
+	})
+
+	t.Run("Release Changed", func(t *testing.T) {
+		changedComponent := *component
+		changedComponent.ReleaseSHA256 = "b"
+
+		_, _, ok := cache.Get(&changedComponent)
+		require.False(t, ok)
+	})
+}
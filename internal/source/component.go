@@ -46,6 +46,11 @@ type Component struct {
 	URL *url.URL
 	// SHA256Sums are the SHA256 sums of files in the component.
 	SHA256Sums map[string]string
+	// ContentsSHA256Sums are the SHA256 sums of the Contents indexes for the
+	// component (if the repository publishes any).
+	ContentsSHA256Sums map[string]string
+	// ReleaseSHA256 is the SHA256 sum of the InRelease file that listed the component.
+	ReleaseSHA256 string
 	// Internal fields.
 	keyring   openpgp.EntityList
 	sourceURL *url.URL
@@ -0,0 +1,295 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dpeckett/compressmagic"
+	"github.com/dpeckett/debco/internal/util/hashreader"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrNoContents is returned when the repository does not publish a Contents
+// index for the component.
+var ErrNoContents = errors.New("no contents index available")
+
+// ContentsEntry is a file listed in a Contents index.
+type ContentsEntry struct {
+	// Path is the absolute path of the file.
+	Path string `json:"path"`
+	// Packages are the names of the packages that ship the file.
+	Packages []string `json:"packages"`
+}
+
+// NewContentsMatcher returns a function that matches file paths against a
+// path or glob. Patterns without a directory are matched against the file
+// name.
+func NewContentsMatcher(pattern string) (func(filePath string) bool, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	if !strings.Contains(pattern, "/") {
+		return func(filePath string) bool {
+			matched, _ := path.Match(pattern, path.Base(filePath))
+			return matched
+		}, nil
+	}
+
+	pattern = "/" + strings.TrimPrefix(pattern, "/")
+
+	return func(filePath string) bool {
+		matched, _ := path.Match(pattern, filePath)
+		return matched
+	}, nil
+}
+
+// SearchContents searches the Contents indexes of the components concurrently
+// and returns the files whose path satisfies the match function, sorted by
+// path. Files shipped by the same packages in several components are merged.
+// Components without a Contents index are skipped. If done is not nil, it is
+// called after each component has been searched (eg. to report progress).
+func SearchContents(ctx context.Context, components []Component, match func(path string) bool, done func()) ([]ContentsEntry, error) {
+	var entriesMu sync.Mutex
+	entriesByPath := make(map[string][]string)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	for _, component := range components {
+		component := component
+
+		// The Contents-all index is already searched by the architecture
+		// specific components of the same repository component.
+		if component.Arch.String() == "all" && slices.ContainsFunc(components, func(other Component) bool {
+			return other.Arch.String() != "all" && path.Dir(other.URL.String()) == path.Dir(component.URL.String())
+		}) {
+			if done != nil {
+				done()
+			}
+			continue
+		}
+
+		g.Go(func() error {
+			if done != nil {
+				defer done()
+			}
+
+			componentEntries, err := component.SearchContents(ctx, match)
+			if err != nil {
+				if errors.Is(err, ErrNoContents) {
+					slog.Debug("Skipping component without a contents index",
+						slog.String("component", component.URL.String()))
+					return nil
+				}
+
+				return fmt.Errorf("failed to search contents: %w", err)
+			}
+
+			entriesMu.Lock()
+			defer entriesMu.Unlock()
+
+			for _, entry := range componentEntries {
+				for _, name := range entry.Packages {
+					if !slices.Contains(entriesByPath[entry.Path], name) {
+						entriesByPath[entry.Path] = append(entriesByPath[entry.Path], name)
+					}
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]ContentsEntry, 0, len(entriesByPath))
+	for filePath, packageNames := range entriesByPath {
+		slices.Sort(packageNames)
+		entries = append(entries, ContentsEntry{Path: filePath, Packages: packageNames})
+	}
+
+	slices.SortFunc(entries, func(a, b ContentsEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return entries, nil
+}
+
+// SearchContents downloads the Contents indexes of the component and returns
+// all the files whose path satisfies the match function. Architecture
+// specific components also search the Contents-all index, as files from
+// architecture independent packages are only listed there.
+func (c *Component) SearchContents(ctx context.Context, match func(path string) bool) ([]ContentsEntry, error) {
+	indexNames := []string{"Contents-" + c.Arch.String()}
+	if c.Arch.String() != "all" {
+		indexNames = append(indexNames, "Contents-all")
+	}
+
+	var entries []ContentsEntry
+	var found bool
+	for _, indexName := range indexNames {
+		indexEntries, err := c.searchIndex(ctx, indexName, match)
+		if err != nil {
+			if errors.Is(err, ErrNoContents) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		entries = append(entries, indexEntries...)
+		found = true
+	}
+
+	if !found {
+		return nil, ErrNoContents
+	}
+
+	return entries, nil
+}
+
+// searchIndex searches the first available (compressed) variant of the
+// named Contents index.
+func (c *Component) searchIndex(ctx context.Context, indexName string, match func(path string) bool) ([]ContentsEntry, error) {
+	var errs error
+
+	for _, name := range []string{indexName + ".xz", indexName + ".gz", indexName} {
+		sha256Sum, ok := c.ContentsSHA256Sums[name]
+		if !ok {
+			continue
+		}
+
+		contentsURL, err := url.Parse(c.URL.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse component URL: %w", err)
+		}
+
+		// Contents indexes are stored in the component directory rather than
+		// the architecture specific directory.
+		contentsURL.Path = path.Join(path.Dir(contentsURL.Path), name)
+
+		slog.Debug("Attempting to download Contents file", slog.String("url", contentsURL.String()))
+
+		entries, err := c.searchContents(ctx, contentsURL.String(), sha256Sum, match)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to search %s file: %w", name, err))
+			continue
+		}
+
+		return entries, nil
+	}
+
+	if errs == nil {
+		return nil, ErrNoContents
+	}
+
+	return nil, fmt.Errorf("failed to download Contents file: %w", errs)
+}
+
+func (c *Component) searchContents(ctx context.Context, contentsURL, sha256Sum string, match func(path string) bool) ([]ContentsEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, contentsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download: %s", resp.Status)
+	}
+
+	hr := hashreader.NewReader(resp.Body)
+
+	dr, err := compressmagic.NewReader(hr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	defer dr.Close()
+
+	var entries []ContentsEntry
+
+	scanner := bufio.NewScanner(dr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, ok := parseContentsLine(scanner.Text())
+		if ok && match(entry.Path) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	// Make sure the entire file has been hashed.
+	if _, err := io.Copy(io.Discard, hr); err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	if err := hr.Verify(sha256Sum); err != nil {
+		return nil, fmt.Errorf("failed to verify: %w", err)
+	}
+
+	return entries, nil
+}
+
+// parseContentsLine parses a line of a Contents index, eg.
+// "usr/bin/envsubst    devel/gettext-base".
+func parseContentsLine(line string) (ContentsEntry, bool) {
+	line = strings.TrimRight(line, " \t")
+
+	// The file path may contain spaces, so split on the last run of whitespace.
+	i := strings.LastIndexAny(line, " \t")
+	if i < 0 {
+		return ContentsEntry{}, false
+	}
+
+	filePath := strings.TrimRight(line[:i], " \t")
+	if filePath == "" {
+		return ContentsEntry{}, false
+	}
+
+	var packageNames []string
+	for _, qualifiedName := range strings.Split(line[i+1:], ",") {
+		// Package names are qualified by their area and section.
+		packageNames = append(packageNames, path.Base(qualifiedName))
+	}
+
+	return ContentsEntry{
+		Path:     "/" + strings.TrimPrefix(filePath, "/"),
+		Packages: packageNames,
+	}, true
+}
@@ -0,0 +1,261 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/debco/internal/source"
+	"github.com/dpeckett/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponentSearchContents(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	contentsFiles := map[string][]byte{}
+	for name, contents := range map[string]string{
+		"Contents-amd64.gz": "usr/bin/envsubst                                        devel/gettext-base\n" +
+			"usr/share/doc/file with spaces                          doc/foo,non-free/doc/bar\n",
+		"Contents-all.gz": "usr/share/doc/base-files/README                         admin/base-files\n",
+	} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		contentsFiles[name] = buf.Bytes()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, ok := contentsFiles[strings.TrimPrefix(r.URL.Path, "/debian/dists/stable/main/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write(contents)
+	}))
+	t.Cleanup(srv.Close)
+
+	componentURL, err := url.Parse(srv.URL + "/debian/dists/stable/main/binary-amd64")
+	require.NoError(t, err)
+
+	contentsSHA256Sums := make(map[string]string)
+	for name, contents := range contentsFiles {
+		contentsSHA256 := sha256.Sum256(contents)
+		contentsSHA256Sums[name] = hex.EncodeToString(contentsSHA256[:])
+	}
+
+	component := source.Component{
+		Name: "main",
+		Arch: arch.MustParse("amd64"),
+		URL:  componentURL,
+		ContentsSHA256Sums: map[string]string{
+			"Contents-amd64.gz": contentsSHA256Sums["Contents-amd64.gz"],
+		},
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		entries, err := component.SearchContents(context.Background(), func(path string) bool {
+			return strings.HasPrefix(path, "/usr/share/doc/")
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []source.ContentsEntry{
+			{Path: "/usr/share/doc/file with spaces", Packages: []string{"foo", "bar"}},
+		}, entries)
+	})
+
+	t.Run("Architecture Independent", func(t *testing.T) {
+		component := component
+		component.ContentsSHA256Sums = contentsSHA256Sums
+
+		entries, err := component.SearchContents(context.Background(), func(path string) bool {
+			return strings.HasPrefix(path, "/usr/share/doc/")
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []source.ContentsEntry{
+			{Path: "/usr/share/doc/file with spaces", Packages: []string{"foo", "bar"}},
+			{Path: "/usr/share/doc/base-files/README", Packages: []string{"base-files"}},
+		}, entries)
+
+		// Only the Contents-all index is published.
+		component.ContentsSHA256Sums = map[string]string{
+			"Contents-all.gz": contentsSHA256Sums["Contents-all.gz"],
+		}
+
+		entries, err = component.SearchContents(context.Background(), func(path string) bool {
+			return strings.HasPrefix(path, "/usr/share/doc/")
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []source.ContentsEntry{
+			{Path: "/usr/share/doc/base-files/README", Packages: []string{"base-files"}},
+		}, entries)
+	})
+
+	t.Run("Hash Mismatch", func(t *testing.T) {
+		component := component
+		component.ContentsSHA256Sums = map[string]string{
+			"Contents-amd64.gz": strings.Repeat("0", 64),
+		}
+
+		_, err := component.SearchContents(context.Background(), func(string) bool { return true })
+		require.Error(t, err)
+	})
+
+	t.Run("No Contents", func(t *testing.T) {
+		component := component
+		component.ContentsSHA256Sums = nil
+
+		_, err := component.SearchContents(context.Background(), func(string) bool { return true })
+		require.ErrorIs(t, err, source.ErrNoContents)
+	})
+}
+
+func TestSearchContents(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	contentsFiles := map[string][]byte{}
+	for name, contents := range map[string]string{
+		"main/Contents-amd64.gz": "usr/bin/envsubst                                        devel/gettext-base\n" +
+			"usr/bin/hello                                           devel/hello\n",
+		"main/Contents-all.gz":      "usr/bin/tool                                            devel/tool\n",
+		"contrib/Contents-amd64.gz": "usr/bin/hello                                           devel/hello,devel/hello-traditional\n",
+	} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write([]byte(contents))
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		contentsFiles["/debian/dists/stable/"+name] = buf.Bytes()
+	}
+
+	var requestsMu sync.Mutex
+	requests := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsMu.Lock()
+		requests[r.URL.Path]++
+		requestsMu.Unlock()
+
+		contents, ok := contentsFiles[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write(contents)
+	}))
+	t.Cleanup(srv.Close)
+
+	var components []source.Component
+	for _, c := range []struct{ name, arch string }{
+		{"main", "all"},
+		{"main", "amd64"},
+		{"contrib", "amd64"},
+		{"non-free", "amd64"},
+	} {
+		componentURL, err := url.Parse(srv.URL + "/debian/dists/stable/" + c.name + "/binary-" + c.arch)
+		require.NoError(t, err)
+
+		component := source.Component{
+			Name:               c.name,
+			Arch:               arch.MustParse(c.arch),
+			URL:                componentURL,
+			ContentsSHA256Sums: make(map[string]string),
+		}
+
+		// The non-free component does not have a Contents index.
+		for _, name := range []string{"Contents-" + c.arch + ".gz", "Contents-all.gz"} {
+			if contents, ok := contentsFiles["/debian/dists/stable/"+c.name+"/"+name]; ok {
+				contentsSHA256 := sha256.Sum256(contents)
+				component.ContentsSHA256Sums[name] = hex.EncodeToString(contentsSHA256[:])
+			}
+		}
+
+		components = append(components, component)
+	}
+
+	match, err := source.NewContentsMatcher("/usr/bin/*")
+	require.NoError(t, err)
+
+	var searched atomic.Int32
+	entries, err := source.SearchContents(context.Background(), components, match, func() {
+		searched.Add(1)
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []source.ContentsEntry{
+		{Path: "/usr/bin/envsubst", Packages: []string{"gettext-base"}},
+		{Path: "/usr/bin/hello", Packages: []string{"hello", "hello-traditional"}},
+		{Path: "/usr/bin/tool", Packages: []string{"tool"}},
+	}, entries)
+	require.Equal(t, int32(4), searched.Load())
+
+	// The Contents-all index is only searched once.
+	require.Equal(t, 1, requests["/debian/dists/stable/main/Contents-all.gz"])
+
+	t.Run("Error", func(t *testing.T) {
+		components := slices.Clone(components)
+		components[1].ContentsSHA256Sums = map[string]string{
+			"Contents-amd64.gz": strings.Repeat("0", 64),
+		}
+
+		_, err := source.SearchContents(context.Background(), components, match, nil)
+		require.Error(t, err)
+	})
+}
+
+func TestNewContentsMatcher(t *testing.T) {
+	match, err := source.NewContentsMatcher("hello")
+	require.NoError(t, err)
+
+	// Patterns without a directory match the file name.
+	require.True(t, match("/usr/bin/hello"))
+	require.True(t, match("/usr/games/hello"))
+	require.False(t, match("/usr/bin/hello-world"))
+
+	match, err = source.NewContentsMatcher("usr/bin/*")
+	require.NoError(t, err)
+
+	require.True(t, match("/usr/bin/hello"))
+	require.False(t, match("/usr/games/hello"))
+	require.False(t, match("/usr/bin/sub/hello"))
+
+	_, err = source.NewContentsMatcher("[")
+	require.Error(t, err)
+}
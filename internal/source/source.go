@@ -19,13 +19,19 @@
 package source
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
@@ -65,6 +71,17 @@ func NewSource(ctx context.Context, conf latestrecipe.SourceConfig) (*Source, er
 		return nil, fmt.Errorf("failed to parse source URL: %w", err)
 	}
 
+	// A local repository directory (recipe paths have already been made
+	// absolute, see recipe.ResolvePaths).
+	if sourceURL.Scheme == "" {
+		absPath, err := filepath.Abs(conf.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of source: %w", err)
+		}
+
+		sourceURL = &url.URL{Scheme: "file", Path: filepath.ToSlash(absPath)}
+	}
+
 	keyring, err := keyring.Load(ctx, conf.SignedBy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read keyring: %w", err)
@@ -102,7 +119,14 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 		return nil, fmt.Errorf("failed to download InRelease file: %s", resp.Status)
 	}
 
-	decoder, err := deb822.NewDecoder(resp.Body, s.keyring)
+	inRelease, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read InRelease file: %w", err)
+	}
+
+	releaseSHA256 := sha256.Sum256(inRelease)
+
+	decoder, err := deb822.NewDecoder(bytes.NewReader(inRelease), s.keyring)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create decoder: %w", err)
 	}
@@ -161,20 +185,34 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 
 			componentDir := path.Join(path.Base(component), "binary-"+arch.String())
 
+			// Files from architecture independent packages are only listed in
+			// the Contents-all index.
+			contentsPrefixes := []string{path.Join(path.Base(component), "Contents-"+arch.String())}
+			if !arch.Is(&allArch) {
+				contentsPrefixes = append(contentsPrefixes, path.Join(path.Base(component), "Contents-all"))
+			}
+
 			componentSHA256Sums := make(map[string]string)
+			contentsSHA256Sums := make(map[string]string)
 			for _, hash := range release.SHA256 {
 				if strings.HasPrefix(hash.Filename, componentDir) {
 					componentSHA256Sums[strings.TrimPrefix(hash.Filename, componentDir+"/")] = hash.Hash
+				} else if slices.ContainsFunc(contentsPrefixes, func(prefix string) bool {
+					return hash.Filename == prefix || strings.HasPrefix(hash.Filename, prefix+".")
+				}) {
+					contentsSHA256Sums[path.Base(hash.Filename)] = hash.Hash
 				}
 			}
 
 			components = append(components, Component{
-				Name:       component,
-				Arch:       arch,
-				URL:        componentURL,
-				SHA256Sums: componentSHA256Sums,
-				keyring:    s.keyring,
-				sourceURL:  s.sourceURL,
+				Name:               component,
+				Arch:               arch,
+				URL:                componentURL,
+				SHA256Sums:         componentSHA256Sums,
+				ContentsSHA256Sums: contentsSHA256Sums,
+				ReleaseSHA256:      hex.EncodeToString(releaseSHA256[:]),
+				keyring:            s.keyring,
+				sourceURL:          s.sourceURL,
 			})
 		}
 	}
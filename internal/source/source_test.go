@@ -65,6 +65,11 @@ func TestSource(t *testing.T) {
 	require.Equal(t, "main", components[1].Name)
 	require.Equal(t, "amd64", components[1].Arch.String())
 
+	require.Contains(t, components[1].ContentsSHA256Sums, "Contents-amd64.gz")
+	// Files from architecture independent packages are only listed in the
+	// Contents-all index.
+	require.Contains(t, components[1].ContentsSHA256Sums, "Contents-all.gz")
+
 	componentPackages, lastUpdated, err := components[1].Packages(ctx)
 	require.NoError(t, err)
 
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecsv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TarEntry is an entry in an image layer.
+type TarEntry struct {
+	// Name is the path of the entry.
+	Name string
+	// Typeflag is the type of the entry (defaults to a regular file).
+	Typeflag byte
+	// Content is the content of a regular file.
+	Content string
+	// Linkname is the target of a link.
+	Linkname string
+}
+
+// WriteOCIArchive writes a single platform (linux/amd64) image with the given
+// layers to an OCI archive.
+func WriteOCIArchive(t *testing.T, archivePath string, layers [][]TarEntry) {
+	blobs := make(map[string][]byte)
+	addBlob := func(mediaType string, data []byte) ocispecsv1.Descriptor {
+		dgst := digest.FromBytes(data)
+		blobs["blobs/sha256/"+dgst.Encoded()] = data
+
+		return ocispecsv1.Descriptor{
+			MediaType: mediaType,
+			Digest:    dgst,
+			Size:      int64(len(data)),
+		}
+	}
+
+	addJSON := func(mediaType string, v any) ocispecsv1.Descriptor {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+
+		return addBlob(mediaType, data)
+	}
+
+	manifest := ocispecsv1.Manifest{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecsv1.MediaTypeImageManifest,
+	}
+
+	for _, entries := range layers {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+
+		for _, e := range entries {
+			typeflag := e.Typeflag
+			if typeflag == 0 {
+				typeflag = tar.TypeReg
+			}
+
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Typeflag: typeflag,
+				Name:     e.Name,
+				Linkname: e.Linkname,
+				Mode:     0o755,
+				Size:     int64(len(e.Content)),
+			}))
+
+			_, err := tw.Write([]byte(e.Content))
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+
+		manifest.Layers = append(manifest.Layers, addBlob(ocispecsv1.MediaTypeImageLayerGzip, buf.Bytes()))
+	}
+
+	manifest.Config = addJSON(ocispecsv1.MediaTypeImageConfig, ocispecsv1.Image{
+		Platform: ocispecsv1.Platform{OS: "linux", Architecture: "amd64"},
+		Config:   ocispecsv1.ImageConfig{Cmd: []string{"/bin/sh"}},
+	})
+
+	manifestDesc := addJSON(ocispecsv1.MediaTypeImageManifest, manifest)
+
+	index := ocispecsv1.Index{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecsv1.MediaTypeImageIndex,
+		Manifests: []ocispecsv1.Descriptor{manifestDesc},
+	}
+
+	indexData, err := json.Marshal(index)
+	require.NoError(t, err)
+
+	blobs["index.json"] = indexData
+	blobs["oci-layout"] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	var names []string
+	for name := range blobs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(blobs[name])),
+		}))
+
+		_, err := tw.Write(blobs[name])
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+}
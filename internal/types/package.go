@@ -31,6 +31,9 @@ type Package struct {
 
 	// URLs is a list of URLs that the package can be downloaded from.
 	URLs []string `json:"-"`
+	// LocalPath is the path to the package file on the local filesystem, for
+	// packages that do not need to be downloaded.
+	LocalPath string `json:"-"`
 	// IsVirtual is true if the package is a virtual package.
 	IsVirtual bool `json:"-"`
 	// Providers lists packages that provide this virtual package.
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/debco/internal/util/tarutil"
+)
+
+// readControlArchive reads the control file, md5sums, and conffiles from a
+// (decompressed) control archive. The md5sums are keyed by relative path, and
+// are nil if the package doesn't have a md5sums file.
+func readControlArchive(controlArchivePath string) (*types.Package, map[string]string, []string, error) {
+	controlArchiveFile, err := os.Open(controlArchivePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open control archive: %w", err)
+	}
+	defer controlArchiveFile.Close()
+
+	controlArchive, err := tarfs.Open(controlArchiveFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open control archive: %w", err)
+	}
+
+	controlFile, err := controlArchive.Open("control")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open control file: %w", err)
+	}
+	defer controlFile.Close()
+
+	decoder, err := deb822.NewDecoder(controlFile, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create control file decoder: %w", err)
+	}
+
+	var pkg types.Package
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode control file: %w", err)
+	}
+
+	var md5sums map[string]string
+	if md5sumsFile, err := controlArchive.Open("md5sums"); err == nil {
+		defer md5sumsFile.Close()
+
+		md5sums = make(map[string]string)
+
+		scanner := bufio.NewScanner(md5sumsFile)
+		for scanner.Scan() {
+			hash, name, ok := strings.Cut(scanner.Text(), " ")
+			if !ok {
+				continue
+			}
+
+			// Binary mode entries are prefixed with a '*'.
+			md5sums[tarutil.CleanPath(strings.TrimLeft(name, " *"))] = hash
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read md5sums: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, fmt.Errorf("failed to open md5sums: %w", err)
+	}
+
+	var conffiles []string
+	if conffilesFile, err := controlArchive.Open("conffiles"); err == nil {
+		defer conffilesFile.Close()
+
+		scanner := bufio.NewScanner(conffilesFile)
+		for scanner.Scan() {
+			// Entries may be prefixed with flags (eg. "remove-on-upgrade").
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 0 {
+				conffiles = append(conffiles, fields[len(fields)-1])
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read conffiles: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, fmt.Errorf("failed to open conffiles: %w", err)
+	}
+
+	return &pkg, md5sums, conffiles, nil
+}
+
+// hashDataArchive computes the md5sums of the regular files (and hard links)
+// in the (decompressed) data archive that satisfy the match function. The
+// hashes are keyed by relative path. It also returns the total size of all
+// the regular files in the archive.
+func hashDataArchive(dataArchivePath string, match func(name string) bool) (map[string]string, int64, error) {
+	dataArchiveFile, err := os.Open(dataArchivePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open data archive: %w", err)
+	}
+	defer dataArchiveFile.Close()
+
+	hashes := make(map[string]string)
+	var totalSize int64
+
+	tr := tar.NewReader(dataArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, 0, fmt.Errorf("failed to read data archive: %w", err)
+		}
+
+		name := tarutil.CleanPath(hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			totalSize += hdr.Size
+
+			if !match(name) {
+				continue
+			}
+
+			h := md5.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, 0, fmt.Errorf("failed to read %s from data archive: %w", name, err)
+			}
+
+			hashes[name] = hex.EncodeToString(h.Sum(nil))
+		case tar.TypeLink:
+			if hash, ok := hashes[tarutil.CleanPath(hdr.Linkname)]; ok && match(name) {
+				hashes[name] = hash
+			}
+		}
+	}
+
+	return hashes, totalSize, nil
+}
+
+// sortedKeys returns the keys of the map in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/dpeckett/debco/internal/util/tarutil"
+)
+
+// conffileHashes returns the conffiles of the package, in the format used by
+// the dpkg status file (eg. "/etc/debian_version <md5sum>").
+func conffileHashes(controlArchivePath, dataArchivePath string) ([]string, error) {
+	_, _, conffiles, err := readControlArchive(controlArchivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conffiles) == 0 {
+		return nil, nil
+	}
+
+	hashes, _, err := hashDataArchive(dataArchivePath, func(name string) bool {
+		return slices.Contains(conffiles, "/"+name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, conffile := range conffiles {
+		// Conffiles that are not shipped by the package (eg. those that are
+		// removed on upgrade) don't have a hash.
+		hash, ok := hashes[tarutil.CleanPath(conffile)]
+		if !ok {
+			slog.Debug("Conffile is not in the data archive", slog.String("path", conffile))
+			continue
+		}
+
+		entries = append(entries, conffile+" "+hash)
+	}
+
+	return entries, nil
+}
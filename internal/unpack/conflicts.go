@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/dependency"
+	"github.com/dpeckett/debco/internal/util/tarutil"
+)
+
+// maxReportedConflicts limits the number of conflicting paths included in
+// error messages.
+const maxReportedConflicts = 10
+
+// ConflictError reports files that are shipped by more than one package,
+// where none of the packages declares that it replaces the others.
+type ConflictError struct {
+	// Conflicts are the names of the packages that ship each conflicting path.
+	Conflicts map[string][]string
+}
+
+func (e *ConflictError) Error() string {
+	var paths []string
+	for path := range e.Conflicts {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	var conflicts []string
+	for i, path := range paths {
+		if i == maxReportedConflicts {
+			conflicts = append(conflicts, fmt.Sprintf("and %d more", len(paths)-i))
+			break
+		}
+
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", path, strings.Join(e.Conflicts[path], ", ")))
+	}
+
+	return "files are shipped by more than one package: " + strings.Join(conflicts, ", ")
+}
+
+// resolveConflicts finds files that are shipped by more than one package
+// (including the installed packages). If one of the packages being unpacked
+// replaces all the others, the file is removed from the data archives of the
+// replaced packages (and from the file lists of replaced installed packages).
+// If instead an installed package replaces the packages being unpacked, their
+// copies of the file are removed (as dpkg would do). Otherwise a
+// ConflictError is returned. The updated file lists of the installed
+// packages are returned, keyed by the name of the list.
+func resolveConflicts(controlArchivePaths, dataArchivePaths []string, installed []InstalledPackage) (map[string][]string, error) {
+	packages := make([]*types.Package, len(controlArchivePaths))
+	owners := make(map[string][]int)
+	upgraded := make(map[string]bool)
+
+	for i := range controlArchivePaths {
+		var err error
+		packages[i], _, _, err = readControlArchive(controlArchivePaths[i])
+		if err != nil {
+			return nil, err
+		}
+		upgraded[packages[i].Name] = true
+
+		files, err := dataArchiveFiles(dataArchivePaths[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %s: %w", packages[i].Name, err)
+		}
+
+		for _, name := range files {
+			owners[name] = append(owners[name], i)
+		}
+	}
+
+	// Files owned by installed packages (other than those being upgraded).
+	installedOwners := make(map[string][]int)
+	for i, pkg := range installed {
+		if upgraded[pkg.Name] {
+			continue
+		}
+
+		for _, name := range pkg.Files {
+			installedOwners[tarutil.CleanPath(name)] = append(installedOwners[tarutil.CleanPath(name)], i)
+		}
+	}
+
+	conflicts := make(map[string][]string)
+	replacedFiles := make(map[int]map[string]bool)
+	replacedInstalledFiles := make(map[int]map[string]bool)
+
+	for name, pkgIndexes := range owners {
+		installedIndexes := installedOwners[name]
+		if len(pkgIndexes)+len(installedIndexes) < 2 {
+			continue
+		}
+
+		replacer := slices.IndexFunc(pkgIndexes, func(i int) bool {
+			for _, j := range pkgIndexes {
+				if i != j && !replaces(packages[i], packages[j]) {
+					return false
+				}
+			}
+
+			for _, j := range installedIndexes {
+				if !replaces(packages[i], &installed[j].Package) {
+					return false
+				}
+			}
+
+			return true
+		})
+		if replacer >= 0 {
+			for _, i := range pkgIndexes {
+				if i == pkgIndexes[replacer] {
+					continue
+				}
+
+				slog.Debug("Replacing file",
+					slog.String("path", "/"+name),
+					slog.String("package", packages[pkgIndexes[replacer]].Name),
+					slog.String("replaces", packages[i].Name))
+
+				addReplaced(replacedFiles, i, name)
+			}
+
+			for _, j := range installedIndexes {
+				slog.Debug("Replacing installed file",
+					slog.String("path", "/"+name),
+					slog.String("package", packages[pkgIndexes[replacer]].Name),
+					slog.String("replaces", installed[j].Name))
+
+				addReplaced(replacedInstalledFiles, j, name)
+			}
+
+			continue
+		}
+
+		installedReplacer := slices.IndexFunc(installedIndexes, func(j int) bool {
+			for _, i := range pkgIndexes {
+				if !replaces(&installed[j].Package, packages[i]) {
+					return false
+				}
+			}
+
+			return true
+		})
+		if installedReplacer >= 0 {
+			for _, i := range pkgIndexes {
+				slog.Debug("Keeping installed file",
+					slog.String("path", "/"+name),
+					slog.String("package", installed[installedIndexes[installedReplacer]].Name),
+					slog.String("replaces", packages[i].Name))
+
+				addReplaced(replacedFiles, i, name)
+			}
+
+			continue
+		}
+
+		for _, i := range pkgIndexes {
+			conflicts["/"+name] = append(conflicts["/"+name], packages[i].Name)
+		}
+
+		for _, j := range installedIndexes {
+			conflicts["/"+name] = append(conflicts["/"+name], installed[j].Name+" (installed)")
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, &ConflictError{Conflicts: conflicts}
+	}
+
+	for i, names := range replacedFiles {
+		if err := removeFromDataArchive(dataArchivePaths[i], names); err != nil {
+			return nil, fmt.Errorf("failed to remove replaced files from %s: %w", packages[i].Name, err)
+		}
+	}
+
+	updatedLists := make(map[string][]string)
+	for j, names := range replacedInstalledFiles {
+		listName := installed[j].listName
+		if listName == "" {
+			listName = installed[j].Name + ".list"
+		}
+
+		updatedLists[listName] = slices.DeleteFunc(slices.Clone(installed[j].Files), func(name string) bool {
+			return names[tarutil.CleanPath(name)]
+		})
+	}
+
+	return updatedLists, nil
+}
+
+func addReplaced(replaced map[int]map[string]bool, i int, name string) {
+	if replaced[i] == nil {
+		replaced[i] = make(map[string]bool)
+	}
+	replaced[i][name] = true
+}
+
+// replaces returns true if the package declares that it replaces the other
+// package.
+func replaces(pkg, other *types.Package) bool {
+	for _, rel := range pkg.Replaces.Relations {
+		for _, possi := range rel.Possibilities {
+			if satisfies(possi, other) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// satisfies returns true if the package satisfies the possibility (either
+// directly, or for unversioned possibilities, by providing it).
+func satisfies(possi dependency.Possibility, pkg *types.Package) bool {
+	if possi.Name != pkg.Name {
+		if possi.Version != nil {
+			return false
+		}
+
+		for _, rel := range pkg.Provides.Relations {
+			for _, provided := range rel.Possibilities {
+				if provided.Name == possi.Name {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	if possi.Version == nil {
+		return true
+	}
+
+	cmp := pkg.Version.Compare(possi.Version.Version)
+	switch possi.Version.Operator {
+	case "<<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "=":
+		return cmp == 0
+	case ">=":
+		return cmp >= 0
+	case ">>":
+		return cmp > 0
+	default:
+		return false
+	}
+}
+
+// dataArchiveFiles returns the relative paths of everything in the
+// (decompressed) data archive, apart from directories (which can be shared
+// between packages).
+func dataArchiveFiles(dataArchivePath string) ([]string, error) {
+	dataArchiveFile, err := os.Open(dataArchivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data archive: %w", err)
+	}
+	defer dataArchiveFile.Close()
+
+	var files []string
+
+	tr := tar.NewReader(dataArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read data archive: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			files = append(files, tarutil.CleanPath(hdr.Name))
+		}
+	}
+
+	return files, nil
+}
+
+// removeFromDataArchive rewrites the (decompressed) data archive without the
+// named entries.
+func removeFromDataArchive(dataArchivePath string, names map[string]bool) error {
+	dataArchiveFile, err := os.Open(dataArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open data archive: %w", err)
+	}
+	defer dataArchiveFile.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(dataArchivePath), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	tr := tar.NewReader(dataArchiveFile)
+	tw := tar.NewWriter(f)
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read data archive: %w", err)
+		}
+
+		if names[tarutil.CleanPath(hdr.Name)] {
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", hdr.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close data archive: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close data archive: %w", err)
+	}
+
+	return os.Rename(f.Name(), dataArchivePath)
+}
@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dpeckett/debco/internal/util/tarutil"
+)
+
+// dpkgConfigPath is the path of the dpkg configuration fragment that records
+// the path filters (so that packages installed later obey the same rules).
+const dpkgConfigPath = "etc/dpkg/dpkg.cfg.d/debco"
+
+// pathFilter implements the dpkg --path-exclude and --path-include options.
+// Patterns are shell globs (where '*' also matches '/') that are matched
+// against absolute paths.
+type pathFilter struct {
+	exclude []*regexp.Regexp
+	include []*regexp.Regexp
+}
+
+func newPathFilter(exclude, include []string) (*pathFilter, error) {
+	var f pathFilter
+
+	for _, pattern := range exclude {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path-exclude pattern %q: %w", pattern, err)
+		}
+
+		f.exclude = append(f.exclude, re)
+	}
+
+	for _, pattern := range include {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path-include pattern %q: %w", pattern, err)
+		}
+
+		f.include = append(f.include, re)
+	}
+
+	return &f, nil
+}
+
+// empty returns true if the filter doesn't exclude anything.
+func (f *pathFilter) empty() bool {
+	return len(f.exclude) == 0
+}
+
+// excluded returns true if the absolute path matches an exclude pattern, and
+// doesn't match any include pattern. This is equivalent to dpkg's last match
+// wins semantics, with all the path-include options following the
+// path-exclude options.
+func (f *pathFilter) excluded(name string) bool {
+	if !matchAny(f.exclude, name) {
+		return false
+	}
+
+	return !matchAny(f.include, name)
+}
+
+// filterDataArchive rewrites the (decompressed) data archive without the
+// excluded files. Like dpkg, excluded directories are kept if they contain
+// anything that isn't excluded, and hard link targets are always kept.
+func (f *pathFilter) filterDataArchive(dataArchivePath string) error {
+	dataArchiveFile, err := os.Open(dataArchivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open data archive: %w", err)
+	}
+	defer dataArchiveFile.Close()
+
+	var names []string
+	needed := make(map[string]bool)
+
+	tr := tar.NewReader(dataArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read data archive: %w", err)
+		}
+
+		name := tarutil.CleanPath(hdr.Name)
+		if name == "." {
+			continue
+		}
+
+		names = append(names, name)
+
+		if hdr.Typeflag == tar.TypeLink {
+			needed[tarutil.CleanPath(hdr.Linkname)] = true
+		}
+
+		if hdr.Typeflag != tar.TypeDir && !f.excluded("/"+name) {
+			needed[name] = true
+		}
+	}
+
+	// The parent directories (and the targets of hard links) of everything
+	// that is kept are also kept.
+	for name := range needed {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			needed[dir] = true
+		}
+	}
+
+	excludedNames := make(map[string]bool)
+	for _, name := range names {
+		if !needed[name] && f.excluded("/"+name) {
+			excludedNames[name] = true
+		}
+	}
+
+	if len(excludedNames) == 0 {
+		return nil
+	}
+
+	return removeFromDataArchive(dataArchivePath, excludedNames)
+}
+
+// dpkgConfig returns a dpkg configuration fragment with the equivalent
+// path-exclude and path-include options.
+func dpkgConfig(exclude, include []string) string {
+	var sb strings.Builder
+
+	sb.WriteString("# Generated by debco, packages installed later will be filtered using the\n")
+	sb.WriteString("# same rules.\n")
+
+	for _, pattern := range exclude {
+		sb.WriteString("path-exclude=" + pattern + "\n")
+	}
+
+	for _, pattern := range include {
+		sb.WriteString("path-include=" + pattern + "\n")
+	}
+
+	return sb.String()
+}
+
+func matchAny(res []*regexp.Regexp, name string) bool {
+	for _, re := range res {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileGlob converts a fnmatch(3) style pattern (without FNM_PATHNAME, as
+// used by dpkg) into a regular expression.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("pattern must be an absolute path")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			// Find the end of the bracket expression (a ']' immediately
+			// following the opening bracket, or its negation, is literal).
+			j := i + 1
+			if j < len(pattern) && (pattern[j] == '!' || pattern[j] == '^') {
+				j++
+			}
+			if j < len(pattern) && pattern[j] == ']' {
+				j++
+			}
+			for j < len(pattern) && pattern[j] != ']' {
+				j++
+			}
+			if j >= len(pattern) {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+
+			class := pattern[i+1 : j]
+			negate := strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+
+			sb.WriteString("[")
+			if negate {
+				sb.WriteString("^")
+			}
+			sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(class, `\`, `\\`), "[", `\[`))
+			sb.WriteString("]")
+
+			i = j
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+)
+
+const (
+	dpkgStatusPath  = "var/lib/dpkg/status"
+	dpkgUpdatesPath = "var/lib/dpkg/updates"
+	dpkgInfoPath    = "var/lib/dpkg/info"
+)
+
+// InstalledPackage is a package that is already installed (eg. in a base
+// image or a lower layer), and the files that it owns.
+type InstalledPackage struct {
+	types.Package
+	// Files are the absolute paths of the files (and directories) owned by the
+	// package, as listed in its dpkg file list.
+	Files []string
+	// listName is the name of the dpkg file list of the package.
+	listName string
+}
+
+// ReadInstalled reads the packages that are installed in a root filesystem,
+// and the files they own, from its dpkg database (the status file, any
+// pending updates, and the file lists). Packages that have been removed (but
+// whose configuration files remain) are skipped.
+func ReadInstalled(fsys fs.FS) ([]InstalledPackage, error) {
+	packages := make(map[string]types.Package)
+	var names []string
+
+	addPackages := func(data []byte) error {
+		decoder, err := deb822.NewDecoder(bytes.NewReader(data), nil)
+		if err != nil {
+			return err
+		}
+
+		var packageList []types.Package
+		if err := decoder.Decode(&packageList); err != nil {
+			return err
+		}
+
+		for _, pkg := range packageList {
+			id := pkg.Name + ":" + pkg.Architecture.String()
+			if _, ok := packages[id]; !ok {
+				names = append(names, id)
+			}
+			packages[id] = pkg
+		}
+
+		return nil
+	}
+
+	status, err := fs.ReadFile(fsys, dpkgStatusPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read dpkg status: %w", err)
+	}
+
+	if err := addPackages(status); err != nil {
+		return nil, fmt.Errorf("failed to decode dpkg status: %w", err)
+	}
+
+	// Pending updates are applied in order (as dpkg would do).
+	updates, err := fs.ReadDir(fsys, dpkgUpdatesPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read dpkg updates: %w", err)
+	}
+
+	for _, update := range updates {
+		if update.IsDir() || strings.Trim(update.Name(), "0123456789") != "" {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dpkgUpdatesPath, update.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dpkg update %s: %w", update.Name(), err)
+		}
+
+		if err := addPackages(data); err != nil {
+			return nil, fmt.Errorf("failed to decode dpkg update %s: %w", update.Name(), err)
+		}
+	}
+
+	var installed []InstalledPackage
+	for _, id := range names {
+		pkg := packages[id]
+		if !hasFiles(pkg) {
+			continue
+		}
+
+		// Multi-Arch: same packages have architecture qualified file lists.
+		var files []string
+		var listName string
+		for _, name := range []string{id, pkg.Name} {
+			data, err := fs.ReadFile(fsys, path.Join(dpkgInfoPath, name+".list"))
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+
+				return nil, fmt.Errorf("failed to read file list of %s: %w", pkg.Name, err)
+			}
+
+			files, listName = readFileList(data), name+".list"
+			break
+		}
+
+		installed = append(installed, InstalledPackage{
+			Package:  pkg,
+			Files:    files,
+			listName: listName,
+		})
+	}
+
+	return installed, nil
+}
+
+// UpdateInstalled returns the installed packages after the dpkg database in
+// fsys (eg. of a layer unpacked on top of them) has been applied. Packages
+// installed by the update are added (or replace the earlier versions), and the
+// file lists of the other packages are replaced by any updated lists.
+func UpdateInstalled(installed []InstalledPackage, fsys fs.FS) ([]InstalledPackage, error) {
+	added, err := ReadInstalled(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	addedIDs := make(map[string]bool)
+	for _, pkg := range added {
+		addedIDs[pkg.Name+":"+pkg.Architecture.String()] = true
+	}
+
+	var updated []InstalledPackage
+	for _, pkg := range installed {
+		if addedIDs[pkg.Name+":"+pkg.Architecture.String()] {
+			continue
+		}
+
+		if pkg.listName != "" {
+			data, err := fs.ReadFile(fsys, path.Join(dpkgInfoPath, pkg.listName))
+			if err == nil {
+				pkg.Files = readFileList(data)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read file list of %s: %w", pkg.Name, err)
+			}
+		}
+
+		updated = append(updated, pkg)
+	}
+
+	return append(updated, added...), nil
+}
+
+// hasFiles returns true if the files of the package are present on the
+// system, according to its dpkg status (eg. "install ok installed").
+func hasFiles(pkg types.Package) bool {
+	if len(pkg.Status) == 0 {
+		return false
+	}
+
+	state := pkg.Status[len(pkg.Status)-1]
+	return state != "not-installed" && state != "config-files"
+}
+
+func readFileList(data []byte) []string {
+	var files []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" && name != "/." {
+			files = append(files, name)
+		}
+	}
+
+	return files
+}
+
+// fileList returns the contents of a dpkg file list.
+func fileList(files []string) []byte {
+	return []byte(strings.Join(slices.Concat([]string{"/."}, files), "\n") + "\n")
+}
@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/dpeckett/debco/internal/util/tarutil"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// entryRef identifies an entry in one of the archives being merged.
+type entryRef struct {
+	tarutil.EntryRef
+	// typeflag is the type of the entry.
+	typeflag byte
+}
+
+// Merge streams the (decompressed) archives, in order, into a single root
+// filesystem archive (that can be copied into the image in one operation).
+// Each path is only written once, with the same result as extracting the
+// archives one after another using dpkg's rules:
+//
+//   - Later files (and symlinks etc.) overwrite earlier ones.
+//   - Existing directories are never replaced, and their metadata is kept.
+//   - Symlinks are not replaced by directories (eg. merged /usr symlinks).
+//
+// The merged archives are removed.
+func Merge(ctx context.Context, tempDir string, archivePaths []string) (string, error) {
+	var progressOutput io.Writer = os.Stdout
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		progressOutput = io.Discard
+	}
+
+	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
+	defer progress.Shutdown()
+
+	// Find the entry that will be written for each path.
+	winners := make(map[string]entryRef)
+
+	for i, archivePath := range archivePaths {
+		err := tarutil.Walk(archivePath, func(index int, hdr *tar.Header, _ io.Reader) error {
+			name := tarutil.CleanPath(hdr.Name)
+
+			entry := entryRef{EntryRef: tarutil.EntryRef{Archive: i, Index: index}, typeflag: hdr.Typeflag}
+			if existing, ok := winners[name]; !ok || overwrites(existing, entry) {
+				winners[name] = entry
+			} else if existing.typeflag != tar.TypeDir || hdr.Typeflag != tar.TypeDir {
+				slog.Debug("Not overwriting existing path", slog.String("path", "/"+name),
+					slog.String("archive", filepath.Base(archivePath)))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive %s: %w", filepath.Base(archivePath), err)
+		}
+	}
+
+	rootFSArchiveFile, err := os.Create(filepath.Join(tempDir, "rootfs.tar"))
+	if err != nil {
+		return "", fmt.Errorf("failed to create root filesystem archive: %w", err)
+	}
+	defer rootFSArchiveFile.Close()
+
+	bw := bufio.NewWriter(rootFSArchiveFile)
+	tw := tar.NewWriter(bw)
+
+	bar := progress.AddBar(int64(len(archivePaths)),
+		mpb.PrependDecorators(
+			decor.Name("Merging: "),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+		),
+	)
+
+	buf := make([]byte, 1<<16)
+
+	for i, archivePath := range archivePaths {
+		err := tarutil.Walk(archivePath, func(index int, hdr *tar.Header, r io.Reader) error {
+			if winners[tarutil.CleanPath(hdr.Name)] != (entryRef{EntryRef: tarutil.EntryRef{Archive: i, Index: index}, typeflag: hdr.Typeflag}) {
+				return nil
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("failed to write tar header: %w", err)
+			}
+
+			if _, err := io.CopyBuffer(tw, r, buf); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", hdr.Name, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			bar.Abort(true)
+			bar.Wait()
+
+			return "", fmt.Errorf("failed to merge archive %s: %w", filepath.Base(archivePath), err)
+		}
+
+		if err := os.Remove(archivePath); err != nil {
+			bar.Abort(true)
+			bar.Wait()
+
+			return "", fmt.Errorf("failed to remove merged archive: %w", err)
+		}
+
+		bar.Increment()
+	}
+
+	bar.Wait()
+
+	if err := tw.Close(); err != nil {
+		return "", fmt.Errorf("failed to close root filesystem archive: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write root filesystem archive: %w", err)
+	}
+
+	if err := rootFSArchiveFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close root filesystem archive: %w", err)
+	}
+
+	return rootFSArchiveFile.Name(), nil
+}
+
+// overwrites returns true if the entry replaces the existing entry for the
+// same path.
+func overwrites(existing, entry entryRef) bool {
+	switch existing.typeflag {
+	case tar.TypeDir:
+		// Directories are never replaced.
+		return false
+	case tar.TypeSymlink:
+		// Symlinks (to directories) are kept when a directory is unpacked.
+		return entry.typeflag != tar.TypeDir
+	default:
+		return true
+	}
+}
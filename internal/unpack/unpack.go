@@ -22,14 +22,18 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/tarfs"
@@ -41,18 +45,46 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string, []string, error) {
+// Options configures how packages are unpacked.
+type Options struct {
+	// Verify checks the files in each data archive against the md5sums of the
+	// package, and their total size against its Installed-Size.
+	Verify bool
+	// PathExclude is a list of glob patterns of files that will not be
+	// unpacked (see the dpkg --path-exclude option).
+	PathExclude []string
+	// PathInclude is a list of glob patterns of files that will be unpacked,
+	// even if they match a PathExclude pattern.
+	PathInclude []string
+	// Update writes the dpkg status of the packages as an update to an
+	// existing dpkg database (instead of replacing the status file), so that
+	// the packages can be installed on top of an existing system.
+	Update bool
+	// Installed are the packages that are already installed on the system
+	// (see ReadInstalled). Files shipped by both an installed package and a
+	// package being unpacked are conflicts, unless one of them replaces the
+	// other.
+	Installed []InstalledPackage
+}
+
+func Unpack(ctx context.Context, tempDir string, packagePaths []string, opts Options) (string, []string, error) {
 	var progressOutput io.Writer = os.Stdout
 	if slog.Default().Enabled(ctx, slog.LevelDebug) {
 		progressOutput = io.Discard
 	}
 
+	filter, err := newPathFilter(opts.PathExclude, opts.PathInclude)
+	if err != nil {
+		return "", nil, err
+	}
+
 	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
 	defer progress.Shutdown()
 
 	// Decompress the packages in parallel.
 	controlArchivePaths := make([]string, len(packagePaths))
 	dataArchivePaths := make([]string, len(packagePaths))
+	verifyErr := &VerifyError{Mismatches: make(map[string][]string)}
 	{
 		bar := progress.AddBar(int64(len(packagePaths)),
 			mpb.PrependDecorators(
@@ -67,6 +99,8 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 		var g errgroup.Group
 		g.SetLimit(runtime.NumCPU())
 
+		var verifyMu sync.Mutex
+
 		for i, packagePath := range packagePaths {
 			i := i
 			packagePath := packagePath
@@ -82,6 +116,27 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 				controlArchivePaths[i] = controlArchivePath
 				dataArchivePaths[i] = dataArchivePath
 
+				if opts.Verify {
+					name, mismatches, err := verifyPackage(controlArchivePath, dataArchivePath)
+					if err != nil {
+						return fmt.Errorf("failed to verify package %s: %w", filepath.Base(packagePath), err)
+					}
+
+					if len(mismatches) > 0 {
+						verifyMu.Lock()
+						verifyErr.Mismatches[name] = mismatches
+						verifyMu.Unlock()
+					}
+				}
+
+				// Filtered files are dropped before conflicts are checked, and
+				// are not included in the file lists (as with dpkg).
+				if !filter.empty() {
+					if err := filter.filterDataArchive(dataArchivePath); err != nil {
+						return fmt.Errorf("failed to filter package %s: %w", filepath.Base(packagePath), err)
+					}
+				}
+
 				return nil
 			})
 		}
@@ -98,6 +153,16 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 		if err != nil {
 			return "", nil, fmt.Errorf("failed to decompress packages: %w", err)
 		}
+
+		if len(verifyErr.Mismatches) > 0 {
+			return "", nil, verifyErr
+		}
+	}
+
+	// Files can only be owned by a single package.
+	updatedLists, err := resolveConflicts(controlArchivePaths, dataArchivePaths, opts.Installed)
+	if err != nil {
+		return "", nil, err
 	}
 
 	dpkgConfArchiveFile, err := os.Create(filepath.Join(tempDir, "dpkg-conf.tar"))
@@ -109,6 +174,26 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 	tw := tar.NewWriter(dpkgConfArchiveFile)
 	defer tw.Close()
 
+	// Record the path filters, so that dpkg applies them to packages
+	// installed later.
+	if !filter.empty() {
+		conf := dpkgConfig(opts.PathExclude, opts.PathInclude)
+
+		hdr := &tar.Header{
+			Name: dpkgConfigPath,
+			Mode: 0o644,
+			Size: int64(len(conf)),
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", nil, fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if _, err := io.WriteString(tw, conf); err != nil {
+			return "", nil, fmt.Errorf("failed to write dpkg configuration to tar archive: %w", err)
+		}
+	}
+
 	var packages []types.Package
 	{
 		bar := progress.AddBar(int64(len(packagePaths)),
@@ -143,6 +228,17 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 			}
 
 			pkg.Status = []string{"install", "ok", "unpacked"}
+
+			// Record the hashes of the conffiles, so that dpkg can detect local
+			// modifications when the package is upgraded.
+			pkg.Conffiles, err = conffileHashes(controlArchivePaths[i], dataArchivePaths[i])
+			if err != nil {
+				bar.Abort(true)
+				bar.Wait()
+
+				return "", nil, fmt.Errorf("failed to hash conffiles of %s: %w", pkg.Name, err)
+			}
+
 			packages = append(packages, *pkg)
 
 			// Get the list of files in the data archive.
@@ -184,14 +280,46 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 		}
 	}
 
+	// Installed packages no longer own the files that have been replaced.
+	listNames := make([]string, 0, len(updatedLists))
+	for listName := range updatedLists {
+		listNames = append(listNames, listName)
+	}
+	slices.Sort(listNames)
+
+	for _, listName := range listNames {
+		list := fileList(updatedLists[listName])
+
+		hdr := &tar.Header{
+			Name: path.Join(dpkgInfoPath, listName),
+			Mode: 0o644,
+			Size: int64(len(list)),
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", nil, fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if _, err := tw.Write(list); err != nil {
+			return "", nil, fmt.Errorf("failed to write files list to tar archive: %w", err)
+		}
+	}
+
 	// Write the dpkg status file.
 	var buf bytes.Buffer
 	if err := deb822.Marshal(&buf, packages); err != nil {
 		return "", nil, fmt.Errorf("failed to marshal packages: %w", err)
 	}
 
+	statusPath := dpkgStatusPath
+	if opts.Update {
+		// dpkg applies the pending updates from its journal the next time the
+		// database is opened (eg. when the packages are configured).
+		statusPath = path.Join(dpkgUpdatesPath, "0000")
+	}
+
 	hdr := &tar.Header{
-		Name: "var/lib/dpkg/status",
+		Name: statusPath,
 		Size: int64(buf.Len()),
 		Mode: 0o644,
 	}
@@ -207,6 +335,75 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 	return dpkgConfArchiveFile.Name(), dataArchivePaths, nil
 }
 
+// ReadControl reads the control metadata of a Debian package file.
+func ReadControl(packagePath string) (*types.Package, error) {
+	pf, err := os.Open(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package file: %w", err)
+	}
+	defer pf.Close()
+
+	debFS, err := arfs.Open(pf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse debian package: %w", err)
+	}
+
+	entries, err := debFS.ReadDir(".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read debian package: %w", err)
+	}
+
+	var controlArchivePath string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "control.tar") {
+			controlArchivePath = entry.Name()
+		}
+	}
+	if controlArchivePath == "" {
+		return nil, fmt.Errorf("failed to find control archive in debian package")
+	}
+
+	controlArchive, err := debFS.Open(controlArchivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control archive: %w", err)
+	}
+
+	dr, err := compressmagic.NewReader(controlArchive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress control archive: %w", err)
+	}
+	defer dr.Close()
+
+	// The control archive is small, so it's fine to read it into memory.
+	controlArchiveBytes, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control archive: %w", err)
+	}
+
+	controlFS, err := tarfs.Open(bytes.NewReader(controlArchiveBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control archive: %w", err)
+	}
+
+	controlFile, err := controlFS.Open("control")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control file: %w", err)
+	}
+	defer controlFile.Close()
+
+	decoder, err := deb822.NewDecoder(controlFile, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control file decoder: %w", err)
+	}
+
+	var pkg types.Package
+	if err := decoder.Decode(&pkg); err != nil {
+		return nil, fmt.Errorf("failed to decode control file: %w", err)
+	}
+
+	return &pkg, nil
+}
+
 func decompressPackage(tempDir string, packagePath string) (string, string, error) {
 	pf, err := os.Open(packagePath)
 	if err != nil {
@@ -378,28 +575,29 @@ func extractControlArchive(tw *tar.Writer, controlArchiveFile *os.File) (*types.
 	return &pkg, nil
 }
 
+// getDataArchiveFileList returns the list of files in a data archive, in the
+// same format as dpkg's info/<package>.list files (absolute paths, in archive
+// order, starting with "/.").
 func getDataArchiveFileList(dataArchiveFile *os.File) ([]string, error) {
-	// Open the data archive as a tar archive.
-	dataArchive, err := tarfs.Open(dataArchiveFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open data archive: %w", err)
-	}
+	filesList := []string{"/."}
 
-	var filesList []string
-	err = fs.WalkDir(dataArchive, ".", func(path string, d fs.DirEntry, err error) error {
+	tr := tar.NewReader(dataArchiveFile)
+	for {
+		hdr, err := tr.Next()
 		if err != nil {
-			return err
-		}
-		if path == "." {
-			return nil
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read data archive: %w", err)
 		}
 
-		filesList = append(filesList, path)
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
 
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to walk data archive: %w", err)
+		filesList = append(filesList, name)
 	}
 
 	return filesList, nil
@@ -19,13 +19,25 @@
 package unpack_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
 	"github.com/dpeckett/debco/internal/testutil"
 	"github.com/dpeckett/debco/internal/unpack"
 	"github.com/stretchr/testify/require"
@@ -43,7 +55,7 @@ func TestUnpack(t *testing.T) {
 		filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"),
 	}
 
-	dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{Verify: true})
 	require.NoError(t, err)
 
 	require.Len(t, dataArchivePaths, 2)
@@ -92,4 +104,695 @@ func TestUnpack(t *testing.T) {
 	}
 
 	require.ElementsMatch(t, expectedFilesList, filesList)
+
+	// The file list is identical to the one written by dpkg.
+	expectedList, err := os.ReadFile(filepath.Join(testutil.Root(), "testdata/lists/base-files.list"))
+	require.NoError(t, err)
+
+	list, err := fs.ReadFile(tarFS, "var/lib/dpkg/info/base-files.list")
+	require.NoError(t, err)
+	require.Equal(t, string(expectedList), string(list))
+
+	statusFile, err := tarFS.Open("var/lib/dpkg/status")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, statusFile.Close())
+	})
+
+	decoder, err := deb822.NewDecoder(statusFile, nil)
+	require.NoError(t, err)
+
+	var packageList []types.Package
+	require.NoError(t, decoder.Decode(&packageList))
+	require.Len(t, packageList, 2)
+
+	require.Equal(t, "base-files", packageList[0].Name)
+	require.Len(t, packageList[0].Conffiles, 6)
+	require.Contains(t, packageList[0].Conffiles, "/etc/debian_version 0900545d517886d6e52125fc9ed787a5")
+	require.Contains(t, packageList[0].Conffiles, "/etc/issue 349d61a0e072d678e3e94923f0c3ce0e")
+
+	require.Equal(t, "base-passwd", packageList[1].Name)
+	require.Empty(t, packageList[1].Conffiles)
+}
+
+func TestUnpackVerify(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagesDir := t.TempDir()
+
+	goodPath := filepath.Join(packagesDir, "good_1.0_all.deb")
+	writePackage(t, goodPath, "Package: good\nVersion: 1.0\nArchitecture: all\nInstalled-Size: 1\n",
+		"5d41402abc4b2a76b9719d911017c592  usr/share/good/hello\n",
+		map[string]string{"usr/share/good/hello": "hello"})
+
+	tamperedPath := filepath.Join(packagesDir, "tampered_1.0_all.deb")
+	writePackage(t, tamperedPath, "Package: tampered\nVersion: 1.0\nArchitecture: all\nInstalled-Size: 1\n",
+		"5d41402abc4b2a76b9719d911017c592  usr/share/tampered/hello\n",
+		map[string]string{
+			"usr/share/tampered/hello": "goodbye",
+			"usr/share/tampered/extra": strings.Repeat("x", 4096),
+		})
+
+	t.Run("Valid", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{goodPath}, unpack.Options{Verify: true})
+		require.NoError(t, err)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{goodPath, tamperedPath}, unpack.Options{Verify: true})
+
+		var verifyErr *unpack.VerifyError
+		require.ErrorAs(t, err, &verifyErr)
+
+		require.Equal(t, map[string][]string{
+			"tampered": {
+				"/usr/share/tampered/hello: md5sum mismatch",
+				"/usr/share/tampered/extra: not listed in md5sums",
+				"contents are 5 KiB, but Installed-Size is 1 KiB",
+			},
+		}, verifyErr.Mismatches)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{tamperedPath}, unpack.Options{})
+		require.NoError(t, err)
+	})
+}
+
+func TestUnpackConflicts(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagesDir := t.TempDir()
+
+	oldPath := filepath.Join(packagesDir, "old_1.0_all.deb")
+	writePackage(t, oldPath, "Package: old\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{"usr/bin/tool": "old", "usr/share/old/README": "old"})
+
+	newPath := filepath.Join(packagesDir, "new_1.0_all.deb")
+	writePackage(t, newPath, "Package: new\nVersion: 1.0\nArchitecture: all\nReplaces: old (<< 2.0)\n", "",
+		map[string]string{"usr/bin/tool": "new"})
+
+	otherPath := filepath.Join(packagesDir, "other_1.0_all.deb")
+	writePackage(t, otherPath, "Package: other\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{"usr/bin/tool": "other"})
+
+	t.Run("Replaces", func(t *testing.T) {
+		dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), []string{newPath, oldPath}, unpack.Options{})
+		require.NoError(t, err)
+
+		// The replaced file is removed from the old package.
+		dataArchiveFile, err := os.Open(dataArchivePaths[1])
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dataArchiveFile.Close())
+		})
+
+		dataFS, err := tarfs.Open(dataArchiveFile)
+		require.NoError(t, err)
+
+		_, err = fs.Stat(dataFS, "usr/bin/tool")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		dpkgConfArchiveFile, err := os.Open(dpkgConfArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgConfArchiveFile.Close())
+		})
+
+		dpkgConfFS, err := tarfs.Open(dpkgConfArchiveFile)
+		require.NoError(t, err)
+
+		oldList, err := fs.ReadFile(dpkgConfFS, "var/lib/dpkg/info/old.list")
+		require.NoError(t, err)
+		require.NotContains(t, string(oldList), "/usr/bin/tool")
+		require.Contains(t, string(oldList), "/usr/share/old/README")
+
+		newList, err := fs.ReadFile(dpkgConfFS, "var/lib/dpkg/info/new.list")
+		require.NoError(t, err)
+		require.Contains(t, string(newList), "/usr/bin/tool")
+	})
+
+	t.Run("Undeclared", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{newPath, oldPath, otherPath}, unpack.Options{})
+
+		var conflictErr *unpack.ConflictError
+		require.ErrorAs(t, err, &conflictErr)
+
+		require.Equal(t, map[string][]string{
+			"/usr/bin/tool": {"new", "old", "other"},
+		}, conflictErr.Conflicts)
+	})
+}
+
+func TestUnpackPathFilter(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagePath := filepath.Join(t.TempDir(), "hello_1.0_all.deb")
+	writePackage(t, packagePath, "Package: hello\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{
+			"usr/bin/hello":                    "hello",
+			"usr/share/doc/hello/README":       "readme",
+			"usr/share/doc/hello/copyright":    "copyright",
+			"usr/share/man/man1/hello.1":       "man",
+			"usr/share/locale/de/hello.mo":     "de",
+			"usr/share/locale/locale.alias":    "alias",
+			"usr/share/hello/[literal]/x.conf": "conf",
+		})
+
+	opts := unpack.Options{
+		PathExclude: []string{"/usr/share/doc/*", "/usr/share/man/*", "/usr/share/locale/*", "/usr/share/hello/\\[literal]/*"},
+		PathInclude: []string{"/usr/share/doc/*/copyright", "/usr/share/locale/locale.alia[s]"},
+	}
+
+	dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), []string{packagePath}, opts)
+	require.NoError(t, err)
+
+	dataArchiveFile, err := os.Open(dataArchivePaths[0])
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dataArchiveFile.Close())
+	})
+
+	dataFS, err := tarfs.Open(dataArchiveFile)
+	require.NoError(t, err)
+
+	var files []string
+	err = fs.WalkDir(dataFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			files = append(files, "/"+path)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{
+		"/usr/bin/hello",
+		"/usr/share/doc/hello/copyright",
+		"/usr/share/locale/locale.alias",
+	}, files)
+
+	dpkgConfArchiveFile, err := os.Open(dpkgConfArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgConfArchiveFile.Close())
+	})
+
+	dpkgConfFS, err := tarfs.Open(dpkgConfArchiveFile)
+	require.NoError(t, err)
+
+	list, err := fs.ReadFile(dpkgConfFS, "var/lib/dpkg/info/hello.list")
+	require.NoError(t, err)
+	require.Contains(t, string(list), "/usr/share/doc/hello/copyright\n")
+	require.NotContains(t, string(list), "/usr/share/doc/hello/README")
+	require.Contains(t, string(list), "/usr/share/doc/hello\n")
+	require.NotContains(t, string(list), "/usr/share/man/man1")
+
+	dpkgConfig, err := fs.ReadFile(dpkgConfFS, "etc/dpkg/dpkg.cfg.d/debco")
+	require.NoError(t, err)
+	require.Contains(t, string(dpkgConfig), "path-exclude=/usr/share/doc/*\npath-exclude=/usr/share/man/*\n")
+	require.Contains(t, string(dpkgConfig), "path-include=/usr/share/doc/*/copyright\n")
+
+	t.Run("Invalid Pattern", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{packagePath}, unpack.Options{
+			PathExclude: []string{"usr/share/doc/*"},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestUnpackUpdate(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	packagePath := filepath.Join(t.TempDir(), "hello_1.0_all.deb")
+	writePackage(t, packagePath, "Package: hello\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{"usr/bin/hello": "hello"})
+
+	dpkgConfArchivePath, _, err := unpack.Unpack(ctx, t.TempDir(), []string{packagePath}, unpack.Options{Update: true})
+	require.NoError(t, err)
+
+	dpkgConfArchiveFile, err := os.Open(dpkgConfArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgConfArchiveFile.Close())
+	})
+
+	dpkgConfFS, err := tarfs.Open(dpkgConfArchiveFile)
+	require.NoError(t, err)
+
+	// The existing status file is left alone.
+	_, err = fs.Stat(dpkgConfFS, "var/lib/dpkg/status")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	update, err := fs.ReadFile(dpkgConfFS, "var/lib/dpkg/updates/0000")
+	require.NoError(t, err)
+	require.Contains(t, string(update), "Package: hello\n")
+	require.Contains(t, string(update), "Status: install ok unpacked\n")
+}
+
+func TestUnpackInstalledConflicts(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	installed, err := unpack.ReadInstalled(fstest.MapFS{
+		"var/lib/dpkg/status": &fstest.MapFile{Data: []byte("Package: old\nStatus: install ok installed\nVersion: 1.0\nArchitecture: all\n\n" +
+			"Package: base\nStatus: install ok installed\nVersion: 1.0\nArchitecture: all\nReplaces: extra\n")},
+		"var/lib/dpkg/info/old.list":  &fstest.MapFile{Data: []byte("/.\n/usr\n/usr/bin\n/usr/bin/tool\n/usr/bin/old\n")},
+		"var/lib/dpkg/info/base.list": &fstest.MapFile{Data: []byte("/.\n/usr\n/usr/bin\n/usr/bin/base\n")},
+	})
+	require.NoError(t, err)
+
+	packagesDir := t.TempDir()
+
+	newPath := filepath.Join(packagesDir, "new_1.0_all.deb")
+	writePackage(t, newPath, "Package: new\nVersion: 1.0\nArchitecture: all\nReplaces: old (<< 2.0)\n", "",
+		map[string]string{"usr/bin/tool": "new"})
+
+	otherPath := filepath.Join(packagesDir, "other_1.0_all.deb")
+	writePackage(t, otherPath, "Package: other\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{"usr/bin/tool": "other"})
+
+	extraPath := filepath.Join(packagesDir, "extra_1.0_all.deb")
+	writePackage(t, extraPath, "Package: extra\nVersion: 1.0\nArchitecture: all\n", "",
+		map[string]string{"usr/bin/base": "extra", "usr/bin/extra": "extra"})
+
+	t.Run("Replaces Installed", func(t *testing.T) {
+		dpkgConfArchivePath, _, err := unpack.Unpack(ctx, t.TempDir(), []string{newPath},
+			unpack.Options{Update: true, Installed: installed})
+		require.NoError(t, err)
+
+		dpkgConfArchiveFile, err := os.Open(dpkgConfArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgConfArchiveFile.Close())
+		})
+
+		dpkgConfFS, err := tarfs.Open(dpkgConfArchiveFile)
+		require.NoError(t, err)
+
+		// The installed package no longer owns the replaced file.
+		list, err := fs.ReadFile(dpkgConfFS, "var/lib/dpkg/info/old.list")
+		require.NoError(t, err)
+		require.Equal(t, "/.\n/usr\n/usr/bin\n/usr/bin/old\n", string(list))
+
+		// Files can only be read once from a tarfs.
+		dpkgConfFS, err = tarfs.Open(dpkgConfArchiveFile)
+		require.NoError(t, err)
+
+		updated, err := unpack.UpdateInstalled(installed, dpkgConfFS)
+		require.NoError(t, err)
+
+		files := make(map[string][]string)
+		for _, pkg := range updated {
+			files[pkg.Name] = pkg.Files
+		}
+
+		require.Equal(t, map[string][]string{
+			"old":  {"/usr", "/usr/bin", "/usr/bin/old"},
+			"base": {"/usr", "/usr/bin", "/usr/bin/base"},
+			"new":  {"/usr", "/usr/bin", "/usr/bin/tool"},
+		}, files)
+	})
+
+	t.Run("Replaced By Installed", func(t *testing.T) {
+		_, dataArchivePaths, err := unpack.Unpack(ctx, t.TempDir(), []string{extraPath},
+			unpack.Options{Update: true, Installed: installed})
+		require.NoError(t, err)
+
+		dataArchiveFile, err := os.Open(dataArchivePaths[0])
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dataArchiveFile.Close())
+		})
+
+		dataFS, err := tarfs.Open(dataArchiveFile)
+		require.NoError(t, err)
+
+		// The installed file is kept.
+		_, err = fs.Stat(dataFS, "usr/bin/base")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fs.Stat(dataFS, "usr/bin/extra")
+		require.NoError(t, err)
+	})
+
+	t.Run("Undeclared", func(t *testing.T) {
+		_, _, err := unpack.Unpack(ctx, t.TempDir(), []string{otherPath},
+			unpack.Options{Update: true, Installed: installed})
+
+		var conflictErr *unpack.ConflictError
+		require.ErrorAs(t, err, &conflictErr)
+
+		require.Equal(t, map[string][]string{
+			"/usr/bin/tool": {"other", "old (installed)"},
+		}, conflictErr.Conflicts)
+	})
+}
+
+func TestReadInstalled(t *testing.T) {
+	fsys := fstest.MapFS{
+		"var/lib/dpkg/status": &fstest.MapFile{Data: []byte(
+			"Package: hello\nStatus: install ok installed\nVersion: 1.0\nArchitecture: all\n\n" +
+				"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\nArchitecture: all\n\n" +
+				"Package: libfoo\nStatus: install ok installed\nVersion: 1.0\nArchitecture: amd64\nMulti-Arch: same\n")},
+		// A pending update that has not been applied yet.
+		"var/lib/dpkg/updates/0000": &fstest.MapFile{Data: []byte(
+			"Package: hello\nStatus: install ok unpacked\nVersion: 2.0\nArchitecture: all\n")},
+		"var/lib/dpkg/updates/tmp.i":          &fstest.MapFile{Data: []byte("Package: ignored\n")},
+		"var/lib/dpkg/info/hello.list":        &fstest.MapFile{Data: []byte("/.\n/usr\n/usr/bin\n/usr/bin/hello\n")},
+		"var/lib/dpkg/info/removed.list":      &fstest.MapFile{Data: []byte("/.\n/etc\n/etc/removed.conf\n")},
+		"var/lib/dpkg/info/libfoo:amd64.list": &fstest.MapFile{Data: []byte("/.\n/usr\n/usr/lib\n/usr/lib/libfoo.so.1\n")},
+	}
+
+	installed, err := unpack.ReadInstalled(fsys)
+	require.NoError(t, err)
+
+	type result struct {
+		Name    string
+		Version string
+		Files   []string
+	}
+
+	var results []result
+	for _, pkg := range installed {
+		results = append(results, result{Name: pkg.Name, Version: pkg.Version.String(), Files: pkg.Files})
+	}
+
+	require.Equal(t, []result{
+		{Name: "hello", Version: "2.0", Files: []string{"/usr", "/usr/bin", "/usr/bin/hello"}},
+		{Name: "libfoo", Version: "1.0", Files: []string{"/usr", "/usr/lib", "/usr/lib/libfoo.so.1"}},
+	}, results)
+
+	t.Run("Empty", func(t *testing.T) {
+		installed, err := unpack.ReadInstalled(fstest.MapFS{})
+		require.NoError(t, err)
+		require.Empty(t, installed)
+	})
+}
+
+func TestMerge(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	tempDir := t.TempDir()
+
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+		content  string
+	}
+
+	writeArchive := func(name string, entries []entry) string {
+		archivePath := filepath.Join(tempDir, name)
+
+		f, err := os.Create(archivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = f.Close()
+		})
+
+		tw := tar.NewWriter(f)
+		for _, e := range entries {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Typeflag: e.typeflag,
+				Name:     e.name,
+				Mode:     e.mode,
+				Linkname: e.linkname,
+				Size:     int64(len(e.content)),
+			}))
+
+			_, err := tw.Write([]byte(e.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		return archivePath
+	}
+
+	archivePaths := []string{
+		writeArchive("first.tar", []entry{
+			{name: "./", typeflag: tar.TypeDir, mode: 0o755},
+			{name: "./lib", typeflag: tar.TypeSymlink, mode: 0o777, linkname: "usr/lib"},
+			{name: "./usr/", typeflag: tar.TypeDir, mode: 0o755},
+			{name: "./usr/lib/", typeflag: tar.TypeDir, mode: 0o755},
+			{name: "./usr/bin/", typeflag: tar.TypeDir, mode: 0o755},
+			{name: "./usr/bin/tool", typeflag: tar.TypeReg, mode: 0o755, content: "first"},
+		}),
+		writeArchive("second.tar", []entry{
+			{name: "./", typeflag: tar.TypeDir, mode: 0o700},
+			{name: "./lib/", typeflag: tar.TypeDir, mode: 0o755},
+			{name: "./lib/libfoo.so", typeflag: tar.TypeReg, mode: 0o644, content: "foo"},
+			{name: "./usr/", typeflag: tar.TypeDir, mode: 0o700},
+			{name: "./usr/bin/tool", typeflag: tar.TypeReg, mode: 0o755, content: "second"},
+			{name: "./usr/bin/other", typeflag: tar.TypeReg, mode: 0o755, content: "other"},
+		}),
+	}
+
+	rootFSArchivePath, err := unpack.Merge(ctx, tempDir, archivePaths)
+	require.NoError(t, err)
+
+	// The merged archives are removed.
+	for _, archivePath := range archivePaths {
+		require.NoFileExists(t, archivePath)
+	}
+
+	rootFSArchiveFile, err := os.Open(rootFSArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rootFSArchiveFile.Close())
+	})
+
+	var entries []entry
+	tr := tar.NewReader(rootFSArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		entries = append(entries, entry{
+			name:     hdr.Name,
+			typeflag: hdr.Typeflag,
+			mode:     hdr.Mode,
+			linkname: hdr.Linkname,
+			content:  string(content),
+		})
+	}
+
+	require.Equal(t, []entry{
+		{name: "./", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "./lib", typeflag: tar.TypeSymlink, mode: 0o777, linkname: "usr/lib"},
+		{name: "./usr/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "./usr/lib/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "./usr/bin/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "./lib/libfoo.so", typeflag: tar.TypeReg, mode: 0o644, content: "foo"},
+		{name: "./usr/bin/tool", typeflag: tar.TypeReg, mode: 0o755, content: "second"},
+		{name: "./usr/bin/other", typeflag: tar.TypeReg, mode: 0o755, content: "other"},
+	}, entries)
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	// Discard the logs (and progress bars, which are hidden at debug level).
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	b.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+	})
+
+	ctx := context.Background()
+
+	// Lots of small packages that share the same directories.
+	packagesDir := b.TempDir()
+
+	var packagePaths []string
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("pkg%d", i)
+
+		files := make(map[string]string)
+		for j := 0; j < 20; j++ {
+			files[fmt.Sprintf("usr/lib/%s/file%d", name, j)] = strings.Repeat("x", 4096)
+		}
+		files["usr/share/doc/"+name+"/copyright"] = "copyright"
+
+		packagePath := filepath.Join(packagesDir, name+"_1.0_all.deb")
+		writePackage(b, packagePath, "Package: "+name+"\nVersion: 1.0\nArchitecture: all\n", "", files)
+
+		packagePaths = append(packagePaths, packagePath)
+	}
+
+	// The number of archives (and entries) that BuildKit needs to copy into
+	// the image.
+	reportArchives := func(b *testing.B, archivePaths []string) {
+		var entries int
+		for _, archivePath := range archivePaths {
+			f, err := os.Open(archivePath)
+			require.NoError(b, err)
+
+			tr := tar.NewReader(f)
+			for {
+				_, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				require.NoError(b, err)
+
+				entries++
+			}
+
+			require.NoError(b, f.Close())
+		}
+
+		b.ReportMetric(float64(len(archivePaths)), "archives/op")
+		b.ReportMetric(float64(entries), "entries/op")
+	}
+
+	b.Run("Per Package", func(b *testing.B) {
+		var archivePaths []string
+		for i := 0; i < b.N; i++ {
+			dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, b.TempDir(), packagePaths, unpack.Options{})
+			require.NoError(b, err)
+
+			archivePaths = append([]string{dpkgConfArchivePath}, dataArchivePaths...)
+		}
+
+		b.StopTimer()
+		reportArchives(b, archivePaths)
+	})
+
+	b.Run("Merged", func(b *testing.B) {
+		var archivePaths []string
+		for i := 0; i < b.N; i++ {
+			tempDir := b.TempDir()
+
+			dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{})
+			require.NoError(b, err)
+
+			rootFSArchivePath, err := unpack.Merge(ctx, tempDir, append([]string{dpkgConfArchivePath}, dataArchivePaths...))
+			require.NoError(b, err)
+
+			archivePaths = []string{rootFSArchivePath}
+		}
+
+		b.StopTimer()
+		reportArchives(b, archivePaths)
+	})
+}
+
+func TestReadControl(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	pkg, err := unpack.ReadControl(filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"))
+	require.NoError(t, err)
+
+	require.Equal(t, "base-passwd", pkg.Name)
+	require.Equal(t, "3.6.1", pkg.Version.String())
+	require.Equal(t, "amd64", pkg.Architecture.String())
+}
+
+// writePackage writes a minimal Debian package (with uncompressed archives),
+// without checking that the metadata matches the files.
+func writePackage(t testing.TB, packagePath, control, md5sums string, files map[string]string) {
+	controlFiles := map[string]string{"control": control}
+	if md5sums != "" {
+		controlFiles["md5sums"] = md5sums
+	}
+
+	controlArchive := writeTar(t, controlFiles)
+
+	dataArchive := writeTar(t, files)
+
+	f, err := os.Create(packagePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	_, err = f.WriteString("!<arch>\n")
+	require.NoError(t, err)
+
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar", controlArchive},
+		{"data.tar", dataArchive},
+	} {
+		_, err := fmt.Fprintf(f, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", entry.name, 0, 0, 0, 0o644, len(entry.data))
+		require.NoError(t, err)
+
+		_, err = f.Write(entry.data)
+		require.NoError(t, err)
+
+		if len(entry.data)%2 != 0 {
+			_, err = f.Write([]byte("\n"))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, f.Close())
+}
+
+func writeTar(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	names := make([]string, 0, len(files))
+	dirs := map[string]bool{".": true}
+	for name := range files {
+		names = append(names, name)
+
+		for dir := path.Dir(name); !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			names = append(names, dir+"/")
+		}
+	}
+	names = append(names, "./")
+	slices.Sort(names)
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     "./" + strings.TrimPrefix(name, "./"),
+				Mode:     0o755,
+			}))
+
+			continue
+		}
+
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "./" + name,
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+		}))
+
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
 }
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// VerifyError reports the packages whose data archive doesn't match the
+// package metadata.
+type VerifyError struct {
+	// Mismatches are the problems found in each package, keyed by package name.
+	Mismatches map[string][]string
+}
+
+func (e *VerifyError) Error() string {
+	var names []string
+	for name := range e.Mismatches {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var packageErrs []string
+	for _, name := range names {
+		packageErrs = append(packageErrs, fmt.Sprintf("%s (%s)", name, strings.Join(e.Mismatches[name], ", ")))
+	}
+
+	return "package contents don't match their metadata: " + strings.Join(packageErrs, ", ")
+}
+
+// verifyPackage checks the files in the data archive against the md5sums
+// control file, and their total size against the Installed-Size of the
+// package. It returns the name of the package and any mismatches.
+func verifyPackage(controlArchivePath, dataArchivePath string) (string, []string, error) {
+	pkg, md5sums, conffiles, err := readControlArchive(controlArchivePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hashes, totalSize, err := hashDataArchive(dataArchivePath, func(string) bool { return true })
+	if err != nil {
+		return "", nil, err
+	}
+
+	var mismatches []string
+
+	// Not every package ships a md5sums file.
+	if md5sums != nil {
+		for _, name := range sortedKeys(md5sums) {
+			actual, ok := hashes[name]
+			if !ok {
+				mismatches = append(mismatches, "/"+name+": missing from data archive")
+			} else if actual != md5sums[name] {
+				mismatches = append(mismatches, "/"+name+": md5sum mismatch")
+			}
+		}
+
+		// Conffiles are not listed in md5sums.
+		for _, name := range sortedKeys(hashes) {
+			if _, ok := md5sums[name]; !ok && !slices.Contains(conffiles, "/"+name) {
+				mismatches = append(mismatches, "/"+name+": not listed in md5sums")
+			}
+		}
+	}
+
+	// Installed-Size is rounded up (and may include more than the files in the
+	// data archive), so it's only an upper bound.
+	installedSize := (totalSize + 1023) / 1024
+	if pkg.InstalledSize > 0 && installedSize > int64(pkg.InstalledSize) {
+		mismatches = append(mismatches, fmt.Sprintf("contents are %d KiB, but Installed-Size is %d KiB",
+			installedSize, pkg.InstalledSize))
+	}
+
+	return pkg.Name, mismatches, nil
+}
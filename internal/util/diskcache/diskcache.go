@@ -19,40 +19,59 @@
 package diskcache
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
-
-	"github.com/rogpeppe/go-internal/cache"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// trimAge is how long an unused cache entry is kept for.
+const trimAge = 5 * 24 * time.Hour
+
+// bodyHeader is the stored header that names the body file of an entry.
+const bodyHeader = "X-Debco-Cache-Body"
+
 // DiskCache is a cache that stores http responses on disk.
+//
+// Each entry is stored as two files, the response header and the response
+// body. Bodies are streamed to and from disk, so they are never buffered in
+// memory. Every stored body gets a unique name that is recorded in the
+// header, and the header is written last, so a header is never paired with
+// the body of another response.
 type DiskCache struct {
-	*cache.Cache
-	namespace string
+	dir string
 }
 
 // NewDiskCache creates a new cache that stores responses in the given directory.
 // The namespace is used to separate different caches in the same directory.
 func NewDiskCache(dir, namespace string) (*DiskCache, error) {
-	c, err := cache.Open(dir)
-	if err != nil {
-		return nil, fmt.Errorf("error opening cache: %w", err)
+	dir = filepath.Join(dir, namespace)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
 	}
 
-	c.Trim()
+	c := &DiskCache{dir: dir}
+	c.trim()
 
-	return &DiskCache{
-		Cache:     c,
-		namespace: namespace,
-	}, nil
+	return c, nil
 }
 
-func (c *DiskCache) Get(key string) ([]byte, bool) {
-	responseBytes, _, err := c.Cache.GetBytes(c.getActionID(key))
+// Get returns the cached response for the key (if present). The caller is
+// responsible for closing the response body.
+func (c *DiskCache) Get(key string, req *http.Request) (*http.Response, bool) {
+	headerPath, bodyPrefix := c.paths(key)
+
+	headerFile, err := os.Open(headerPath)
 	if err != nil {
-		if !(errors.Is(err, os.ErrNotExist) || err.Error() == "cache entry not found") {
+		if !errors.Is(err, os.ErrNotExist) {
 			slog.Warn("Error getting cached response",
 				slog.String("key", key), slog.Any("error", err))
 		} else {
@@ -61,24 +80,255 @@ func (c *DiskCache) Get(key string) ([]byte, bool) {
 
 		return nil, false
 	}
+	defer headerFile.Close()
+
+	resp, err := http.ReadResponse(bufio.NewReader(headerFile), req)
+	if err != nil {
+		slog.Warn("Error reading cached response", slog.String("key", key), slog.Any("error", err))
+		return nil, false
+	}
+
+	// The body is named by the header, entries without a (matching) body
+	// are treated as a miss.
+	bodyName := resp.Header.Get(bodyHeader)
+	resp.Header.Del(bodyHeader)
+	if !strings.HasPrefix(bodyName, bodyPrefix) || !strings.HasSuffix(bodyName, ".body") ||
+		strings.ContainsAny(bodyName, `/\`) {
+		slog.Debug("Cache miss, no body for cached response", slog.String("key", key))
+		return nil, false
+	}
+
+	bodyPath := filepath.Join(c.dir, bodyName)
+
+	bodyFile, err := os.Open(bodyPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error getting cached response body", slog.String("key", key), slog.Any("error", err))
+		} else {
+			slog.Debug("Cache miss, body of cached response is missing", slog.String("key", key))
+		}
+
+		return nil, false
+	}
+
+	fi, err := bodyFile.Stat()
+	if err != nil {
+		_ = bodyFile.Close()
+		slog.Warn("Error getting cached response body", slog.String("key", key), slog.Any("error", err))
+		return nil, false
+	}
 
 	slog.Debug("Cache hit", slog.String("key", key))
 
-	return responseBytes, true
+	// Mark the entry as recently used.
+	now := time.Now()
+	_ = os.Chtimes(headerPath, now, now)
+	_ = os.Chtimes(bodyPath, now, now)
+
+	resp.Body = &cachedBody{File: bodyFile, name: bodyName}
+	resp.ContentLength = fi.Size()
+
+	return resp, true
 }
 
-func (c *DiskCache) Set(key string, responseBytes []byte) {
+// Set stores the response in the cache. The response body is replaced with
+// a reader that writes the body to the cache as it is read. The entry is only
+// stored once the body has been read completely.
+func (c *DiskCache) Set(key string, resp *http.Response) {
 	slog.Debug("Storing cached response", slog.String("key", key))
 
-	if err := c.Cache.PutBytes(c.getActionID(key), responseBytes); err != nil {
+	bodyFile, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
 		slog.Warn("Error setting cached response", slog.Any("error", err))
+		return
+	}
+
+	resp.Body = &cachingReader{
+		ReadCloser: resp.Body,
+		bodyFile:   bodyFile,
+		onEOF: func() error {
+			if err := bodyFile.Close(); err != nil {
+				return err
+			}
+
+			headerPath, bodyPrefix := c.paths(key)
+
+			// The body gets a unique name (so it never replaces the body of
+			// the currently stored header), and the header is replaced last.
+			bodyName := bodyPrefix + strings.TrimPrefix(filepath.Base(bodyFile.Name()), ".tmp-") + ".body"
+			if err := os.Rename(bodyFile.Name(), filepath.Join(c.dir, bodyName)); err != nil {
+				return err
+			}
+
+			if err := c.writeHeader(headerPath, bodyName, resp); err != nil {
+				_ = os.Remove(filepath.Join(c.dir, bodyName))
+				return err
+			}
+
+			c.removeBodies(bodyPrefix, bodyName)
+
+			return nil
+		},
+	}
+}
+
+// UpdateHeader replaces the stored header of the cached response for the key.
+// The response must have been returned by Get (and its body not yet closed).
+func (c *DiskCache) UpdateHeader(key string, resp *http.Response) {
+	headerPath, _ := c.paths(key)
+
+	body, ok := resp.Body.(*cachedBody)
+	if !ok {
+		slog.Warn("Error updating cached response, not a cached response", slog.String("key", key))
+		return
+	}
+
+	if err := c.writeHeader(headerPath, body.name, resp); err != nil {
+		slog.Warn("Error updating cached response", slog.String("key", key), slog.Any("error", err))
 	}
 }
 
-func (c *DiskCache) Delete(key string) {}
+func (c *DiskCache) Delete(key string) {
+	headerPath, bodyPrefix := c.paths(key)
+
+	_ = os.Remove(headerPath)
+	c.removeBodies(bodyPrefix, "")
+}
+
+// removeBodies removes the stored bodies with the prefix, except for the
+// named body.
+func (c *DiskCache) removeBodies(bodyPrefix, keep string) {
+	bodyPaths, err := filepath.Glob(filepath.Join(c.dir, bodyPrefix+"*.body"))
+	if err != nil {
+		return
+	}
+
+	for _, bodyPath := range bodyPaths {
+		if filepath.Base(bodyPath) != keep {
+			_ = os.Remove(bodyPath)
+		}
+	}
+}
+
+func (c *DiskCache) writeHeader(headerPath, bodyName string, resp *http.Response) error {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := bufio.NewWriter(f)
+	if _, err := fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status); err != nil {
+		return err
+	}
+
+	header := resp.Header.Clone()
+	header.Set(bodyHeader, bodyName)
+
+	if err := header.Write(w); err != nil {
+		return err
+	}
+
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Atomically replace any existing header.
+	return os.Rename(f.Name(), headerPath)
+}
+
+// paths returns the path to the header of the entry for the key, and the
+// prefix of the names of its bodies.
+func (c *DiskCache) paths(key string) (string, string) {
+	h := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(h[:])
+
+	return filepath.Join(c.dir, name+".header"), name + "-"
+}
+
+// trim removes cache entries that haven't been used recently. Headers and
+// bodies are both marked as used by Get, so any file that hasn't been modified
+// recently (including left over temporary files) is removed.
+func (c *DiskCache) trim() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		slog.Warn("Error reading cache directory", slog.String("dir", c.dir), slog.Any("error", err))
+		return
+	}
+
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if time.Since(fi.ModTime()) > trimAge {
+			slog.Debug("Removing unused cache file", slog.String("name", e.Name()))
+
+			_ = os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+// cachedBody is the body of a cached response.
+type cachedBody struct {
+	*os.File
+	// name is the name of the body file.
+	name string
+}
+
+// cachingReader writes the body to the cache file as it is read.
+type cachingReader struct {
+	io.ReadCloser
+	bodyFile *os.File
+	onEOF    func() error
+	done     bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.done {
+		if _, werr := r.bodyFile.Write(p[:n]); werr != nil {
+			slog.Warn("Error writing cached response", slog.Any("error", werr))
+			r.abort()
+		}
+	}
+
+	if errors.Is(err, io.EOF) && !r.done {
+		r.done = true
+		if err := r.onEOF(); err != nil {
+			slog.Warn("Error storing cached response", slog.Any("error", err))
+			_ = os.Remove(r.bodyFile.Name())
+		}
+	}
+
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	// If the body was not read completely, don't store a truncated response.
+	r.abort()
+
+	return r.ReadCloser.Close()
+}
+
+func (r *cachingReader) abort() {
+	if r.done {
+		return
+	}
+	r.done = true
 
-func (c *DiskCache) getActionID(key string) cache.ActionID {
-	h := cache.NewHash(c.namespace)
-	_, _ = h.Write([]byte(key))
-	return h.Sum()
+	_ = r.bodyFile.Close()
+	_ = os.Remove(r.bodyFile.Name())
 }
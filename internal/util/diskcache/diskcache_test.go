@@ -19,6 +19,13 @@
 package diskcache_test
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/dpeckett/debco/internal/testutil"
@@ -29,21 +36,242 @@ import (
 func TestDiskCache(t *testing.T) {
 	testutil.SetupGlobals(t)
 
-	cacheDir := t.TempDir()
+	var requests, revalidations atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
 
-	cache, err := diskcache.NewDiskCache(cacheDir, "test")
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/stale":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				revalidations.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		_, _ = w.Write([]byte("data"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cache, err := diskcache.NewDiskCache(t.TempDir(), "test")
 	require.NoError(t, err)
 
-	t.Run("Exist", func(t *testing.T) {
-		cache.Set("exist", []byte("data"))
+	client := &http.Client{Transport: diskcache.NewTransport(cache)}
+
+	get := func(t *testing.T, path string) (string, bool) {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return string(data), resp.Header.Get(diskcache.XFromCache) != ""
+	}
+
+	t.Run("Fresh", func(t *testing.T) {
+		requests.Store(0)
+
+		data, fromCache := get(t, "/fresh")
+		require.Equal(t, "data", data)
+		require.False(t, fromCache)
+
+		data, fromCache = get(t, "/fresh")
+		require.Equal(t, "data", data)
+		require.True(t, fromCache)
+
+		require.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("Revalidate", func(t *testing.T) {
+		requests.Store(0)
+
+		_, fromCache := get(t, "/stale")
+		require.False(t, fromCache)
+
+		data, fromCache := get(t, "/stale")
+		require.Equal(t, "data", data)
+		require.True(t, fromCache)
+
+		require.Equal(t, int32(2), requests.Load())
+		require.Equal(t, int32(1), revalidations.Load())
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		requests.Store(0)
+
+		offlineClient := &http.Client{Transport: &diskcache.Transport{Cache: cache, Offline: true}}
+
+		resp, err := offlineClient.Get(srv.URL + "/stale")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		_, err = offlineClient.Get(srv.URL + "/uncached")
+		var notCached *diskcache.NotCachedError
+		require.ErrorAs(t, err, &notCached)
+		require.Equal(t, srv.URL+"/uncached", notCached.URL)
+
+		require.Zero(t, requests.Load())
+	})
+
+	t.Run("Offline Uncacheable", func(t *testing.T) {
+		offlineClient := &http.Client{Transport: &diskcache.Transport{
+			Cache: cache,
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				t.Fatalf("unexpected request while offline: %s %s", req.Method, req.URL)
+				return nil, nil
+			}),
+			Offline: true,
+		}}
+
+		// The range request can't be answered from the cached response.
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/fresh", nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=1-")
+
+		_, err = offlineClient.Do(req)
+		var notCached *diskcache.NotCachedError
+		require.ErrorAs(t, err, &notCached)
+
+		_, err = offlineClient.Head(srv.URL + "/fresh")
+		require.ErrorAs(t, err, &notCached)
+	})
+
+	t.Run("Partial Read", func(t *testing.T) {
+		requests.Store(0)
+
+		resp, err := client.Get(srv.URL + "/partial")
+		require.NoError(t, err)
+
+		buf := make([]byte, 1)
+		_, err = resp.Body.Read(buf)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		// The truncated response must not have been stored.
+		_, ok := cache.Get(srv.URL+"/partial", nil)
+		require.False(t, ok)
+	})
 
-		data, ok := cache.Get("exist")
+	t.Run("Header Body Mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+
+		cache, err := diskcache.NewDiskCache(dir, "test")
+		require.NoError(t, err)
+
+		store := func(key, body string) {
+			resp := &http.Response{
+				Status:     "200 OK",
+				StatusCode: http.StatusOK,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Etag": []string{`"` + body + `"`}},
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}
+
+			cache.Set(key, resp)
+
+			_, err := io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		}
+
+		get := func(key string) (string, string, bool) {
+			resp, ok := cache.Get(key, nil)
+			if !ok {
+				return "", "", false
+			}
+			defer resp.Body.Close()
+
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			return resp.Header.Get("ETag"), string(data), true
+		}
+
+		store("key", "v1")
+
+		etag, body, ok := get("key")
+		require.True(t, ok)
+		require.Equal(t, `"v1"`, etag)
+		require.Equal(t, "v1", body)
+
+		// A body stored without its header (eg. the process crashed before the
+		// header was written) is never paired with the existing header.
+		headerPaths, err := filepath.Glob(filepath.Join(dir, "test", "*.header"))
+		require.NoError(t, err)
+		require.Len(t, headerPaths, 1)
+
+		bodyPrefix := strings.TrimSuffix(headerPaths[0], ".header") + "-"
+		require.NoError(t, os.WriteFile(bodyPrefix+"crashed.body", []byte("v2"), 0o644))
+
+		etag, body, ok = get("key")
+		require.True(t, ok)
+		require.Equal(t, `"v1"`, etag)
+		require.Equal(t, "v1", body)
+
+		// Replacing the entry removes the old bodies.
+		store("key", "v3")
+
+		etag, body, ok = get("key")
 		require.True(t, ok)
-		require.Equal(t, []byte("data"), data)
+		require.Equal(t, `"v3"`, etag)
+		require.Equal(t, "v3", body)
+
+		bodyPaths, err := filepath.Glob(bodyPrefix + "*.body")
+		require.NoError(t, err)
+		require.Len(t, bodyPaths, 1)
+
+		// Updating the header keeps the body.
+		resp, ok := cache.Get("key", nil)
+		require.True(t, ok)
+		resp.Header.Set("ETag", `"v3-updated"`)
+		cache.UpdateHeader("key", resp)
+		require.NoError(t, resp.Body.Close())
+
+		etag, body, ok = get("key")
+		require.True(t, ok)
+		require.Equal(t, `"v3-updated"`, etag)
+		require.Equal(t, "v3", body)
+
+		// A header whose body is missing is a miss.
+		require.NoError(t, os.Remove(bodyPaths[0]))
+
+		_, _, ok = get("key")
+		require.False(t, ok)
 	})
 
-	t.Run("Non Exist", func(t *testing.T) {
-		_, ok := cache.Get("non-exist")
+	t.Run("Local Files", func(t *testing.T) {
+		localPath := filepath.Join(t.TempDir(), "local")
+		require.NoError(t, os.WriteFile(localPath, []byte("local"), 0o644))
+
+		transport := &http.Transport{}
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+
+		offlineClient := &http.Client{Transport: &diskcache.Transport{Cache: cache, Transport: transport, Offline: true}}
+
+		resp, err := offlineClient.Get("file://" + filepath.ToSlash(localPath))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "local", string(body))
+
+		_, ok := cache.Get("file://"+filepath.ToSlash(localPath), nil)
 		require.False(t, ok)
 	})
 }
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
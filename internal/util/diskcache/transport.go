@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XFromCache is the header added to responses that are served from the cache.
+const XFromCache = "X-From-Cache"
+
+// NotCachedError is returned by an offline transport when a response is not
+// available in the cache.
+type NotCachedError struct {
+	URL string
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("%s is not cached", e.URL)
+}
+
+// Transport is a http.RoundTripper that caches responses on disk. Stale
+// responses are revalidated with the origin server (using the ETag and
+// Last-Modified validators) before they are reused.
+type Transport struct {
+	// Cache is where responses are stored.
+	Cache *DiskCache
+	// Transport is used to make requests (if nil, http.DefaultTransport is used).
+	Transport http.RoundTripper
+	// Offline serves all responses from the cache (without revalidation), and
+	// never makes any requests.
+	Offline bool
+}
+
+// NewTransport returns a new Transport that caches responses in the provided cache.
+func NewTransport(c *DiskCache) *Transport {
+	return &Transport{Cache: c}
+}
+
+// RoundTrip executes a single HTTP transaction, returning a cached response
+// if one is available and still valid.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// Local files (eg. file:// URLs) are never cached, and are always
+	// available offline.
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return transport.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+
+	if t.Offline {
+		// Only whole GET responses are cached.
+		if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+			return nil, &NotCachedError{URL: key}
+		}
+
+		cachedResp, ok := t.Cache.Get(key, req)
+		if !ok {
+			return nil, &NotCachedError{URL: key}
+		}
+
+		cachedResp.Header.Set(XFromCache, "1")
+		return cachedResp, nil
+	}
+
+	// Only whole GET responses are cached.
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		hasDirective(req.Header, "no-store") {
+		return transport.RoundTrip(req)
+	}
+
+	if cachedResp, ok := t.Cache.Get(key, req); ok {
+		if isFresh(cachedResp.Header, req.Header) {
+			cachedResp.Header.Set(XFromCache, "1")
+			return cachedResp, nil
+		}
+
+		etag := cachedResp.Header.Get("ETag")
+		lastModified := cachedResp.Header.Get("Last-Modified")
+
+		// Without validators, the response can't be revalidated.
+		if etag == "" && lastModified == "" {
+			_ = cachedResp.Body.Close()
+			return t.roundTripAndStore(transport, key, req)
+		}
+
+		revalidateReq := req.Clone(req.Context())
+		if etag != "" {
+			revalidateReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			revalidateReq.Header.Set("If-Modified-Since", lastModified)
+		}
+
+		resp, err := transport.RoundTrip(revalidateReq)
+		if err != nil {
+			_ = cachedResp.Body.Close()
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			// Refresh the stored headers (eg. Date, Expires, Cache-Control).
+			for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+				if value := resp.Header.Get(name); value != "" {
+					cachedResp.Header.Set(name, value)
+				}
+			}
+			t.Cache.UpdateHeader(key, cachedResp)
+
+			cachedResp.Header.Set(XFromCache, "1")
+			return cachedResp, nil
+		}
+
+		_ = cachedResp.Body.Close()
+
+		return t.store(key, resp), nil
+	}
+
+	return t.roundTripAndStore(transport, key, req)
+}
+
+func (t *Transport) roundTripAndStore(transport http.RoundTripper, key string, req *http.Request) (*http.Response, error) {
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.store(key, resp), nil
+}
+
+func (t *Transport) store(key string, resp *http.Response) *http.Response {
+	if resp.StatusCode == http.StatusOK && !hasDirective(resp.Header, "no-store") {
+		t.Cache.Set(key, resp)
+	}
+
+	return resp
+}
+
+// isFresh returns true if the cached response can be used without
+// revalidating it with the origin server.
+func isFresh(respHeader, reqHeader http.Header) bool {
+	if hasDirective(reqHeader, "no-cache") || hasDirective(respHeader, "no-cache") {
+		return false
+	}
+
+	date, err := http.ParseTime(respHeader.Get("Date"))
+	if err != nil {
+		return false
+	}
+	age := time.Since(date)
+
+	if maxAge, ok := directiveValue(respHeader, "max-age"); ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return false
+		}
+
+		return age < time.Duration(seconds)*time.Second
+	}
+
+	if expires := respHeader.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return false
+		}
+
+		return time.Now().Before(expiresAt)
+	}
+
+	return false
+}
+
+func hasDirective(header http.Header, name string) bool {
+	_, ok := directiveValue(header, name)
+	return ok
+}
+
+func directiveValue(header http.Header, name string) (string, bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tarutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// EntryRef identifies an entry in one of a list of archives.
+type EntryRef struct {
+	// Archive is the index of the archive in the list.
+	Archive int
+	// Index is the index of the entry in the archive.
+	Index int
+}
+
+// Walk calls fn for each entry in the tar archive.
+func Walk(archivePath string, fn func(index int, hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(bufio.NewReaderSize(f, 1<<16))
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if err := fn(index, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// CleanPath returns the canonical form of an archive entry name: relative to
+// the root (eg. "usr/bin/hello" for "./usr/bin/hello"), and empty for the
+// root itself.
+func CleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Dir returns the parent directory of a clean path (empty for the root).
+func Dir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+
+	return ""
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tarutil_test
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/debco/internal/util/tarutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "test.tar")
+
+	f, err := os.Create(archivePath)
+	require.NoError(t, err)
+
+	tw := tar.NewWriter(f)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./hello", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}))
+	_, err = tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	contents := make(map[string]string)
+	var indexes []int
+	err = tarutil.Walk(archivePath, func(index int, hdr *tar.Header, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		contents[tarutil.CleanPath(hdr.Name)] = string(data)
+		indexes = append(indexes, index)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{"": "", "hello": "hello"}, contents)
+	require.Equal(t, []int{0, 1}, indexes)
+}
+
+func TestCleanPath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"./":                "",
+		"/":                 "",
+		".":                 "",
+		"./usr/bin/":        "usr/bin",
+		"/usr/bin/hello":    "usr/bin/hello",
+		"usr//lib/../bin/x": "usr/bin/x",
+		"../etc/passwd":     "etc/passwd",
+	} {
+		require.Equal(t, expected, tarutil.CleanPath(name), name)
+	}
+}
+
+func TestDir(t *testing.T) {
+	require.Equal(t, "usr/bin", tarutil.Dir("usr/bin/hello"))
+	require.Equal(t, "", tarutil.Dir("usr"))
+	require.Equal(t, "", tarutil.Dir(""))
+}
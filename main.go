@@ -20,6 +20,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -28,18 +29,33 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/containerd/containerd/platforms"
+	"github.com/docker/go-units"
+	"github.com/dpeckett/deb822"
+	debtypes "github.com/dpeckett/deb822/types"
 	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/dpeckett/debco/internal/aptproxy"
+	"github.com/dpeckett/debco/internal/aptrepo"
+	"github.com/dpeckett/debco/internal/baseimage"
 	"github.com/dpeckett/debco/internal/buildkit"
+	"github.com/dpeckett/debco/internal/bundle"
 	"github.com/dpeckett/debco/internal/constants"
 	"github.com/dpeckett/debco/internal/database"
+	"github.com/dpeckett/debco/internal/debstore"
+	"github.com/dpeckett/debco/internal/download"
+	"github.com/dpeckett/debco/internal/keyring"
+	"github.com/dpeckett/debco/internal/layers"
+	"github.com/dpeckett/debco/internal/localpkg"
 	"github.com/dpeckett/debco/internal/recipe"
 	latestrecipe "github.com/dpeckett/debco/internal/recipe/v1alpha1"
 	"github.com/dpeckett/debco/internal/resolve"
@@ -49,8 +65,6 @@ import (
 	"github.com/dpeckett/debco/internal/unpack"
 	"github.com/dpeckett/debco/internal/util"
 	"github.com/dpeckett/debco/internal/util/diskcache"
-	"github.com/dpeckett/debco/internal/util/hashreader"
-	"github.com/gregjones/httpcache"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 	"github.com/vbauerster/mpb/v8"
@@ -58,6 +72,12 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// defaultProxyUpstreams are the repositories that the proxy serves by default.
+var defaultProxyUpstreams = []string{
+	"https://deb.debian.org/debian",
+	"https://deb.debian.org/debian-security",
+}
+
 func main() {
 	defaultCacheDir, _ := xdg.CacheFile("debco")
 	defaultStateDir, _ := xdg.StateFile("debco")
@@ -82,6 +102,92 @@ func main() {
 		},
 	}
 
+	offlineFlag := &cli.BoolFlag{
+		Name:  "offline",
+		Usage: "Only use previously cached data, never access the network",
+	}
+
+	// Flags shared by commands that query the packages available to a recipe.
+	queryFlags := []cli.Flag{
+		offlineFlag,
+		&cli.StringFlag{
+			Name:     "filename",
+			Aliases:  []string{"f"},
+			Usage:    "Recipe file to use",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "platform",
+			Aliases: []string{"p"},
+			Usage:   "Target platform in the 'os/arch' format",
+			Value:   "linux/" + runtime.GOARCH,
+		},
+	}
+
+	signingKeyFlag := &cli.StringFlag{
+		Name:  "signing-key",
+		Usage: "Private OpenPGP key used to sign the repository (defaults to a key in the state directory)",
+	}
+
+	componentFlag := &cli.StringFlag{
+		Name:  "component",
+		Usage: "Repository component",
+		Value: aptrepo.DefaultComponent,
+	}
+
+	proxyFlag := &cli.StringFlag{
+		Name:  "proxy",
+		Usage: "Route all source traffic through a debco proxy (eg. 'http://proxy:3142')",
+	}
+
+	// Flags shared by commands that download packages.
+	downloadFlags := []cli.Flag{
+		&cli.IntFlag{
+			Name:  "download-retries",
+			Usage: "Number of times a failed package download is retried",
+			Value: download.DefaultRetries,
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrent-downloads",
+			Usage: "Maximum number of concurrent package downloads",
+			Value: download.DefaultMaxConcurrency,
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrent-downloads-per-host",
+			Usage: "Maximum number of concurrent package downloads from a single host",
+			Value: download.DefaultMaxConcurrencyPerHost,
+		},
+		&cli.StringFlag{
+			Name:  "bandwidth-limit",
+			Usage: "Maximum total download rate per second (eg. '10MB')",
+		},
+	}
+
+	// Flags shared by commands that build images.
+	buildkitFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:    "buildkit-addr",
+			Usage:   "Address of an existing BuildKit daemon (eg. 'tcp://buildkitd:1234', 'unix:///run/buildkit/buildkitd.sock', 'docker-container://buildkitd' or 'kube-pod://buildkitd-0')",
+			EnvVars: []string{"BUILDKIT_HOST"},
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-tlscacert",
+			Usage: "CA certificate used to verify the BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-tlscert",
+			Usage: "Client certificate used to connect to the BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-tlskey",
+			Usage: "Client key used to connect to the BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-tlsservername",
+			Usage: "Server name used to verify the BuildKit daemon certificate",
+		},
+	}
+
 	initLogger := func(c *cli.Context) error {
 		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			Level: (*slog.Level)(c.Generic("log-level").(*util.LevelFlag)),
@@ -116,6 +222,41 @@ func main() {
 		return nil
 	}
 
+	initHTTPCache := func(c *cli.Context) error {
+		// Cache all HTTP responses on disk.
+		cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+		if err != nil {
+			return fmt.Errorf("failed to create disk cache: %w", err)
+		}
+
+		transport := newTransport()
+		if c.String("proxy") != "" {
+			proxyURL, err := url.Parse(c.String("proxy"))
+			if err != nil {
+				return fmt.Errorf("invalid proxy URL: %w", err)
+			}
+
+			transport = &aptproxy.Transport{
+				Proxy:     proxyURL,
+				Transport: transport,
+			}
+
+			// Packages are also downloaded through the proxy.
+			packageClient.Transport = transport
+		}
+
+		// Use the disk cache for all HTTP requests.
+		http.DefaultClient = &http.Client{
+			Transport: &diskcache.Transport{
+				Cache:     cache,
+				Transport: transport,
+				Offline:   c.Bool("offline"),
+			},
+		}
+
+		return nil
+	}
+
 	app := &cli.App{
 		Name:    "debco",
 		Usage:   "A declarative Debian base system builder",
@@ -124,7 +265,7 @@ func main() {
 			{
 				Name:  "build",
 				Usage: "Build a Debian base system image",
-				Flags: append([]cli.Flag{
+				Flags: slices.Concat([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "filename",
 						Aliases:  []string{"f"},
@@ -153,18 +294,25 @@ func main() {
 						Name:  "dev",
 						Usage: "Enable development mode",
 					},
-				}, persistentFlags...),
-				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir),
+					&cli.BoolFlag{
+						Name:  "verify-contents",
+						Usage: "Verify the contents of packages against their md5sums and Installed-Size",
+					},
+					offlineFlag,
+					proxyFlag,
+				}, downloadFlags, buildkitFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir, initHTTPCache),
 				Action: func(c *cli.Context) error {
-					// Cache all HTTP responses on disk.
-					cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+					// Cache parsed package indexes on disk.
+					packagesCache, err := source.NewPackagesCache(filepath.Join(c.String("cache-dir"), "packages"))
 					if err != nil {
-						return fmt.Errorf("failed to create disk cache: %w", err)
+						return fmt.Errorf("failed to create packages cache: %w", err)
 					}
 
-					// Use the disk cache for all HTTP requests.
-					http.DefaultClient = &http.Client{
-						Transport: httpcache.NewTransport(cache),
+					// Store downloaded packages by their SHA256 sum.
+					debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+					if err != nil {
+						return fmt.Errorf("failed to create package store: %w", err)
 					}
 
 					// A temporary directory used during image building.
@@ -176,26 +324,27 @@ func main() {
 						_ = os.RemoveAll(tempDir)
 					}()
 
-					// Mutual TLS certificates for the BuildKit daemon.
-					certsDir := filepath.Join(c.String("state-dir"), "certs")
-					if err := os.MkdirAll(certsDir, 0o700); err != nil {
-						return fmt.Errorf("failed to create certs directory: %w", err)
+					recipe, err := loadRecipe(c.String("filename"))
+					if err != nil {
+						return err
 					}
 
-					// Load the recipe file.
-					recipeFile, err := os.Open(c.String("filename"))
+					includeNameVersions, localPackages, err := loadRecipePackages(filepath.Join(tempDir, "generated"), recipe)
 					if err != nil {
-						return fmt.Errorf("failed to open recipe file: %w", err)
+						return err
 					}
-					defer recipeFile.Close()
 
-					recipe, err := recipe.FromYAML(recipeFile)
+					downloader, maxConcurrentDownloads, err := newDownloader(c, recipe)
 					if err != nil {
-						return fmt.Errorf("failed to read recipe: %w", err)
+						return err
 					}
 
-					// Start the BuildKit daemon.
-					b := buildkit.New("debco", certsDir)
+					// Start the BuildKit daemon (or connect to an existing one).
+					b, err := newBuildKit(c, recipe)
+					if err != nil {
+						return err
+					}
+					b.Offline = c.Bool("offline")
 					if err := b.StartDaemon(c.Context); err != nil {
 						return fmt.Errorf("failed to start buildkit daemon: %w", err)
 					}
@@ -233,7 +382,7 @@ func main() {
 						slog.Info("Loading packages")
 
 						var packageDB *database.PackageDB
-						packageDB, sourceDateEpoch, err := loadPackageDB(c.Context, recipe, platform)
+						packageDB, sourceDateEpoch, err := loadPackageDB(c.Context, recipe, platform, packagesCache)
 						if err != nil {
 							return err
 						}
@@ -242,58 +391,164 @@ func main() {
 							buildOpts.SourceDateEpoch = sourceDateEpoch
 						}
 
-						var requiredNameVersions []string
+						platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
+						if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
+							return fmt.Errorf("failed to create platform temp directory: %w", err)
+						}
 
-						// By default, install the debco binary (for second-stage provisioning).
-						if !c.Bool("dev") {
-							requiredNameVersions = append(requiredNameVersions, "debco")
+						platformOpts := buildkit.PlatformBuildOptions{
+							Platform:        platform,
+							BuildContextDir: platformTempDir,
 						}
 
-						// By default, install all priority required packages.
-						if !(recipe.Options != nil && recipe.Options.OmitRequired) {
-							_ = packageDB.ForEach(func(pkg types.Package) error {
-								if pkg.Priority == "required" {
-									requiredNameVersions = append(requiredNameVersions, pkg.Package.Name)
+						// The debco package is installed to provision the image (unless
+						// it is built on top of a base image).
+						installDebco := !c.Bool("dev") && recipe.From == ""
+
+						var base *baseimage.Image
+						if recipe.From != "" {
+							slog.Info("Loading base image", slog.String("from", recipe.From))
+
+							base, err = baseimage.Load(c.Context, b, recipe.From, platform, platformTempDir)
+							if err != nil {
+								return err
+							}
+
+							platformOpts.BaseImage = base.Ref
+							platformOpts.BaseArchivePath = base.ArchivePath
+							platformOpts.BaseImageConfig = &base.Config
+
+							// The debco binary is mounted from the debco package, as the
+							// base image doesn't contain it.
+							if !c.Bool("dev") {
+								platformOpts.SecondStageArchivePath, err = baseimage.PrepareSecondStage(c.Context,
+									filepath.Join(platformTempDir, "second-stage"), packageDB,
+									func(ctx context.Context, dir string, selectedDB *database.PackageDB) ([]string, error) {
+										if c.Bool("offline") {
+											if err := checkStoredPackages(selectedDB, debStore); err != nil {
+												return nil, err
+											}
+										}
+
+										return downloadSelectedPackages(ctx, dir, selectedDB, debStore, downloader, maxConcurrentDownloads)
+									})
+								if err != nil {
+									return err
 								}
+							}
 
-								return nil
-							})
+							baseimage.MarkInstalled(packageDB, base.Installed)
 						}
 
 						slog.Info("Resolving selected packages")
 
-						selectedDB, err := resolve.Resolve(packageDB,
-							append(requiredNameVersions, recipe.Packages.Include...),
-							recipe.Packages.Exclude)
+						selectedDB, err := selectPackages(packageDB, recipe, platform,
+							includeNameVersions, localPackages, installDebco)
 						if err != nil {
 							return err
 						}
 
-						platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
-						if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
-							return fmt.Errorf("failed to create platform temp directory: %w", err)
+						// Only the packages that are not already installed in the base
+						// image need to be installed.
+						if base != nil {
+							baseimage.RemoveInstalled(selectedDB, base.Installed)
 						}
 
-						slog.Info("Downloading selected packages")
+						// Make sure every package is available before starting an offline build.
+						if c.Bool("offline") {
+							if err := checkStoredPackages(selectedDB, debStore); err != nil {
+								return err
+							}
+						}
 
-						packagePaths, err := downloadSelectedPackages(c.Context, platformTempDir, selectedDB)
-						if err != nil {
-							return err
+						// The debco package is needed to install the base layer.
+						var basePackages []string
+						if installDebco {
+							basePackages = append(basePackages, "debco")
 						}
 
-						slog.Info("Unpacking packages")
+						var layersConf *latestrecipe.LayersConfig
+						if recipe.Options != nil {
+							layersConf = recipe.Options.Layers
+						}
 
-						dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(c.Context, platformTempDir, packagePaths)
+						layerList, err := layers.FromConfig(layersConf, selectedDB, basePackages)
 						if err != nil {
 							return err
 						}
 
-						buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, buildkit.PlatformBuildOptions{
-							Platform:            platform,
-							BuildContextDir:     platformTempDir,
-							DpkgConfArchivePath: dpkgConfArchivePath,
-							DataArchivePaths:    dataArchivePaths,
-						})
+						// The image is still provisioned when the base image already
+						// contains every package.
+						if len(layerList) == 0 {
+							layerList = []layers.Layer{{Name: layers.StrategySquashed}}
+						}
+
+						unpackOpts := unpack.Options{
+							Verify: c.Bool("verify-contents"),
+						}
+						if recipe.Options != nil {
+							unpackOpts.PathExclude = recipe.Options.PathExclude
+							unpackOpts.PathInclude = recipe.Options.PathInclude
+						}
+						if base != nil {
+							unpackOpts.Installed = base.Installed
+						}
+
+						for i, layer := range layerList {
+							layerTempDir := platformTempDir
+							if len(layerList) > 1 {
+								slog.Info("Preparing layer", slog.String("name", layer.Name),
+									slog.Int("packages", len(layer.Packages)))
+
+								layerTempDir = filepath.Join(platformTempDir, fmt.Sprintf("layer-%d", i))
+								if err := os.MkdirAll(layerTempDir, 0o755); err != nil {
+									return fmt.Errorf("failed to create layer temp directory: %w", err)
+								}
+							}
+
+							layerDB := database.NewPackageDB()
+							layerDB.AddAll(layer.Packages)
+
+							slog.Info("Downloading selected packages")
+
+							packagePaths, err := downloadSelectedPackages(c.Context, layerTempDir, layerDB, debStore, downloader, maxConcurrentDownloads)
+							if err != nil {
+								return err
+							}
+
+							slog.Info("Unpacking packages")
+
+							// Layers are installed on top of the packages in the lower layers
+							// (or the base image).
+							unpackOpts.Update = i > 0 || base != nil
+
+							dpkgConfArchivePath, dataArchivePaths, err := unpack.Unpack(c.Context, layerTempDir, packagePaths, unpackOpts)
+							if err != nil {
+								return err
+							}
+
+							// Files in the upper layers are checked against those installed
+							// by this layer (and the lower layers).
+							unpackOpts.Installed, err = baseimage.AddLayer(unpackOpts.Installed, dpkgConfArchivePath)
+							if err != nil {
+								return err
+							}
+
+							// Merge everything into a single root filesystem archive, so that
+							// it can be copied into the image in one operation.
+							rootFSArchivePath, err := unpack.Merge(c.Context, layerTempDir, append([]string{dpkgConfArchivePath}, dataArchivePaths...))
+							if err != nil {
+								return fmt.Errorf("failed to merge packages: %w", err)
+							}
+
+							if i == 0 && base == nil {
+								platformOpts.RootFSArchivePath = rootFSArchivePath
+							} else {
+								platformOpts.LayerArchivePaths = append(platformOpts.LayerArchivePaths, rootFSArchivePath)
+							}
+						}
+
+						buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, platformOpts)
 					}
 
 					slog.Info("Building multi-platform image", slog.String("output", c.String("output")))
@@ -306,143 +561,1224 @@ func main() {
 				},
 			},
 			{
-				Name:        "second-stage",
-				Description: "Operations that will be run after the image is built",
-				Hidden:      true,
-				Subcommands: []*cli.Command{
-					{
-						// MergeUsr is a separate command as it needs to be run before
-						// packages are configured.
-						Name:        "merge-usr",
-						Description: "Merge the /usr directory into the root filesystem",
-						Flags:       persistentFlags,
-						Before:      util.BeforeAll(initLogger),
-						Action: func(_ *cli.Context) error {
-							return secondstage.MergeUsr()
-						},
+				Name:  "vendor",
+				Usage: "Export a self-contained bundle that can be built without network access",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "filename",
+						Aliases:  []string{"f"},
+						Usage:    "Recipe file to use",
+						Required: true,
 					},
-					{
-						Name:        "provision",
-						Description: "Set up the image with the requested recipe",
-						Flags: append([]cli.Flag{
-							&cli.StringFlag{
-								Name:     "filename",
-								Aliases:  []string{"f"},
-								Usage:    "Recipe file to use",
-								Required: true,
-							},
-						}, persistentFlags...),
-						Before: util.BeforeAll(initLogger),
-						Action: func(c *cli.Context) error {
-							// Load the recipe file.
-							recipeFile, err := os.Open(c.String("filename"))
-							if err != nil {
-								return fmt.Errorf("failed to open recipe file: %w", err)
-							}
-							defer recipeFile.Close()
-
-							recipe, err := recipe.FromYAML(recipeFile)
-							if err != nil {
-								return fmt.Errorf("failed to read recipe: %w", err)
-							}
-
-							return secondstage.Provision(c.Context, recipe)
-						},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output bundle directory",
+						Value:   "bundle",
 					},
-				},
-			},
-		},
-	}
+					&cli.StringFlag{
+						Name:    "platform",
+						Aliases: []string{"p"},
+						Usage:   "Target platform(s) in the 'os/arch' format",
+						Value:   "linux/" + runtime.GOARCH,
+					},
+					&cli.BoolFlag{
+						Name:  "buildkit-image",
+						Usage: "Include the BuildKit image in the bundle",
+					},
+					offlineFlag,
+					proxyFlag,
+				}, downloadFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					packagesCache, err := source.NewPackagesCache(filepath.Join(c.String("cache-dir"), "packages"))
+					if err != nil {
+						return fmt.Errorf("failed to create packages cache: %w", err)
+					}
 
-	if err := app.Run(os.Args); err != nil {
-		slog.Error("Error", slog.Any("error", err))
-		os.Exit(1)
-	}
-}
+					debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+					if err != nil {
+						return fmt.Errorf("failed to create package store: %w", err)
+					}
 
-func loadPackageDB(ctx context.Context, recipe *latestrecipe.Recipe, platform ocispecs.Platform) (*database.PackageDB, time.Time, error) {
-	var componentsMu sync.Mutex
-	var components []source.Component
+					tempDir, err := os.MkdirTemp("", "debco-*")
+					if err != nil {
+						return fmt.Errorf("failed to create temporary directory: %w", err)
+					}
+					defer func() {
+						_ = os.RemoveAll(tempDir)
+					}()
 
-	var progressOutput io.Writer = os.Stdout
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
-		progressOutput = io.Discard
-	}
+					recipe, err := loadRecipe(c.String("filename"))
+					if err != nil {
+						return err
+					}
 
-	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
-	defer progress.Shutdown()
+					if err := bundle.CheckBaseImage(recipe); err != nil {
+						return err
+					}
 
-	{
-		sourceConfs := append([]latestrecipe.SourceConfig{}, recipe.Sources...)
-
-		if !(recipe.Options != nil && recipe.Options.OmitUpstreamAPT) {
-			sourceConfs = append([]latestrecipe.SourceConfig{
-				{
-					URL:      constants.UpstreamAPTURL,
-					SignedBy: constants.UpstreamAPTSignedBy,
-					// Given debco is only linked to libc, this should be "fine".
-					Distribution: "bookworm",
-					Components:   []string{"stable"},
-				},
-			}, sourceConfs...)
-		}
+					includeNameVersions, localPackages, err := loadRecipePackages(filepath.Join(tempDir, "generated"), recipe)
+					if err != nil {
+						return err
+					}
 
-		g, ctx := errgroup.WithContext(ctx)
+					downloader, maxConcurrentDownloads, err := newDownloader(c, recipe)
+					if err != nil {
+						return err
+					}
 
-		bar := progress.AddBar(int64(len(sourceConfs)),
-			mpb.PrependDecorators(
-				decor.Name("Source: "),
-				decor.CountersNoUnit("%d / %d"),
-			),
-			mpb.AppendDecorators(
-				decor.Percentage(),
-			),
-		)
+					bundleDir := c.String("output")
+					repoDir := filepath.Join(bundleDir, bundle.RepoDir)
 
-		for _, sourceConf := range sourceConfs {
-			sourceConf := sourceConf
+					// Start from an empty repository, so that it only contains the packages
+					// selected by the recipe.
+					if err := os.RemoveAll(repoDir); err != nil {
+						return fmt.Errorf("failed to remove existing repository: %w", err)
+					}
 
-			g.Go(func() error {
-				defer bar.Increment()
+					if err := os.MkdirAll(repoDir, 0o755); err != nil {
+						return fmt.Errorf("failed to create repository directory: %w", err)
+					}
 
-				s, err := source.NewSource(ctx, sourceConf)
-				if err != nil {
-					return fmt.Errorf("failed to create source: %w", err)
-				}
+					var platformList []ocispecs.Platform
+					for _, platformStr := range strings.Split(c.String("platform"), ",") {
+						platform, err := platforms.Parse(platformStr)
+						if err != nil {
+							return fmt.Errorf("failed to parse platform: %w", err)
+						}
 
-				targetArch, err := arch.Parse(platform.Architecture)
-				if err != nil {
-					return fmt.Errorf("failed to parse target architecture: %w", err)
-				}
+						if platform.OS != "linux" {
+							return fmt.Errorf("unsupported OS: %s", platform.OS)
+						}
 
-				sourceComponents, err := s.Components(ctx, targetArch)
-				if err != nil {
-					return fmt.Errorf("failed to get components: %w", err)
-				}
+						slog.Info("Vendoring packages", slog.String("platform", platforms.Format(platform)))
 
-				componentsMu.Lock()
-				components = append(components, sourceComponents...)
-				componentsMu.Unlock()
+						packageDB, _, err := loadPackageDB(c.Context, recipe, platform, packagesCache)
+						if err != nil {
+							return err
+						}
 
-				return nil
-			})
-		}
+						selectedDB, err := selectPackages(packageDB, recipe, platform,
+							includeNameVersions, localPackages, true)
+						if err != nil {
+							return err
+						}
 
-		err := g.Wait()
+						platformTempDir := filepath.Join(tempDir, strings.ReplaceAll(platforms.Format(platform), "/", "-"))
+						if err := os.MkdirAll(platformTempDir, 0o755); err != nil {
+							return fmt.Errorf("failed to create platform temp directory: %w", err)
+						}
 
-		if err != nil {
-			bar.Abort(true)
-		} else {
-			bar.SetTotal(bar.Current(), true)
-		}
-		bar.Wait()
+						if c.Bool("offline") {
+							if err := checkStoredPackages(selectedDB, debStore); err != nil {
+								return err
+							}
+						}
 
-		if err != nil {
-			return nil, time.Time{}, fmt.Errorf("failed to get components: %w", err)
-		}
-	}
+						packagePaths, err := downloadSelectedPackages(c.Context, platformTempDir, selectedDB, debStore, downloader, maxConcurrentDownloads)
+						if err != nil {
+							return err
+						}
 
-	packageDB := database.NewPackageDB()
+						for _, packagePath := range packagePaths {
+							if _, err := aptrepo.Add(repoDir, packagePath, aptrepo.Options{}); err != nil {
+								return err
+							}
+						}
+
+						platformList = append(platformList, platform)
+					}
+
+					slog.Info("Publishing repository", slog.String("dir", repoDir))
+
+					// The bundle is signed with a throwaway key, only the public key is kept.
+					signer, err := aptrepo.GenerateKey("debco", "")
+					if err != nil {
+						return err
+					}
+
+					var architectures []string
+					for _, platform := range platformList {
+						architectures = append(architectures, platform.Architecture)
+					}
+
+					if err := aptrepo.Publish(repoDir, signer, aptrepo.Options{
+						Architectures: architectures,
+						Origin:        "debco",
+						Label:         "debco",
+						Description:   "Packages vendored by debco",
+					}); err != nil {
+						return fmt.Errorf("failed to publish repository: %w", err)
+					}
+
+					if recipe.From != "" {
+						slog.Info("Copying base image", slog.String("from", recipe.From))
+
+						if err := bundle.CopyBaseImage(bundleDir, recipe); err != nil {
+							return err
+						}
+					}
+
+					vendoredRecipe, err := bundle.Recipe(recipe, includeNameVersions, localPackages, platformList)
+					if err != nil {
+						return err
+					}
+
+					if err := saveRecipe(filepath.Join(bundleDir, bundle.RecipeFile), vendoredRecipe); err != nil {
+						return err
+					}
+
+					if c.Bool("buildkit-image") {
+						slog.Info("Saving buildkit image")
+
+						imageFile, err := os.Create(filepath.Join(bundleDir, "buildkit-image.tar"))
+						if err != nil {
+							return fmt.Errorf("failed to create buildkit image file: %w", err)
+						}
+						defer imageFile.Close()
+
+						b := buildkit.New("debco", "")
+						b.Offline = c.Bool("offline")
+						if err := b.SaveImage(c.Context, imageFile); err != nil {
+							return err
+						}
+
+						if err := imageFile.Close(); err != nil {
+							return fmt.Errorf("failed to close buildkit image file: %w", err)
+						}
+					}
+
+					slog.Info("Bundle written", slog.String("dir", bundleDir))
+
+					return nil
+				},
+			},
+			{
+				Name:  "proxy",
+				Usage: "Run a caching APT proxy",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to listen on (eg. ':3142' to accept remote connections)",
+						Value: "127.0.0.1:3142",
+					},
+					&cli.StringSliceFlag{
+						Name:  "signed-by",
+						Usage: "Public key URL (https) or file path trusted to sign repositories",
+					},
+					&cli.StringSliceFlag{
+						Name:  "upstream",
+						Usage: "URL of a repository that may be proxied (defaults to the Debian archive and security repositories)",
+					},
+				}, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					// The upstream debco repository is always trusted.
+					trustedKeys, err := keyring.Load(c.Context, constants.UpstreamAPTSignedBy)
+					if err != nil {
+						slog.Warn("Failed to read upstream signing key", slog.Any("error", err))
+					}
+
+					for _, key := range c.StringSlice("signed-by") {
+						keys, err := keyring.Load(c.Context, key)
+						if err != nil {
+							return fmt.Errorf("failed to read key %s: %w", key, err)
+						}
+
+						trustedKeys = append(trustedKeys, keys...)
+					}
+
+					// The upstream debco repository is always allowed.
+					upstreams := c.StringSlice("upstream")
+					if len(upstreams) == 0 {
+						upstreams = defaultProxyUpstreams
+					}
+					upstreams = append([]string{constants.UpstreamAPTURL}, upstreams...)
+
+					var upstreamURLs []*url.URL
+					for _, upstream := range upstreams {
+						upstreamURL, err := url.Parse(upstream)
+						if err != nil || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") || upstreamURL.Host == "" {
+							return fmt.Errorf("invalid upstream URL: %q", upstream)
+						}
+
+						upstreamURLs = append(upstreamURLs, upstreamURL)
+					}
+
+					cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "proxy")
+					if err != nil {
+						return fmt.Errorf("failed to create disk cache: %w", err)
+					}
+
+					// Packages are shared with local builds.
+					debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+					if err != nil {
+						return fmt.Errorf("failed to create package store: %w", err)
+					}
+
+					srv := &http.Server{
+						Addr: c.String("listen"),
+						Handler: aptproxy.NewServer(aptproxy.Options{
+							Cache:     cache,
+							Store:     debStore,
+							Keyring:   trustedKeys,
+							Upstreams: upstreamURLs,
+							Client:    &http.Client{},
+						}),
+						ReadHeaderTimeout: 10 * time.Second,
+					}
+
+					go func() {
+						<-c.Context.Done()
+						_ = srv.Close()
+					}()
+
+					slog.Info("Listening", slog.String("addr", srv.Addr))
+
+					if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						return fmt.Errorf("failed to serve: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "repo",
+				Usage: "Build and sign a local APT repository",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "init",
+						Usage:     "Create a new repository (and signing key)",
+						ArgsUsage: "<dir>",
+						Flags: slices.Concat([]cli.Flag{
+							signingKeyFlag,
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "Name of the signing key owner",
+								Value: "debco",
+							},
+							&cli.StringFlag{
+								Name:  "email",
+								Usage: "Email address of the signing key owner",
+							},
+						}, persistentFlags),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a repository directory")
+							}
+							repoDir := c.Args().First()
+
+							// Reuse the existing signing key (if any).
+							keyPath := signingKeyPath(c)
+							signer, err := aptrepo.LoadPrivateKey(keyPath)
+							if errors.Is(err, os.ErrNotExist) {
+								slog.Info("Generating signing key", slog.String("path", keyPath))
+
+								signer, err = aptrepo.GenerateKey(c.String("name"), c.String("email"))
+								if err != nil {
+									return err
+								}
+
+								if err := aptrepo.SavePrivateKey(keyPath, signer); err != nil {
+									return err
+								}
+							} else if err != nil {
+								return err
+							}
+
+							if err := aptrepo.Init(repoDir, signer); err != nil {
+								return err
+							}
+
+							slog.Info("Initialized repository", slog.String("dir", repoDir))
+
+							return nil
+						},
+					},
+					{
+						Name:      "add",
+						Usage:     "Add packages to a repository",
+						ArgsUsage: "<dir> <package.deb>...",
+						Flags: slices.Concat([]cli.Flag{
+							componentFlag,
+						}, persistentFlags),
+						Before: initLogger,
+						Action: func(c *cli.Context) error {
+							if c.NArg() < 2 {
+								return fmt.Errorf("expected a repository directory and at least one package")
+							}
+							repoDir := c.Args().First()
+
+							if err := aptrepo.Check(repoDir); err != nil {
+								return err
+							}
+
+							for _, packagePath := range c.Args().Tail() {
+								control, err := aptrepo.Add(repoDir, packagePath, aptrepo.Options{
+									Component: c.String("component"),
+								})
+								if err != nil {
+									return err
+								}
+
+								slog.Info("Added package",
+									slog.String("name", control.Name),
+									slog.String("version", control.Version.String()),
+									slog.String("arch", control.Architecture.String()))
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:      "publish",
+						Usage:     "Generate the signed package indexes of a repository",
+						ArgsUsage: "<dir>",
+						Flags: slices.Concat([]cli.Flag{
+							signingKeyFlag,
+							&cli.StringFlag{
+								Name:  "distribution",
+								Usage: "Name of the distribution",
+								Value: aptrepo.DefaultDistribution,
+							},
+							&cli.StringSliceFlag{
+								Name:  "architecture",
+								Usage: "Architecture to publish indexes for (in addition to those of the packages)",
+							},
+							&cli.StringFlag{
+								Name:  "origin",
+								Usage: "Origin of the repository",
+							},
+							&cli.StringFlag{
+								Name:  "label",
+								Usage: "Label of the repository",
+							},
+							&cli.StringFlag{
+								Name:  "description",
+								Usage: "Description of the repository",
+							},
+						}, persistentFlags),
+						Before: util.BeforeAll(initLogger, initStateDir),
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a repository directory")
+							}
+							repoDir := c.Args().First()
+
+							if err := aptrepo.Check(repoDir); err != nil {
+								return err
+							}
+
+							signer, err := aptrepo.LoadPrivateKey(signingKeyPath(c))
+							if err != nil {
+								return err
+							}
+
+							if err := aptrepo.Publish(repoDir, signer, aptrepo.Options{
+								Distribution:  c.String("distribution"),
+								Architectures: c.StringSlice("architecture"),
+								Origin:        c.String("origin"),
+								Label:         c.String("label"),
+								Description:   c.String("description"),
+							}); err != nil {
+								return fmt.Errorf("failed to publish repository: %w", err)
+							}
+
+							slog.Info("Published repository", slog.String("dir", repoDir))
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "rdepends",
+				Usage:     "List the packages that depend on a package",
+				ArgsUsage: "PACKAGE...",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "Search all available packages, not just those selected by the recipe",
+					},
+				}, queryFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("no packages specified")
+					}
+
+					packagesCache, err := source.NewPackagesCache(filepath.Join(c.String("cache-dir"), "packages"))
+					if err != nil {
+						return fmt.Errorf("failed to create packages cache: %w", err)
+					}
+
+					tempDir, err := os.MkdirTemp("", "debco-*")
+					if err != nil {
+						return fmt.Errorf("failed to create temporary directory: %w", err)
+					}
+					defer func() {
+						_ = os.RemoveAll(tempDir)
+					}()
+
+					recipe, err := loadRecipe(c.String("filename"))
+					if err != nil {
+						return err
+					}
+
+					includeNameVersions, localPackages, err := loadRecipePackages(filepath.Join(tempDir, "generated"), recipe)
+					if err != nil {
+						return err
+					}
+
+					platform, err := platforms.Parse(c.String("platform"))
+					if err != nil {
+						return fmt.Errorf("failed to parse platform: %w", err)
+					}
+
+					packageDB, _, err := loadPackageDB(c.Context, recipe, platform, packagesCache)
+					if err != nil {
+						return err
+					}
+
+					queryDB := packageDB
+					if c.Bool("all") {
+						if _, err := localpkg.Add(packageDB, platform, localPackages); err != nil {
+							return err
+						}
+					} else {
+						queryDB, err = selectPackages(packageDB, recipe, platform, includeNameVersions, localPackages, true)
+						if err != nil {
+							return err
+						}
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "PACKAGE\tVERSION\tARCHITECTURE\tRELATION")
+
+					for _, name := range c.Args().Slice() {
+						for _, dependent := range queryDB.Dependents(name) {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dependent.Package.Name,
+								dependent.Package.Version, dependent.Package.Architecture, dependent.Relation)
+						}
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "search",
+				Usage:     "Search the packages available from the recipe's sources",
+				ArgsUsage: "PATTERN",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "names-only",
+						Usage: "Only match the pattern against package names",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the results as JSON",
+					},
+				}, queryFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected a single search pattern")
+					}
+
+					pattern, err := regexp.Compile("(?i)" + c.Args().First())
+					if err != nil {
+						return fmt.Errorf("invalid search pattern: %w", err)
+					}
+
+					packageDB, err := loadSourcesPackageDB(c)
+					if err != nil {
+						return err
+					}
+
+					// Find the latest version of each matching package (an empty
+					// slice, so that no results are encoded as an empty JSON array).
+					results := make([]packageSummary, 0)
+					var latest version.Version
+					_ = packageDB.ForEach(func(pkg types.Package) error {
+						summary := packageSummary{
+							Name:         pkg.Name,
+							Version:      pkg.Version.String(),
+							Architecture: pkg.Architecture.String(),
+							Description:  strings.SplitN(pkg.Description, "\n", 2)[0],
+						}
+
+						if !pattern.MatchString(summary.Name) &&
+							(c.Bool("names-only") || !pattern.MatchString(summary.Description)) {
+							return nil
+						}
+
+						if n := len(results); n > 0 && results[n-1].Name == pkg.Name {
+							if pkg.Version.Compare(latest) >= 0 {
+								results[n-1] = summary
+								latest = pkg.Version
+							}
+							return nil
+						}
+
+						results = append(results, summary)
+						latest = pkg.Version
+						return nil
+					})
+
+					if c.Bool("json") {
+						return writeJSON(os.Stdout, results)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "PACKAGE\tVERSION\tARCHITECTURE\tDESCRIPTION")
+
+					for _, result := range results {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Name,
+							result.Version, result.Architecture, result.Description)
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "Show all available versions of a package",
+				ArgsUsage: "PACKAGE",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the results as JSON",
+					},
+				}, queryFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected a single package name")
+					}
+
+					packageDB, err := loadSourcesPackageDB(c)
+					if err != nil {
+						return err
+					}
+
+					results := make([]packageDetails, 0)
+					for _, pkg := range packageDB.Get(c.Args().First()) {
+						if pkg.IsVirtual {
+							continue
+						}
+
+						results = append(results, packageDetails{
+							Package: pkg.Package,
+							Sources: packageSources(pkg),
+						})
+					}
+
+					if len(results) == 0 {
+						return fmt.Errorf("package %q not found", c.Args().First())
+					}
+
+					// Show the latest version first.
+					slices.Reverse(results)
+
+					if c.Bool("json") {
+						return writeJSON(os.Stdout, results)
+					}
+
+					for i, result := range results {
+						if i > 0 {
+							fmt.Println()
+						}
+
+						if err := deb822.Marshal(os.Stdout, result.Package); err != nil {
+							return fmt.Errorf("failed to marshal package: %w", err)
+						}
+
+						for _, source := range result.Sources {
+							fmt.Printf("APT-Sources: %s\n", source)
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "search-file",
+				Usage:     "Find the packages that provide a file",
+				ArgsUsage: "PATH-OR-GLOB",
+				Flags: slices.Concat([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the results as JSON",
+					},
+				}, queryFlags, persistentFlags),
+				Before: util.BeforeAll(initLogger, initCacheDir, initHTTPCache),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected a single path or glob")
+					}
+
+					match, err := source.NewContentsMatcher(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					recipe, err := loadRecipe(c.String("filename"))
+					if err != nil {
+						return err
+					}
+
+					platform, err := platforms.Parse(c.String("platform"))
+					if err != nil {
+						return fmt.Errorf("failed to parse platform: %w", err)
+					}
+
+					entries, err := searchContents(c.Context, recipe, platform, match)
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("json") {
+						return writeJSON(os.Stdout, entries)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "PATH\tPACKAGES")
+
+					for _, entry := range entries {
+						fmt.Fprintf(w, "%s\t%s\n", entry.Path, strings.Join(entry.Packages, ", "))
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Manage the local cache",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "ls",
+						Usage:  "List the packages in the cache",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+							if err != nil {
+								return fmt.Errorf("failed to open package store: %w", err)
+							}
+
+							entries, err := debStore.List()
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "PACKAGE\tVERSION\tARCHITECTURE\tSHA256\tSIZE\tLAST USED")
+
+							for _, e := range entries {
+								name, pkgVersion, pkgArch := "-", "-", "-"
+								if control, err := unpack.ReadControl(e.Path); err == nil {
+									name, pkgVersion, pkgArch = control.Name, control.Version.String(), control.Architecture.String()
+								}
+
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s ago\n", name, pkgVersion, pkgArch,
+									e.SHA256[:12], units.HumanSize(float64(e.Size)), units.HumanDuration(time.Since(e.LastUsed)))
+							}
+
+							return w.Flush()
+						},
+					},
+					{
+						Name:   "du",
+						Usage:  "Show the disk usage of the cache",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							cacheDir := c.String("cache-dir")
+
+							totalSize, err := dirSize(cacheDir)
+							if err != nil {
+								return err
+							}
+
+							debsSize, err := dirSize(filepath.Join(cacheDir, "debs"))
+							if err != nil {
+								return err
+							}
+
+							packagesSize, err := dirSize(filepath.Join(cacheDir, "packages"))
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "CACHE\tSIZE")
+							fmt.Fprintf(w, "Packages\t%s\n", units.HumanSize(float64(debsSize)))
+							fmt.Fprintf(w, "Package indexes\t%s\n", units.HumanSize(float64(packagesSize)))
+							fmt.Fprintf(w, "HTTP responses\t%s\n", units.HumanSize(float64(totalSize-debsSize-packagesSize)))
+							fmt.Fprintf(w, "Total\t%s\n", units.HumanSize(float64(totalSize)))
+
+							return w.Flush()
+						},
+					},
+					{
+						Name:  "prune",
+						Usage: "Remove unused packages (and incomplete downloads) from the cache",
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "max-age",
+								Usage: "Remove packages that have not been used for longer than this duration (0 to disable)",
+								Value: 30 * 24 * time.Hour,
+							},
+							&cli.StringFlag{
+								Name:  "max-size",
+								Usage: "Remove the least recently used packages until the cache is no larger than this size (eg. '10GB')",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							opts := debstore.PruneOptions{
+								MaxAge: c.Duration("max-age"),
+							}
+
+							if c.String("max-size") != "" {
+								maxSize, err := units.FromHumanSize(c.String("max-size"))
+								if err != nil {
+									return fmt.Errorf("invalid maximum size: %w", err)
+								}
+								opts.MaxSize = maxSize
+							}
+
+							debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+							if err != nil {
+								return fmt.Errorf("failed to open package store: %w", err)
+							}
+
+							removed, err := debStore.Prune(opts)
+							if err != nil {
+								return err
+							}
+
+							var freed int64
+							for _, e := range removed {
+								freed += e.Size
+							}
+
+							fmt.Printf("Removed %d packages, freed %s\n", len(removed), units.HumanSize(float64(freed)))
+
+							return nil
+						},
+					},
+					{
+						Name:  "clear",
+						Usage: "Remove all packages from the cache",
+						Flags: append([]cli.Flag{
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "Also remove cached package indexes and HTTP responses",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							if c.Bool("all") {
+								entries, err := os.ReadDir(c.String("cache-dir"))
+								if err != nil {
+									return fmt.Errorf("failed to read cache directory: %w", err)
+								}
+
+								for _, e := range entries {
+									if err := os.RemoveAll(filepath.Join(c.String("cache-dir"), e.Name())); err != nil {
+										return fmt.Errorf("failed to remove %s: %w", e.Name(), err)
+									}
+								}
+
+								return nil
+							}
+
+							debStore, err := debstore.New(filepath.Join(c.String("cache-dir"), "debs"))
+							if err != nil {
+								return fmt.Errorf("failed to open package store: %w", err)
+							}
+
+							return debStore.Clear()
+						},
+					},
+				},
+			},
+			{
+				Name:        "second-stage",
+				Description: "Operations that will be run after the image is built",
+				Hidden:      true,
+				Subcommands: []*cli.Command{
+					{
+						// MergeUsr is a separate command as it needs to be run before
+						// packages are configured.
+						Name:        "merge-usr",
+						Description: "Merge the /usr directory into the root filesystem",
+						Flags:       persistentFlags,
+						Before:      util.BeforeAll(initLogger),
+						Action: func(_ *cli.Context) error {
+							return secondstage.MergeUsr()
+						},
+					},
+					{
+						Name:        "unpack",
+						Description: "Unpack a root filesystem archive on top of the image",
+						ArgsUsage:   "ARCHIVE",
+						Flags:       persistentFlags,
+						Before:      util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expected a single archive")
+							}
+
+							return secondstage.Unpack(c.Args().First(), "/")
+						},
+					},
+					{
+						Name:        "provision",
+						Description: "Set up the image with the requested recipe",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "filename",
+								Aliases:  []string{"f"},
+								Usage:    "Recipe file to use",
+								Required: true,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							// Load the recipe file.
+							recipeFile, err := os.Open(c.String("filename"))
+							if err != nil {
+								return fmt.Errorf("failed to open recipe file: %w", err)
+							}
+							defer recipeFile.Close()
+
+							recipe, err := recipe.FromYAML(recipeFile)
+							if err != nil {
+								return fmt.Errorf("failed to read recipe: %w", err)
+							}
+
+							return secondstage.Provision(c.Context, recipe)
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		slog.Error("Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// loadRecipe reads the recipe from the provided file.
+func loadRecipe(filename string) (*latestrecipe.Recipe, error) {
+	recipeFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recipe file: %w", err)
+	}
+	defer recipeFile.Close()
+
+	r, err := recipe.FromYAML(recipeFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipe: %w", err)
+	}
+
+	// Local paths in the recipe are relative to the recipe file.
+	recipeDir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recipe directory: %w", err)
+	}
+
+	recipe.ResolvePaths(r, recipeDir)
+
+	return r, nil
+}
+
+// saveRecipe writes the recipe to the provided file.
+func saveRecipe(filename string, r *latestrecipe.Recipe) error {
+	recipeFile, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create recipe file: %w", err)
+	}
+	defer recipeFile.Close()
+
+	if err := recipe.ToYAML(recipeFile, r); err != nil {
+		return err
+	}
+
+	if err := recipeFile.Close(); err != nil {
+		return fmt.Errorf("failed to close recipe file: %w", err)
+	}
+
+	return nil
+}
+
+// loadSourcesPackageDB loads the packages available from the sources of the
+// recipe, for the platform selected on the command line.
+func loadSourcesPackageDB(c *cli.Context) (*database.PackageDB, error) {
+	packagesCache, err := source.NewPackagesCache(filepath.Join(c.String("cache-dir"), "packages"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create packages cache: %w", err)
+	}
+
+	recipe, err := loadRecipe(c.String("filename"))
+	if err != nil {
+		return nil, err
+	}
+
+	platform, err := platforms.Parse(c.String("platform"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse platform: %w", err)
+	}
+
+	packageDB, _, err := loadPackageDB(c.Context, recipe, platform, packagesCache)
+	return packageDB, err
+}
+
+// newProgress creates a progress container (that is hidden when debug logging
+// is enabled, as it would be interleaved with the logs).
+func newProgress(ctx context.Context) *mpb.Progress {
+	var progressOutput io.Writer = os.Stdout
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		progressOutput = io.Discard
+	}
+
+	return mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
+}
+
+// loadComponents returns the repository components of all the sources
+// referenced by the recipe, for the target platform.
+func loadComponents(ctx context.Context, progress *mpb.Progress, recipe *latestrecipe.Recipe, platform ocispecs.Platform) ([]source.Component, error) {
+	var componentsMu sync.Mutex
+	var components []source.Component
+
+	// Resources that are not available in the cache (during an offline build).
+	var missing missingResources
+
+	sourceConfs := append([]latestrecipe.SourceConfig{}, recipe.Sources...)
+
+	if !(recipe.Options != nil && recipe.Options.OmitUpstreamAPT) {
+		sourceConfs = append([]latestrecipe.SourceConfig{
+			{
+				URL:      constants.UpstreamAPTURL,
+				SignedBy: constants.UpstreamAPTSignedBy,
+				// Given debco is only linked to libc, this should be "fine".
+				Distribution: "bookworm",
+				Components:   []string{"stable"},
+			},
+		}, sourceConfs...)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	bar := progress.AddBar(int64(len(sourceConfs)),
+		mpb.PrependDecorators(
+			decor.Name("Source: "),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+		),
+	)
+
+	for _, sourceConf := range sourceConfs {
+		sourceConf := sourceConf
+
+		g.Go(func() error {
+			defer bar.Increment()
+
+			s, err := source.NewSource(ctx, sourceConf)
+			if err != nil {
+				if missing.add(err) {
+					return nil
+				}
+
+				return fmt.Errorf("failed to create source: %w", err)
+			}
+
+			targetArch, err := arch.Parse(platform.Architecture)
+			if err != nil {
+				return fmt.Errorf("failed to parse target architecture: %w", err)
+			}
+
+			sourceComponents, err := s.Components(ctx, targetArch)
+			if err != nil {
+				if missing.add(err) {
+					return nil
+				}
+
+				return fmt.Errorf("failed to get components: %w", err)
+			}
+
+			componentsMu.Lock()
+			components = append(components, sourceComponents...)
+			componentsMu.Unlock()
+
+			return nil
+		})
+	}
+
+	err := g.Wait()
+
+	if err != nil {
+		bar.Abort(true)
+	} else {
+		bar.SetTotal(bar.Current(), true)
+	}
+	bar.Wait()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get components: %w", err)
+	}
+
+	if err := missing.err(); err != nil {
+		return nil, err
+	}
+
+	return components, nil
+}
+
+// searchContents searches the Contents indexes of all the sources referenced
+// by the recipe for files that satisfy the match function (see
+// source.SearchContents).
+func searchContents(ctx context.Context, recipe *latestrecipe.Recipe, platform ocispecs.Platform, match func(path string) bool) ([]source.ContentsEntry, error) {
+	progress := newProgress(ctx)
+	defer progress.Shutdown()
+
+	components, err := loadComponents(ctx, progress, recipe, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	bar := progress.AddBar(int64(len(components)),
+		mpb.PrependDecorators(
+			decor.Name("Contents: "),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+		),
+	)
+
+	entries, err := source.SearchContents(ctx, components, match, bar.Increment)
+
+	if err != nil {
+		bar.Abort(true)
+	} else {
+		bar.SetTotal(bar.Current(), true)
+	}
+	bar.Wait()
+
+	return entries, err
+}
+
+// missingResources collects the resources that are not available in the
+// cache during an offline build, so they can all be reported at once.
+type missingResources struct {
+	mu        sync.Mutex
+	resources []string
+}
+
+// add records the resource if the error was caused by it not being cached.
+func (m *missingResources) add(err error) bool {
+	var notCached *diskcache.NotCachedError
+	if !errors.As(err, &notCached) {
+		return false
+	}
+
+	m.record(notCached.URL)
+
+	return true
+}
+
+func (m *missingResources) record(resource string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !slices.Contains(m.resources, resource) {
+		m.resources = append(m.resources, resource)
+	}
+}
+
+func (m *missingResources) err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.resources) == 0 {
+		return nil
+	}
+
+	slices.Sort(m.resources)
+
+	return fmt.Errorf("not available offline (run an online build to populate the cache): %s",
+		strings.Join(m.resources, ", "))
+}
+
+// checkStoredPackages checks that all the selected packages are available
+// without downloading them.
+func checkStoredPackages(selectedDB *database.PackageDB, debStore *debstore.Store) error {
+	var missing missingResources
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		// Packages in local repositories can always be downloaded.
+		if pkg.LocalPath == "" && !slices.ContainsFunc(pkg.URLs, isLocalURL) {
+			if _, ok := debStore.Get(pkg.SHA256); !ok {
+				missing.record(fmt.Sprintf("%s=%s (%s)", pkg.Name, pkg.Version, pkg.Architecture))
+			}
+		}
+
+		return nil
+	})
+
+	return missing.err()
+}
+
+// dirSize returns the total size of the files in the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+
+	return size, nil
+}
+
+func loadPackageDB(ctx context.Context, recipe *latestrecipe.Recipe, platform ocispecs.Platform, packagesCache *source.PackagesCache) (*database.PackageDB, time.Time, error) {
+	progress := newProgress(ctx)
+	defer progress.Shutdown()
+
+	components, err := loadComponents(ctx, progress, recipe, platform)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	packageDB := database.NewPackageDB()
+
+	// Resources that are not available in the cache (during an offline build).
+	var missing missingResources
 
 	var sourceDateEpoch time.Time
 	{
@@ -464,9 +1800,23 @@ func loadPackageDB(ctx context.Context, recipe *latestrecipe.Recipe, platform oc
 			g.Go(func() error {
 				defer bar.Increment()
 
-				componentPackages, lastUpdated, err := component.Packages(ctx)
-				if err != nil {
-					return fmt.Errorf("failed to get packages: %w", err)
+				// Use the previously parsed packages if the release hasn't changed.
+				componentPackages, lastUpdated, ok := packagesCache.Get(&component)
+				if !ok {
+					var err error
+					componentPackages, lastUpdated, err = component.Packages(ctx)
+					if err != nil {
+						if missing.add(err) {
+							return nil
+						}
+
+						return fmt.Errorf("failed to get packages: %w", err)
+					}
+
+					if err := packagesCache.Put(&component, componentPackages, lastUpdated); err != nil {
+						slog.Warn("Failed to cache packages",
+							slog.String("component", component.URL.String()), slog.Any("error", err))
+					}
 				}
 
 				if lastUpdated.After(sourceDateEpoch) {
@@ -493,10 +1843,15 @@ func loadPackageDB(ctx context.Context, recipe *latestrecipe.Recipe, platform oc
 		}
 	}
 
+	if err := missing.err(); err != nil {
+		return nil, time.Time{}, err
+	}
+
 	return packageDB, sourceDateEpoch, nil
 }
 
-func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *database.PackageDB) ([]string, error) {
+func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *database.PackageDB,
+	debStore *debstore.Store, downloader *download.Downloader, maxConcurrency int) ([]string, error) {
 	var progressOutput io.Writer = os.Stdout
 	if slog.Default().Enabled(ctx, slog.LevelDebug) {
 		progressOutput = io.Discard
@@ -516,7 +1871,7 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 	)
 
 	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(10)
+	g.SetLimit(maxConcurrency)
 
 	var packagePathsMu sync.Mutex
 	var packagePaths []string
@@ -525,24 +1880,44 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 		g.Go(func() error {
 			defer bar.Increment()
 
-			var errs error
-			for _, pkgURL := range util.Shuffle(pkg.URLs) {
-				slog.Debug("Downloading package", slog.String("url", pkgURL))
-
-				packagePath, err := downloadPackage(ctx, tempDir, pkgURL, pkg.SHA256)
-				errs = errors.Join(errs, err)
-				if err == nil {
-					packagePathsMu.Lock()
-					packagePaths = append(packagePaths, packagePath)
-					packagePathsMu.Unlock()
-					errs = nil
-					break
+			// Local packages don't need to be downloaded.
+			if pkg.LocalPath != "" {
+				packagePathsMu.Lock()
+				packagePaths = append(packagePaths, pkg.LocalPath)
+				packagePathsMu.Unlock()
+
+				return nil
+			}
+
+			// Check if we already have the package before downloading it.
+			storedPath, ok := debStore.Get(pkg.SHA256)
+			if !ok {
+				var errs error
+				for _, pkgURL := range util.Shuffle(pkg.URLs) {
+					slog.Debug("Downloading package", slog.String("url", pkgURL))
+
+					var err error
+					storedPath, err = downloadPackage(ctx, debStore, downloader, pkgURL, pkg.SHA256)
+					errs = errors.Join(errs, err)
+					if err == nil {
+						errs = nil
+						break
+					}
+				}
+				if errs != nil {
+					return fmt.Errorf("failed to download package: %w", errs)
 				}
 			}
-			if errs != nil {
-				return fmt.Errorf("failed to download package: %w", errs)
+
+			packagePath := filepath.Join(tempDir, filepath.Base(pkg.Filename))
+			if err := linkOrCopy(storedPath, packagePath); err != nil {
+				return fmt.Errorf("failed to copy package %s: %w", pkg.Name, err)
 			}
 
+			packagePathsMu.Lock()
+			packagePaths = append(packagePaths, packagePath)
+			packagePathsMu.Unlock()
+
 			return nil
 		})
 
@@ -568,43 +1943,248 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 	return packagePaths, nil
 }
 
-func downloadPackage(ctx context.Context, downloadDir, pkgURL, sha256 string) (string, error) {
-	url, err := url.Parse(pkgURL)
+// packageClient is used to download packages. Packages are kept in the
+// package store, so there is no need to also cache them as HTTP responses.
+var packageClient = &http.Client{Transport: newTransport()}
+
+// newTransport returns a HTTP transport that also supports file:// URLs (for
+// local repositories).
+func newTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return transport
+}
+
+// isLocalURL returns true if the URL refers to a file on the local filesystem.
+func isLocalURL(u string) bool {
+	return strings.HasPrefix(u, "file://")
+}
+
+func downloadPackage(ctx context.Context, debStore *debstore.Store, downloader *download.Downloader, pkgURL, sha256 string) (string, error) {
+	partialPath, unlock, err := debStore.LockPartial(ctx, sha256)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// Another process may have downloaded the package while we were waiting.
+	if path, ok := debStore.Get(sha256); ok {
+		return path, nil
+	}
+
+	// Incomplete downloads are resumed from the partial file.
+	if err := downloader.Download(ctx, pkgURL, partialPath); err != nil {
+		return "", err
+	}
+
+	return debStore.Commit(sha256)
+}
+
+// newDownloader creates a package downloader configured by the recipe (and
+// any command line overrides). It also returns the maximum number of
+// concurrent downloads.
+func newDownloader(c *cli.Context, recipe *latestrecipe.Recipe) (*download.Downloader, int, error) {
+	opts := download.Options{
+		Client:                packageClient,
+		Retries:               download.DefaultRetries,
+		MaxConcurrencyPerHost: download.DefaultMaxConcurrencyPerHost,
+	}
+	maxConcurrency := download.DefaultMaxConcurrency
+
+	var bandwidthLimit string
+	if recipe.Options != nil && recipe.Options.Download != nil {
+		downloadConf := recipe.Options.Download
+
+		if downloadConf.Retries != nil {
+			opts.Retries = *downloadConf.Retries
+		}
+		if downloadConf.MaxConcurrency > 0 {
+			maxConcurrency = downloadConf.MaxConcurrency
+		}
+		if downloadConf.MaxConcurrencyPerHost > 0 {
+			opts.MaxConcurrencyPerHost = downloadConf.MaxConcurrencyPerHost
+		}
+		bandwidthLimit = downloadConf.BandwidthLimit
+	}
+
+	// Command line flags take precedence over the recipe.
+	if c.IsSet("download-retries") {
+		opts.Retries = c.Int("download-retries")
+	}
+	if c.IsSet("max-concurrent-downloads") {
+		maxConcurrency = c.Int("max-concurrent-downloads")
+	}
+	if c.IsSet("max-concurrent-downloads-per-host") {
+		opts.MaxConcurrencyPerHost = c.Int("max-concurrent-downloads-per-host")
+	}
+	if c.IsSet("bandwidth-limit") {
+		bandwidthLimit = c.String("bandwidth-limit")
+	}
+
+	if maxConcurrency <= 0 {
+		return nil, 0, fmt.Errorf("maximum concurrent downloads must be positive")
+	}
+
+	if bandwidthLimit != "" {
+		var err error
+		opts.BandwidthLimit, err = units.FromHumanSize(bandwidthLimit)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid bandwidth limit: %w", err)
+		}
+	}
+
+	return download.New(opts), maxConcurrency, nil
+}
+
+// linkOrCopy hard links the file to the destination, falling back to copying
+// it (eg. if the destination is on a different filesystem).
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+
+	return dstFile.Close()
+}
+
+// loadRecipePackages reads (or generates) the local packages referenced by the
+// recipe, returning the remaining included package names and versions.
+func loadRecipePackages(generatedDir string, recipe *latestrecipe.Recipe) ([]string, []types.Package, error) {
+	// Read any local package files referenced by the recipe.
+	includeNameVersions, localPackages, err := localpkg.Load(recipe.Packages.Include)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse package URL: %w", err)
+		return nil, nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	// Generate any dummy packages declared in the recipe.
+	dummyPackages, err := localpkg.BuildDummy(generatedDir, recipe.Packages.Dummy)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, nil, err
 	}
+	localPackages = append(localPackages, dummyPackages...)
 
-	resp, err := http.DefaultClient.Do(req)
+	// Bundle local files into generated packages (so they are owned by dpkg).
+	generatedPackages, err := localpkg.BuildGenerated(generatedDir, recipe.Packages.Generated)
 	if err != nil {
-		return "", fmt.Errorf("failed to download package: %w", err)
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
+	localPackages = append(localPackages, generatedPackages...)
 
-	// Read the package completely so the cache can be populated.
-	hr := hashreader.NewReader(resp.Body)
+	return includeNameVersions, localPackages, nil
+}
 
-	packageFile, err := os.Create(filepath.Join(downloadDir, filepath.Base(url.Path)))
+// selectPackages resolves the set of packages that will be installed into the
+// image for the given platform.
+func selectPackages(packageDB *database.PackageDB, recipe *latestrecipe.Recipe, platform ocispecs.Platform,
+	includeNameVersions []string, localPackages []types.Package, installDebco bool) (*database.PackageDB, error) {
+	// Install local and generated packages built for the target architecture.
+	requiredNameVersions, err := localpkg.Add(packageDB, platform, localPackages)
 	if err != nil {
-		return "", fmt.Errorf("failed to create package file: %w", err)
+		return nil, err
+	}
+
+	// By default, install the debco binary (for second-stage provisioning).
+	if installDebco {
+		requiredNameVersions = append(requiredNameVersions, "debco")
+	}
+
+	// By default, install all priority required packages.
+	if !(recipe.Options != nil && recipe.Options.OmitRequired) {
+		_ = packageDB.ForEach(func(pkg types.Package) error {
+			if pkg.Priority == "required" {
+				requiredNameVersions = append(requiredNameVersions, pkg.Package.Name)
+			}
+
+			return nil
+		})
+	}
+
+	return resolve.Resolve(packageDB,
+		append(requiredNameVersions, includeNameVersions...),
+		recipe.Packages.Exclude, recipe.Packages.PreferredProviders)
+}
+
+// newBuildKit returns a BuildKit instance for the BuildKit daemon configured by
+// the command line flags (or recipe), see buildkit.FromConfig.
+func newBuildKit(c *cli.Context, recipe *latestrecipe.Recipe) (*buildkit.BuildKit, error) {
+	var buildkitConf latestrecipe.BuildKitConfig
+	if recipe.Options != nil && recipe.Options.BuildKit != nil {
+		buildkitConf = *recipe.Options.BuildKit
 	}
-	defer packageFile.Close()
 
-	if _, err := io.Copy(packageFile, hr); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to read package: %w", err)
+	// Command line flags take precedence over the recipe.
+	if c.IsSet("buildkit-addr") {
+		buildkitConf.Address = c.String("buildkit-addr")
 	}
+	if c.IsSet("buildkit-tlscacert") {
+		buildkitConf.CACert = c.String("buildkit-tlscacert")
+	}
+	if c.IsSet("buildkit-tlscert") {
+		buildkitConf.Cert = c.String("buildkit-tlscert")
+	}
+	if c.IsSet("buildkit-tlskey") {
+		buildkitConf.Key = c.String("buildkit-tlskey")
+	}
+	if c.IsSet("buildkit-tlsservername") {
+		buildkitConf.ServerName = c.String("buildkit-tlsservername")
+	}
+
+	return buildkit.FromConfig(c.Context, buildkitConf, c.String("state-dir"))
+}
+
+type packageSummary struct {
+	Name         string `json:"Package"`
+	Version      string `json:"Version"`
+	Architecture string `json:"Architecture"`
+	Description  string `json:"Description"`
+}
+
+type packageDetails struct {
+	debtypes.Package
+	// Sources lists the repositories the package is available from.
+	Sources []string `json:"APT-Sources,omitempty"`
+}
+
+// packageSources returns the base URLs of the repositories that the package
+// can be downloaded from.
+func packageSources(pkg types.Package) []string {
+	var sources []string
+	for _, pkgURL := range pkg.URLs {
+		sources = append(sources, strings.TrimSuffix(pkgURL, "/"+pkg.Filename))
+	}
+
+	return sources
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
 
-	if err := hr.Verify(sha256); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to verify package: %w", err)
+// signingKeyPath returns the path of the private key used to sign local
+// repositories.
+func signingKeyPath(c *cli.Context) string {
+	if c.IsSet("signing-key") {
+		return c.String("signing-key")
 	}
 
-	return packageFile.Name(), nil
+	return filepath.Join(c.String("state-dir"), "repo", "signing_key.asc")
 }
 
 func toOCIImageConfig(recipe *latestrecipe.Recipe) ocispecs.ImageConfig {